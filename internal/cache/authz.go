@@ -0,0 +1,149 @@
+package cache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mtvy/cached_updater/internal/metrics"
+	"github.com/mtvy/cached_updater/internal/userdata"
+	"github.com/mtvy/cached_updater/pkg"
+)
+
+const (
+	// Token не прошёл проверку
+	cacheTokenRejected = "cache_token_rejected"
+	// У token'а нет нужных ролей
+	cacheTokenForbidden = "cache_token_forbidden"
+
+	// defaultVerifiedTokenTTL - Сколько помним проверенный token, если не задано в Config
+	defaultVerifiedTokenTTL = time.Minute
+	// verifiedTokensSweepThreshold - Размер verifiedTokens, после которого при записи удаляем истёкшие
+	verifiedTokensSweepThreshold = 10000
+)
+
+var (
+	// ErrUnauthorized - Token не прошёл проверку подписи или срока действия, errors.Is(err, pkg.ErrUnauthorized) == true
+	ErrUnauthorized = fmt.Errorf("access token is not valid: %w", pkg.ErrUnauthorized)
+	// ErrForbidden - У token'а нет ролей, нужных для чтения user'ов, errors.Is(err, pkg.ErrForbidden) == true
+	ErrForbidden = fmt.Errorf("access token lacks required roles: %w", pkg.ErrForbidden)
+)
+
+// defaultRequiredClientRoles - Роли, которые проверяются, если в Config не заданы никакие
+var defaultRequiredClientRoles = map[string][]string{
+	"realm-management": {"view-users"},
+}
+
+// TokenVerifier - Проверяет access token realm'а и отдаёт его claims
+type TokenVerifier interface {
+	VerifyToken(ctx context.Context, accessToken, realm string) (*userdata.TokenClaims, error)
+}
+
+// verifiedToken - Результат проверки token'а
+type verifiedToken struct {
+	claims   *userdata.TokenClaims
+	deadline time.Time
+}
+
+// verifiedTokens - Помнит проверенные token'ы, чтобы не проверять подпись на каждый запрос.
+// Ключ - hash token'а и realm, сами token'ы не храним
+type verifiedTokens struct {
+	ttl time.Duration
+	sync.RWMutex
+	tokens map[string]verifiedToken
+}
+
+func newVerifiedTokens(ttl time.Duration) *verifiedTokens {
+	if ttl <= 0 {
+		ttl = defaultVerifiedTokenTTL
+	}
+	return &verifiedTokens{
+		ttl:    ttl,
+		tokens: make(map[string]verifiedToken),
+	}
+}
+
+func verifiedTokenKey(realm, accessToken string) string {
+	sum := sha256.Sum256([]byte(accessToken))
+	return realm + "/" + hex.EncodeToString(sum[:])
+}
+
+// Get - Достаём claims проверенного и ещё не истёкшего token'а
+func (v *verifiedTokens) Get(realm, accessToken string) (*userdata.TokenClaims, bool) {
+	v.RLock()
+	defer v.RUnlock()
+	verified, ok := v.tokens[verifiedTokenKey(realm, accessToken)]
+	if !ok || !verified.deadline.After(time.Now()) {
+		return nil, false
+	}
+	return verified.claims, true
+}
+
+// Add - Запоминаем проверенный token не дольше ttl и не дольше его exp
+func (v *verifiedTokens) Add(realm, accessToken string, claims *userdata.TokenClaims) {
+	now := time.Now()
+	deadline := now.Add(v.ttl)
+	if !claims.ExpiresAt.IsZero() && claims.ExpiresAt.Before(deadline) {
+		deadline = claims.ExpiresAt
+	}
+	v.Lock()
+	defer v.Unlock()
+	if len(v.tokens) >= verifiedTokensSweepThreshold {
+		for key, verified := range v.tokens {
+			if !verified.deadline.After(now) {
+				delete(v.tokens, key)
+			}
+		}
+	}
+	v.tokens[verifiedTokenKey(realm, accessToken)] = verifiedToken{claims: claims, deadline: deadline}
+}
+
+// authorize - Проверяем token перед чтением user'ов. Без Config.Verifier проверка выключена
+func (c *cacheDecorator) authorize(ctx context.Context, accessToken, realm string) error {
+	if c.cfg.Verifier == nil {
+		return nil
+	}
+	claims, ok := c.verified.Get(realm, accessToken)
+	if !ok {
+		if accessToken == "" {
+			metrics.IncKeycloakCacheEvent(realm, cacheTokenRejected)
+			return ErrUnauthorized
+		}
+		var err error
+		claims, err = c.cfg.Verifier.VerifyToken(ctx, accessToken, realm)
+		if err != nil || claims == nil {
+			metrics.IncKeycloakCacheEvent(realm, cacheTokenRejected)
+			return ErrUnauthorized
+		}
+		c.verified.Add(realm, accessToken, claims)
+	}
+	if !c.hasRequiredRoles(claims) {
+		metrics.IncKeycloakCacheEvent(realm, cacheTokenForbidden)
+		return ErrForbidden
+	}
+	return nil
+}
+
+// hasRequiredRoles - Есть ли у token'а все роли из Config
+func (c *cacheDecorator) hasRequiredRoles(claims *userdata.TokenClaims) bool {
+	realmRoles, clientRoles := c.cfg.RequiredRealmRoles, c.cfg.RequiredClientRoles
+	if len(realmRoles) == 0 && len(clientRoles) == 0 {
+		clientRoles = defaultRequiredClientRoles
+	}
+	for _, role := range realmRoles {
+		if !claims.HasRealmRole(role) {
+			return false
+		}
+	}
+	for clientID, roles := range clientRoles {
+		for _, role := range roles {
+			if !claims.HasClientRole(clientID, role) {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,84 @@
+package cache
+
+import (
+	"context"
+
+	"github.com/mtvy/cached_updater/internal/userdata"
+	"golang.org/x/sync/errgroup"
+)
+
+const defaultBatchConcurrency = 8
+
+// BatchResult - Результат операции над одним user'ом batch'а.
+// Результаты идут в том же порядке, что и user'ы на входе
+type BatchResult struct {
+	// ID созданного user'а в CreateUsers, переданный ID в UpdateUsers и GetUsersByIDs
+	UserID string
+	// User в GetUsersByIDs, может быть вместе с *StaleError
+	User *userdata.User
+	// Ошибка операции над этим user'ом, на остальные user'ы batch'а не влияет
+	Err error
+}
+
+// CreateUsers - Заводим user'ов в keycloak не более чем в cfg.BatchConcurrency походов одновременно
+func (c *cacheDecorator) CreateUsers(ctx context.Context, token, realm string, users []userdata.User) []BatchResult {
+	results := make([]BatchResult, len(users))
+	c.forEach(ctx, len(users), func(ctx context.Context, i int) {
+		results[i].UserID, results[i].Err = c.CreateUser(ctx, token, realm, users[i])
+	})
+	return results
+}
+
+// UpdateUsers - Обновляем user'ов в keycloak не более чем в cfg.BatchConcurrency походов одновременно
+func (c *cacheDecorator) UpdateUsers(ctx context.Context, token, realm string, users []userdata.User) []BatchResult {
+	results := make([]BatchResult, len(users))
+	for i, user := range users {
+		if user.ID != nil {
+			results[i].UserID = *user.ID
+		}
+	}
+	c.forEach(ctx, len(users), func(ctx context.Context, i int) {
+		results[i].Err = c.UpdateUser(ctx, token, realm, users[i])
+	})
+	return results
+}
+
+// GetUsersByIDs - Получаем user'ов по userID. Найденные в cache отдаём сразу,
+// за остальными идём в keycloak не более чем в cfg.BatchConcurrency походов одновременно
+func (c *cacheDecorator) GetUsersByIDs(ctx context.Context, accessToken, realm string, userIDs []string) []BatchResult {
+	results := make([]BatchResult, len(userIDs))
+	err := c.authorize(ctx, accessToken, realm)
+	misses := make([]int, 0, len(userIDs))
+	for i, userID := range userIDs {
+		results[i].UserID = userID
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		if user, err := c.userProvider.GetUserByUserID(ctx, realm, userID); err == nil {
+			results[i].User = &user
+			continue
+		}
+		misses = append(misses, i)
+	}
+	c.forEach(ctx, len(misses), func(ctx context.Context, i int) {
+		result := &results[misses[i]]
+		result.User, result.Err = c.getUserByID(ctx, accessToken, realm, result.UserID)
+	})
+	return results
+}
+
+// forEach - Вызываем fn для каждого индекса из [0, n) не более чем в cfg.BatchConcurrency горутинах.
+// Отмена ctx не прерывает batch: оставшиеся походы в keycloak вернут ошибку ctx
+func (c *cacheDecorator) forEach(ctx context.Context, n int, fn func(ctx context.Context, i int)) {
+	var group errgroup.Group
+	group.SetLimit(c.cfg.BatchConcurrency)
+	for i := 0; i < n; i++ {
+		i := i
+		group.Go(func() error {
+			fn(ctx, i)
+			return nil
+		})
+	}
+	group.Wait()
+}
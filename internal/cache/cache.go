@@ -2,10 +2,18 @@ package cache
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/mtvy/cached_updater/internal/invalidation"
 	"github.com/mtvy/cached_updater/internal/metrics"
 	"github.com/mtvy/cached_updater/internal/userdata"
 	"github.com/mtvy/cached_updater/pkg"
+	"golang.org/x/sync/singleflight"
 )
 
 const (
@@ -13,15 +21,91 @@ const (
 	getCacheUsersErr    = "cache_error_get_user_by_email"
 	getKeycloakUsers    = "keycloak_get_users"
 	getKeycloakUsersErr = "keycloak_error_get_user_by_email"
+	// Поход в keycloak не выполнялся, результат получен от параллельного запроса
+	keycloakDeduplicated = "keycloak_deduplicated"
+	// Отдали просроченного user'а
+	cacheServedStale = "cache_served_stale"
+	// Отдали промах из negativeCache без похода в keycloak
+	cacheNegativeHit = "cache_negative_hit"
+	// Не удалось разослать инвалидацию другим репликам
+	invalidationPublishErr = "invalidation_publish_error"
+	// Применили инвалидацию, полученную от другой реплики
+	invalidationApplied = "invalidation_applied"
+	// Отдали результат запроса GetUsers из queryCache
+	cacheQueryHit = "cache_query_hit"
 )
 
+// defaultUpstreamTimeout - Таймаут общего похода в keycloak и фонового обновления, если не задан Config.UpstreamTimeout.
+// Такие походы не отменяются вместе с запросом, поэтому всегда ограничены по времени
+const defaultUpstreamTimeout = 10 * time.Second
+
 type cachedUsersProvider interface {
-	// SetUser - Сеттим новое значение в маппу с lock
-	SetUser(ctx context.Context, userID, email string, newUser userdata.User)
-	// SetUGetUserByUserIDser - Безопасно достаём User'а по userID
-	GetUserByUserID(ctx context.Context, userID string) (userdata.User, error)
-	// GetUserByEmail - Безопасно достаём User'а по email
-	GetUserByEmail(ctx context.Context, email string) (userdata.User, error)
+	// SetUser - Сеттим новое значение в маппу realm'а с lock
+	SetUser(ctx context.Context, realm, userID, email string, newUser userdata.User)
+	// GetUserByUserID - Безопасно достаём User'а realm'а по userID
+	GetUserByUserID(ctx context.Context, realm, userID string) (userdata.User, error)
+	// GetUserByEmail - Безопасно достаём User'а realm'а по email
+	GetUserByEmail(ctx context.Context, realm, email string) (userdata.User, error)
+	// GetStaleUserByUserID - Достаём User'а realm'а по userID, в том числе просроченного
+	GetStaleUserByUserID(ctx context.Context, realm, userID string) (userdata.User, error)
+	// GetStaleUserByEmail - Достаём User'а realm'а по email, в том числе просроченного
+	GetStaleUserByEmail(ctx context.Context, realm, email string) (userdata.User, error)
+	// GetUserByIndex - Безопасно достаём User'а realm'а по значению дополнительного индекса
+	GetUserByIndex(ctx context.Context, realm, index, value string) (userdata.User, error)
+	// InvalidateUser - Удаляем user'а realm'а вместе со всеми его ключами
+	InvalidateUser(ctx context.Context, realm, userID string)
+	// InvalidateRealm - Удаляем всех user'ов realm'а
+	InvalidateRealm(ctx context.Context, realm string)
+	// Purge - Удаляем user'ов всех realm'ов
+	Purge(ctx context.Context)
+}
+
+// Config - Настройки cacheDecorator
+type Config struct {
+	// Таймаут похода в keycloak за user'ом, если не задан - используем defaultUpstreamTimeout
+	UpstreamTimeout time.Duration
+	// Отдавать просроченного user'а с *StaleError, если keycloak вернул ошибку или не ответил
+	ServeStaleOnError bool
+	// Сразу отдавать просроченного user'а с *StaleError и обновлять его в фоне
+	StaleWhileRevalidate bool
+	// Время жизни записи о том, что user'а нет в keycloak, 0 - промахи не кэшируются
+	NegativeTTL time.Duration
+	// Время жизни результатов прочих запросов GetUsers (Search, Q, Enabled, First/Max и т.д.),
+	// 0 - такие запросы всегда идут в keycloak. Результаты realm'а сбрасываются при любой записи в нём.
+	// Запросы по неуникальным индексам тоже запоминаются: так значение атрибута,
+	// которое есть у нескольких user'ов, отдаётся из cache целиком
+	QueryTTL time.Duration
+	// Атрибуты, значения которых keycloak держит уникальными, например через валидатор user profile.
+	// Запросы по ним и по username отдаются из индекса провайдера. Индекс остальных атрибутов
+	// знает только user'ов в cache, поэтому запросы по ним идут в keycloak или queryCache
+	UniqueIndexes []string
+	// Время жизни эффективных ролей user'а в GetEffectiveRoles, 0 - роли всегда идут в keycloak
+	RolesTTL time.Duration
+
+	// Проверка token'а перед чтением user'ов, nil - token не проверяется и cache отдаётся любому
+	Verifier TokenVerifier
+	// Сколько помним проверенный token (не дольше его exp), если не задано - defaultVerifiedTokenTTL
+	VerifiedTokenTTL time.Duration
+	// Роли realm'а, которые должны быть у token'а
+	RequiredRealmRoles []string
+	// Ключ - clientID, значение - роли client'а, которые должны быть у token'а.
+	// Если не заданы ни эти, ни RequiredRealmRoles - требуем realm-management/view-users
+	RequiredClientRoles map[string][]string
+	// Шина, через которую изменения user'ов рассылаются другим репликам, nil - без рассылки
+	Bus invalidation.Bus
+	// Идентификатор реплики в событиях шины, пустой - генерируется случайный
+	ReplicaID string
+	// Количество одновременных походов в keycloak в CreateUsers, UpdateUsers и GetUsersByIDs,
+	// если не задано - используем defaultBatchConcurrency
+	BatchConcurrency int
+}
+
+// localInvalidator - Провайдер, у которого есть локальный уровень.
+// События от других реплик сбрасывают только его: общий уровень уже обновила реплика-отправитель.
+// Провайдер без локального уровня (общий redis) по событиям не сбрасывается
+type localInvalidator interface {
+	InvalidateLocalUser(ctx context.Context, realm, userID string)
+	InvalidateLocalRealm(ctx context.Context, realm string)
 }
 
 type UserAdapter interface {
@@ -34,12 +118,39 @@ type cacheDecorator struct {
 	userAdapter UserAdapter
 	// Провайдер кээшированных пользователей
 	userProvider cachedUsersProvider
+	// Объединяет одновременные походы в keycloak за одним и тем же ключом
+	group singleflight.Group
+	// Ключи, фоновое обновление которых уже идёт
+	revalidating sync.Map
+	// Поколения user'ов, за которыми идут в keycloak
+	generations *userGenerations
+	cfg         Config
+	// Промахи по userID и email
+	negative *negativeCache
+	// Результаты прочих запросов GetUsers
+	queries *queryCache
+	// Проверенные token'ы
+	verified *verifiedTokens
+	// Эффективные роли user'ов
+	roles *rolesCache
 }
 
-func NewCacheDecorator(userAdapter UserAdapter, userProvider cachedUsersProvider) *cacheDecorator {
+func NewCacheDecorator(userAdapter UserAdapter, userProvider cachedUsersProvider, cfg Config) *cacheDecorator {
+	if cfg.Bus != nil && cfg.ReplicaID == "" {
+		cfg.ReplicaID = newReplicaID()
+	}
+	if cfg.BatchConcurrency <= 0 {
+		cfg.BatchConcurrency = defaultBatchConcurrency
+	}
 	return &cacheDecorator{
 		userAdapter:  userAdapter,
 		userProvider: userProvider,
+		cfg:          cfg,
+		generations:  newUserGenerations(),
+		negative:     newNegativeCache(cfg.NegativeTTL),
+		queries:      newQueryCache(cfg.QueryTTL),
+		verified:     newVerifiedTokens(cfg.VerifiedTokenTTL),
+		roles:        newRolesCache(cfg.RolesTTL),
 	}
 }
 
@@ -54,26 +165,197 @@ func (c *cacheDecorator) CreateUser(ctx context.Context, token, realm string, us
 	if user.Email != nil {
 		email = *user.Email
 	}
-	c.userProvider.SetUser(ctx, userID, email, user)
+	c.generations.Bump(realm, userID)
+	c.negative.Delete(userIDKey(realm, userID), emailKey(realm, email))
+	c.queries.DeleteRealm(realm)
+	cachedUser := user.WithoutSecrets()
+	cachedUser.ID = &userID
+	c.userProvider.SetUser(ctx, realm, userID, email, cachedUser)
+	c.publish(ctx, invalidation.Event{Realm: realm, UserID: userID, Email: email})
 	return userID, nil
 }
 
 // GetUserByID - Получаем значение user'а по userID
 func (c *cacheDecorator) GetUserByID(ctx context.Context, accessToken, realm, userID string) (*userdata.User, error) {
-	if user, err := c.userProvider.GetUserByUserID(ctx, userID); err == nil {
+	if err := c.authorize(ctx, accessToken, realm); err != nil {
+		return nil, err
+	}
+	return c.getUserByID(ctx, accessToken, realm, userID)
+}
+
+// getUserByID - Получаем user'а из cache или keycloak, token уже проверен
+func (c *cacheDecorator) getUserByID(ctx context.Context, accessToken, realm, userID string) (*userdata.User, error) {
+	if user, err := c.userProvider.GetUserByUserID(ctx, realm, userID); err == nil {
 		return &user, nil
 	}
-	// Если нет - получаем и сеттим в cache
-	newUserPtr, err := c.userAdapter.GetUserByID(ctx, accessToken, realm, userID)
-	if err != nil {
-		return newUserPtr, err
+	if c.negative.Has(userIDKey(realm, userID)) {
+		metrics.IncKeycloakCacheEvent(realm, cacheNegativeHit)
+		return nil, pkg.ErrUserNotFound
 	}
-	email := ""
-	if newUserPtr.Email != nil {
-		email = *newUserPtr.Email
+	if c.cfg.StaleWhileRevalidate {
+		if user, err := c.userProvider.GetStaleUserByUserID(ctx, realm, userID); err == nil {
+			c.revalidate(userIDKey(realm, userID), func(ctx context.Context) {
+				c.fetchUserByID(ctx, accessToken, realm, userID)
+			})
+			metrics.IncKeycloakCacheEvent(realm, cacheServedStale)
+			return &user, &StaleError{}
+		}
+	}
+	newUserPtr, err := c.fetchUserByID(ctx, accessToken, realm, userID)
+	// Удалённого user'а не отдаём даже просроченным
+	if err != nil && c.cfg.ServeStaleOnError && !errors.Is(err, pkg.ErrUserNotFound) {
+		if user, staleErr := c.userProvider.GetStaleUserByUserID(ctx, realm, userID); staleErr == nil {
+			metrics.IncKeycloakCacheEvent(realm, cacheServedStale)
+			return &user, &StaleError{Err: err}
+		}
+	}
+	return newUserPtr, err
+}
+
+// fetchUserByID - Получаем user'а из keycloak и сеттим в cache.
+// Параллельные промахи по тому же user'у ждут один поход.
+// Если user изменился, пока шёл поход, прочитанная копия в cache не попадает
+func (c *cacheDecorator) fetchUserByID(ctx context.Context, accessToken, realm, userID string) (*userdata.User, error) {
+	result, err := c.do(ctx, realm, userIDKey(realm, userID), func(ctx context.Context) (interface{}, error) {
+		generation := c.generations.Begin(realm, userID)
+		defer c.generations.End(realm, userID)
+		newUserPtr, err := c.userAdapter.GetUserByID(ctx, accessToken, realm, userID)
+		if c.generations.Changed(realm, userID, generation) {
+			return newUserPtr, err
+		}
+		if errors.Is(err, pkg.ErrUserNotFound) {
+			c.forgetDeletedUser(ctx, realm, userID)
+			c.negative.Add(userIDKey(realm, userID))
+		}
+		if err != nil {
+			return newUserPtr, err
+		}
+		email := ""
+		if newUserPtr.Email != nil {
+			email = *newUserPtr.Email
+		}
+		c.userProvider.SetUser(ctx, realm, userID, email, *newUserPtr)
+		// User изменился между проверкой и записью: убираем записанную копию
+		if c.generations.Changed(realm, userID, generation) {
+			c.userProvider.InvalidateUser(ctx, realm, userID)
+		}
+		return newUserPtr, nil
+	})
+	newUserPtr, _ := result.(*userdata.User)
+	return copyUser(newUserPtr), err
+}
+
+// forgetDeletedUser - Keycloak не нашёл user'а: убираем его запись вместе с email и индексами,
+// иначе просроченная копия отдавалась бы через GetStale* до конца StaleGrace
+func (c *cacheDecorator) forgetDeletedUser(ctx context.Context, realm, userID string) {
+	c.userProvider.InvalidateUser(ctx, realm, userID)
+	c.roles.DeleteUser(realm, userID)
+}
+
+// upstreamContext - Контекст общего похода в keycloak: значения берутся из ctx, а отмена - нет,
+// чтобы отмена запроса, начавшего поход, не ломала его остальным ждущим.
+// Поход ограничен UpstreamTimeout или defaultUpstreamTimeout
+func (c *cacheDecorator) upstreamContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	timeout := c.cfg.UpstreamTimeout
+	if timeout <= 0 {
+		timeout = defaultUpstreamTimeout
 	}
-	c.userProvider.SetUser(ctx, userID, email, *newUserPtr)
-	return newUserPtr, nil
+	return context.WithTimeout(valueOnlyContext{ctx}, timeout)
+}
+
+// valueOnlyContext - Контекст со значениями родителя, но без его deadline и отмены
+type valueOnlyContext struct {
+	context.Context
+}
+
+func (valueOnlyContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (valueOnlyContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (valueOnlyContext) Err() error {
+	return nil
+}
+
+// revalidate - Запускаем фоновое обновление просроченного user'а по key,
+// если оно ещё не идёт: иначе каждое чтение горячего ключа заводило бы горутину.
+// Контекст не связан с запросом, так как запрос завершится раньше обновления
+func (c *cacheDecorator) revalidate(key string, fn func(ctx context.Context)) {
+	if _, running := c.revalidating.LoadOrStore(key, struct{}{}); running {
+		return
+	}
+	timeout := c.cfg.UpstreamTimeout
+	if timeout <= 0 {
+		timeout = defaultUpstreamTimeout
+	}
+	go func() {
+		defer c.revalidating.Delete(key)
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		fn(ctx)
+	}()
+}
+
+// userIDKey - Ключ объединения запросов user'а по userID
+func userIDKey(realm, userID string) string {
+	return realm + "/id/" + userID
+}
+
+// emailKey - Ключ объединения запросов и промахов user'а по email.
+// Keycloak хранит email в нижнем регистре, поэтому написания одного email дают один ключ
+func emailKey(realm, email string) string {
+	return realm + "/email/" + strings.ToLower(email)
+}
+
+// indexKey - Ключ объединения запросов user'а по значению индекса
+func indexKey(realm, index, value string) string {
+	return realm + "/index/" + index + "/" + value
+}
+
+// do - Выполняем fn один раз на key для всех параллельных вызовов.
+// fn получает контекст из upstreamContext, а каждый вызов ждёт результат не дольше своего ctx.
+// Вызовы, получившие чужой результат, считаем в метрике
+func (c *cacheDecorator) do(ctx context.Context, realm, key string, fn func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	executed := false
+	resultCh := c.group.DoChan(key, func() (interface{}, error) {
+		executed = true
+		ctx, cancel := c.upstreamContext(ctx)
+		defer cancel()
+		return fn(ctx)
+	})
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case result := <-resultCh:
+		if !executed {
+			metrics.IncKeycloakCacheEvent(realm, keycloakDeduplicated)
+		}
+		return result.Val, result.Err
+	}
+}
+
+// copyUser - Копируем user'а, чтобы вызовы с общим результатом не делили один указатель
+func copyUser(user *userdata.User) *userdata.User {
+	if user == nil {
+		return nil
+	}
+	userCopy := *user
+	return &userCopy
+}
+
+// copyUsers - Копируем user'ов, чтобы вызовы с общим результатом не делили одни указатели
+func copyUsers(users []*userdata.User) []*userdata.User {
+	if users == nil {
+		return nil
+	}
+	usersCopy := make([]*userdata.User, len(users))
+	for i, user := range users {
+		usersCopy[i] = copyUser(user)
+	}
+	return usersCopy
 }
 
 // isGetUserByEmail - Если приходит только запрос на получение пользователя только по email - вернём true
@@ -100,17 +382,187 @@ func isGetUserByEmail(ctx context.Context, params userdata.GetUsersParams) bool
 
 // GetUsers - Получаем значение user'ов из keycloak по gocloak.GetUsersParams
 func (c *cacheDecorator) GetUsers(ctx context.Context, token, realm string, params userdata.GetUsersParams) ([]*userdata.User, error) {
-	// Проверяем наличие валидной записи в emailMap
+	if err := c.authorize(ctx, token, realm); err != nil {
+		return nil, err
+	}
+	// Проверяем наличие валидной записи в emailMap realm'а
 	// Проверяем params на наличие только поля Email (в этом случае запишем в кэш)
 	if isGetUserByEmail(ctx, params) {
-		if user, err := c.userProvider.GetUserByEmail(ctx, *params.Email); err == nil {
+		if user, err := c.userProvider.GetUserByEmail(ctx, realm, *params.Email); err == nil {
 			return []*userdata.User{&user}, nil
 		}
+		if c.negative.Has(emailKey(realm, *params.Email)) {
+			metrics.IncKeycloakCacheEvent(realm, cacheNegativeHit)
+			return []*userdata.User{}, nil
+		}
+		if c.cfg.StaleWhileRevalidate {
+			if user, err := c.userProvider.GetStaleUserByEmail(ctx, realm, *params.Email); err == nil {
+				c.revalidate(emailKey(realm, *params.Email), func(ctx context.Context) {
+					c.fetchUsersByEmail(ctx, token, realm, params)
+				})
+				metrics.IncKeycloakCacheEvent(realm, cacheServedStale)
+				return []*userdata.User{&user}, &StaleError{}
+			}
+		}
+		users, err := c.fetchUsersByEmail(ctx, token, realm, params)
+		if err != nil && c.cfg.ServeStaleOnError {
+			if user, staleErr := c.userProvider.GetStaleUserByEmail(ctx, realm, *params.Email); staleErr == nil {
+				metrics.IncKeycloakCacheEvent(realm, cacheServedStale)
+				return []*userdata.User{&user}, &StaleError{Err: err}
+			}
+		}
+		return users, err
+	}
+	if index, value, ok := getUsersIndexQuery(ctx, params); ok {
+		// Ответ keycloak из queryCache полнее индекса: значение атрибута может быть у нескольких user'ов
+		key := queryKey(params)
+		if users, ok := c.cachedQuery(ctx, realm, key); ok {
+			return users, nil
+		}
+		if c.isUniqueIndex(index) {
+			if user, err := c.userProvider.GetUserByIndex(ctx, realm, index, value); err == nil {
+				return []*userdata.User{&user}, nil
+			}
+		}
+		// Параллельные промахи по тому же значению индекса ждут один поход
+		return c.fetchQuery(ctx, token, realm, params, key, indexKey(realm, index, value))
+	}
+	if c.queries.Enabled() {
+		return c.getUsersByQuery(ctx, token, realm, params)
+	}
+	return c.getUsers(ctx, token, realm, params)
+}
+
+// getUsersByQuery - Отдаём результат запроса из queryCache, если все его user'ы есть в cache.
+// Иначе идём в keycloak, параллельные промахи по тому же запросу ждут один поход
+func (c *cacheDecorator) getUsersByQuery(ctx context.Context, token, realm string, params userdata.GetUsersParams) ([]*userdata.User, error) {
+	key := queryKey(params)
+	if users, ok := c.cachedQuery(ctx, realm, key); ok {
+		return users, nil
+	}
+	return c.fetchQuery(ctx, token, realm, params, key, realm+"/query:"+key)
+}
+
+// cachedQuery - Достаём результат запроса из queryCache, если все его user'ы есть в cache
+func (c *cacheDecorator) cachedQuery(ctx context.Context, realm, key string) ([]*userdata.User, bool) {
+	userIDs, ok := c.queries.Get(realm, key)
+	if !ok {
+		return nil, false
+	}
+	users, ok := c.resolveUsers(ctx, realm, userIDs)
+	if ok {
+		metrics.IncKeycloakCacheEvent(realm, cacheQueryHit)
 	}
-	// Если нет - получаем
+	return users, ok
+}
+
+// fetchQuery - Идём в keycloak за запросом и запоминаем результат в queryCache,
+// если с начала похода в realm'е не было записей. Параллельные походы с тем же flightKey ждут один
+func (c *cacheDecorator) fetchQuery(ctx context.Context, token, realm string, params userdata.GetUsersParams, key, flightKey string) ([]*userdata.User, error) {
+	result, err := c.do(ctx, realm, flightKey, func(ctx context.Context) (interface{}, error) {
+		version := c.queries.Version()
+		users, err := c.getUsers(ctx, token, realm, params)
+		if err != nil {
+			return users, err
+		}
+		userIDs := make([]string, 0, len(users))
+		for _, user := range users {
+			// Без userID результат не собрать из cache, такой запрос не запоминаем
+			if user == nil || user.ID == nil {
+				return users, nil
+			}
+			userIDs = append(userIDs, *user.ID)
+		}
+		c.queries.Set(realm, key, version, userIDs)
+		return users, nil
+	})
+	users, _ := result.([]*userdata.User)
+	return copyUsers(users), err
+}
+
+// resolveUsers - Достаём user'ов из cache по userID. false - кого-то из них в cache уже нет
+func (c *cacheDecorator) resolveUsers(ctx context.Context, realm string, userIDs []string) ([]*userdata.User, bool) {
+	users := make([]*userdata.User, 0, len(userIDs))
+	for _, userID := range userIDs {
+		user, err := c.userProvider.GetUserByUserID(ctx, realm, userID)
+		if err != nil {
+			return nil, false
+		}
+		users = append(users, &user)
+	}
+	return users, true
+}
+
+// isUniqueIndex - Значение индекса может быть только у одного user'а keycloak
+func (c *cacheDecorator) isUniqueIndex(index string) bool {
+	if index == pkg.IndexUsername {
+		return true
+	}
+	for _, unique := range c.cfg.UniqueIndexes {
+		if unique == index {
+			return true
+		}
+	}
+	return false
+}
+
+// getUsersIndexQuery - Если запрос ищет user'а по точному значению одного индексируемого поля,
+// вернём имя индекса и значение: username при Exact или один атрибут в Q вида "key:value"
+func getUsersIndexQuery(ctx context.Context, params userdata.GetUsersParams) (string, string, bool) {
+	// Проверяем, что не пришло полей, которые меняют выборку
+	if params.BriefRepresentation != nil ||
+		params.Email != nil ||
+		params.EmailVerified != nil ||
+		params.Enabled != nil ||
+		params.First != nil ||
+		params.FirstName != nil ||
+		params.IDPAlias != nil ||
+		params.IDPUserID != nil ||
+		params.LastName != nil ||
+		params.Max != nil ||
+		params.Search != nil {
+		return "", "", false
+	}
+	switch {
+	case params.Username != nil && params.Q == nil:
+		// Без Exact keycloak ищет username по подстроке
+		if params.Exact == nil || !*params.Exact {
+			return "", "", false
+		}
+		return pkg.IndexUsername, *params.Username, true
+	case params.Q != nil && params.Username == nil:
+		// Q в keycloak - пары "key:value" через пробел, кэшируем только одну пару
+		key, value, ok := strings.Cut(*params.Q, ":")
+		if !ok || key == "" || value == "" || strings.Contains(*params.Q, " ") {
+			return "", "", false
+		}
+		return key, value, true
+	}
+	return "", "", false
+}
+
+// fetchUsersByEmail - Получаем user'ов по email из keycloak и сеттим в cache.
+// Параллельные промахи по тому же email ждут один поход
+func (c *cacheDecorator) fetchUsersByEmail(ctx context.Context, token, realm string, params userdata.GetUsersParams) ([]*userdata.User, error) {
+	result, err := c.do(ctx, realm, emailKey(realm, *params.Email), func(ctx context.Context) (interface{}, error) {
+		users, err := c.getUsers(ctx, token, realm, params)
+		if err == nil && len(users) == 0 {
+			if user, err := c.userProvider.GetStaleUserByEmail(ctx, realm, *params.Email); err == nil && user.ID != nil {
+				c.forgetDeletedUser(ctx, realm, *user.ID)
+			}
+			c.negative.Add(emailKey(realm, *params.Email))
+		}
+		return users, err
+	})
+	users, _ := result.([]*userdata.User)
+	return copyUsers(users), err
+}
+
+// getUsers - Получаем user'ов из keycloak и проставляем их в cache
+func (c *cacheDecorator) getUsers(ctx context.Context, token, realm string, params userdata.GetUsersParams) ([]*userdata.User, error) {
 	users, err := c.userAdapter.GetUsers(ctx, token, realm, params)
 	if err != nil {
-		metrics.IncKeycloakCacheEvent(getKeycloakUsersErr)
+		metrics.IncKeycloakCacheEvent(realm, getKeycloakUsersErr)
 		return users, err
 	}
 
@@ -124,38 +576,235 @@ func (c *cacheDecorator) GetUsers(ctx context.Context, token, realm string, para
 		if user.ID != nil {
 			userID = *user.ID
 		}
-		c.userProvider.SetUser(ctx, userID, email, *user)
+		c.userProvider.SetUser(ctx, realm, userID, email, *user)
 	}
-	metrics.IncKeycloakCacheEvent(getKeycloakUsers)
+	metrics.IncKeycloakCacheEvent(realm, getKeycloakUsers)
 	return users, nil
 }
 
+// UpdateUser - Обновляем user'а в keycloak и в cache.
+// Если у user'а сменился email, провайдер удаляет старый ключ
 func (c *cacheDecorator) UpdateUser(ctx context.Context, token, realm string, user userdata.User) error {
 	if err := c.userAdapter.UpdateUser(ctx, token, realm, user); err != nil {
 		return err
 	}
-	c.userProvider.SetUser(ctx, *user.ID, *user.Email, user)
+	if user.ID == nil {
+		return nil
+	}
+	email := ""
+	if user.Email != nil {
+		email = *user.Email
+	}
+	c.generations.Bump(realm, *user.ID)
+	c.negative.Delete(userIDKey(realm, *user.ID), emailKey(realm, email))
+	c.queries.DeleteRealm(realm)
+	c.userProvider.SetUser(ctx, realm, *user.ID, email, user.WithoutSecrets())
+	c.publish(ctx, invalidation.Event{Realm: realm, UserID: *user.ID, Email: email})
+	return nil
+}
+
+// DeleteUser - Удаляем user'а из keycloak и сразу убираем его из cache по userID и email
+func (c *cacheDecorator) DeleteUser(ctx context.Context, token, realm, userID string) error {
+	if err := c.userAdapter.DeleteUser(ctx, token, realm, userID); err != nil {
+		return err
+	}
+	c.generations.Bump(realm, userID)
+	c.userProvider.InvalidateUser(ctx, realm, userID)
+	c.negative.Add(userIDKey(realm, userID))
+	c.queries.DeleteRealm(realm)
+	c.roles.DeleteUser(realm, userID)
+	c.publish(ctx, invalidation.Event{Realm: realm, UserID: userID})
+	return nil
+}
+
+// ExecuteActionsEmail - Отправляем письмо с required actions и перечитываем user'а:
+// keycloak мог поменять его RequiredActions
+func (c *cacheDecorator) ExecuteActionsEmail(ctx context.Context, token, realm, userID string, actions []userdata.RequiredAction, params userdata.ExecuteActionsEmailParams) error {
+	if err := c.userAdapter.ExecuteActionsEmail(ctx, token, realm, userID, actions, params); err != nil {
+		return err
+	}
+	c.refreshUser(ctx, token, realm, userID)
+	return nil
+}
+
+// SendVerifyEmail - Отправляем письмо с подтверждением email и перечитываем user'а:
+// keycloak мог поменять его EmailVerified и RequiredActions
+func (c *cacheDecorator) SendVerifyEmail(ctx context.Context, token, realm, userID string, params userdata.SendVerifyEmailParams) error {
+	if err := c.userAdapter.SendVerifyEmail(ctx, token, realm, userID, params); err != nil {
+		return err
+	}
+	c.refreshUser(ctx, token, realm, userID)
 	return nil
 }
 
+// refreshUser - Сбрасываем user'а и сразу перечитываем его из keycloak.
+// Поход, начатый до действия, мог прочитать старого user'а, поэтому к нему не присоединяемся,
+// а смена поколения не даёт ему записать свою копию в cache.
+// Если перечитать не удалось, user останется сброшенным и прочитается при следующем запросе
+func (c *cacheDecorator) refreshUser(ctx context.Context, token, realm, userID string) {
+	c.generations.Bump(realm, userID)
+	c.queries.DeleteRealm(realm)
+	c.userProvider.InvalidateUser(ctx, realm, userID)
+	c.group.Forget(userIDKey(realm, userID))
+	c.fetchUserByID(ctx, token, realm, userID)
+	c.publish(ctx, invalidation.Event{Realm: realm, UserID: userID})
+}
+
+// InvalidateUser - Удаляем user'а realm'а из cache, следующий запрос пойдёт в keycloak
+func (c *cacheDecorator) InvalidateUser(ctx context.Context, realm, userID string) {
+	c.generations.Bump(realm, userID)
+	c.negative.Delete(userIDKey(realm, userID))
+	c.queries.DeleteRealm(realm)
+	c.roles.DeleteUser(realm, userID)
+	c.userProvider.InvalidateUser(ctx, realm, userID)
+	c.publish(ctx, invalidation.Event{Realm: realm, UserID: userID})
+}
+
+// InvalidateCreatedUser - Удаляем user'а, созданного в обход сервиса, и промахи по его userID и email.
+// Если email неизвестен, сбрасываем все промахи realm'а: среди них может быть email нового user'а
+func (c *cacheDecorator) InvalidateCreatedUser(ctx context.Context, realm, userID, email string) {
+	c.generations.Bump(realm, userID)
+	if email == "" {
+		c.negative.DeleteRealm(realm)
+	} else {
+		c.negative.Delete(userIDKey(realm, userID), emailKey(realm, email))
+	}
+	c.queries.DeleteRealm(realm)
+	c.roles.DeleteUser(realm, userID)
+	c.userProvider.InvalidateUser(ctx, realm, userID)
+	c.publish(ctx, invalidation.Event{Realm: realm, UserID: userID, Email: email})
+}
+
+// InvalidateRealm - Удаляем из cache всех user'ов и промахи realm'а
+func (c *cacheDecorator) InvalidateRealm(ctx context.Context, realm string) {
+	c.generations.BumpRealm(realm)
+	c.negative.DeleteRealm(realm)
+	c.queries.DeleteRealm(realm)
+	c.roles.DeleteRealm(realm)
+	c.userProvider.InvalidateRealm(ctx, realm)
+	c.publish(ctx, invalidation.Event{Realm: realm})
+}
+
+// Purge - Полностью очищаем cache реплики, другим репликам событие не рассылается
+func (c *cacheDecorator) Purge(ctx context.Context) {
+	c.generations.BumpAll()
+	c.negative.Purge()
+	c.queries.Purge()
+	c.roles.Purge()
+	c.userProvider.Purge(ctx)
+}
+
+// ListenInvalidations - Подписываемся на события других реплик и сбрасываем по ним локальный cache.
+// Возвращается после установки подписки, события применяются до отмены ctx
+func (c *cacheDecorator) ListenInvalidations(ctx context.Context) error {
+	if c.cfg.Bus == nil {
+		return nil
+	}
+	return c.cfg.Bus.Subscribe(ctx, c.applyInvalidation)
+}
+
+// applyInvalidation - Сбрасываем user'а или realm из события другой реплики
+func (c *cacheDecorator) applyInvalidation(ctx context.Context, event invalidation.Event) {
+	if event.Origin == c.cfg.ReplicaID || event.Realm == "" {
+		return
+	}
+	local, hasLocal := c.userProvider.(localInvalidator)
+	c.queries.DeleteRealm(event.Realm)
+	if event.UserID == "" {
+		c.generations.BumpRealm(event.Realm)
+		c.negative.DeleteRealm(event.Realm)
+		c.roles.DeleteRealm(event.Realm)
+		if hasLocal {
+			local.InvalidateLocalRealm(ctx, event.Realm)
+		}
+	} else {
+		c.generations.Bump(event.Realm, event.UserID)
+		c.negative.Delete(userIDKey(event.Realm, event.UserID), emailKey(event.Realm, event.Email))
+		c.roles.DeleteUser(event.Realm, event.UserID)
+		if hasLocal {
+			local.InvalidateLocalUser(ctx, event.Realm, event.UserID)
+		}
+	}
+	metrics.IncKeycloakCacheEvent(event.Realm, invalidationApplied)
+}
+
+// publish - Рассылаем событие другим репликам. Ошибка не возвращается:
+// изменение в keycloak уже применено, остальные реплики дождутся ttl
+func (c *cacheDecorator) publish(ctx context.Context, event invalidation.Event) {
+	if c.cfg.Bus == nil {
+		return
+	}
+	event.Origin = c.cfg.ReplicaID
+	if err := c.cfg.Bus.Publish(ctx, event); err != nil {
+		metrics.IncKeycloakCacheEvent(event.Realm, invalidationPublishErr)
+	}
+}
+
+// newReplicaID - Случайный идентификатор реплики для событий шины
+func newReplicaID() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return time.Now().Format(time.RFC3339Nano)
+	}
+	return hex.EncodeToString(buf)
+}
+
 func (c *cacheDecorator) LoginClient(ctx context.Context, clientID, clientSecret, realm string, scopes ...string) (*userdata.JWT, error) {
 	return c.userAdapter.LoginClient(ctx, clientID, clientSecret, realm, scopes...)
 }
 
+// SetPassword - Меняем пароль и сбрасываем user'а в cache, так как у него поменялись credentials
 func (c *cacheDecorator) SetPassword(ctx context.Context, token, userID, realm, password string, temporary bool) error {
-	return c.userAdapter.SetPassword(ctx, token, userID, realm, password, temporary)
+	if err := c.userAdapter.SetPassword(ctx, token, userID, realm, password, temporary); err != nil {
+		return err
+	}
+	c.generations.Bump(realm, userID)
+	c.userProvider.InvalidateUser(ctx, realm, userID)
+	c.publish(ctx, invalidation.Event{Realm: realm, UserID: userID})
+	return nil
 }
 
 func (c *cacheDecorator) GetCredentials(ctx context.Context, token, realm, userID string) ([]*userdata.CredentialRepresentation, error) {
 	return c.userAdapter.GetCredentials(ctx, token, realm, userID)
 }
 
+// DeleteCredentials - Удаляем credential и сбрасываем user'а в cache
 func (c *cacheDecorator) DeleteCredentials(ctx context.Context, token, realm, userID, credentialID string) error {
-	return c.userAdapter.DeleteCredentials(ctx, token, realm, userID, credentialID)
+	if err := c.userAdapter.DeleteCredentials(ctx, token, realm, userID, credentialID); err != nil {
+		return err
+	}
+	c.generations.Bump(realm, userID)
+	c.userProvider.InvalidateUser(ctx, realm, userID)
+	c.publish(ctx, invalidation.Event{Realm: realm, UserID: userID})
+	return nil
 }
 
+// LogoutAllSessions - Завершаем сессии user'а и сбрасываем его в cache:
+// обычно это делают при блокировке или компрометации, после чего user'а стоит перечитать
 func (c *cacheDecorator) LogoutAllSessions(ctx context.Context, accessToken, realm, userID string) error {
-	return c.userAdapter.LogoutAllSessions(ctx, accessToken, realm, userID)
+	if err := c.userAdapter.LogoutAllSessions(ctx, accessToken, realm, userID); err != nil {
+		return err
+	}
+	c.generations.Bump(realm, userID)
+	c.userProvider.InvalidateUser(ctx, realm, userID)
+	c.publish(ctx, invalidation.Event{Realm: realm, UserID: userID})
+	return nil
+}
+
+func (c *cacheDecorator) GetUserSessions(ctx context.Context, token, realm, userID string) ([]*userdata.UserSession, error) {
+	return c.userAdapter.GetUserSessions(ctx, token, realm, userID)
+}
+
+func (c *cacheDecorator) LogoutUserSession(ctx context.Context, accessToken, realm, sessionID string) error {
+	return c.userAdapter.LogoutUserSession(ctx, accessToken, realm, sessionID)
+}
+
+func (c *cacheDecorator) Logout(ctx context.Context, clientID, clientSecret, realm, refreshToken string) error {
+	return c.userAdapter.Logout(ctx, clientID, clientSecret, realm, refreshToken)
+}
+
+func (c *cacheDecorator) RefreshToken(ctx context.Context, refreshToken, clientID, clientSecret, realm string) (*userdata.JWT, error) {
+	return c.userAdapter.RefreshToken(ctx, refreshToken, clientID, clientSecret, realm)
 }
 
 func (c *cacheDecorator) Login(ctx context.Context, clientID, clientSecret, realm, username, password string) (*userdata.JWT, error) {
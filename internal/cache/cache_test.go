@@ -0,0 +1,1355 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/mtvy/cached_updater/internal/invalidation"
+	"github.com/mtvy/cached_updater/internal/keycloak"
+	"github.com/mtvy/cached_updater/internal/rediscache"
+	"github.com/mtvy/cached_updater/internal/userdata"
+	"github.com/mtvy/cached_updater/pkg"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/require"
+)
+
+const testRealm = "test"
+
+func GetPtr[T any](v T) *T {
+	return &v
+}
+
+func testUserFactory(userID, email string) userdata.User {
+	return userdata.User{
+		ID:    GetPtr(userID),
+		Email: GetPtr(email),
+	}
+}
+
+// testUserAdapter - Считает походы в keycloak и держит их до закрытия release
+type testUserAdapter struct {
+	UserAdapter
+	// Разблокирует GetUserByID и GetUsers
+	release chan struct{}
+	// Ошибка, которую вернут GetUserByID и GetUsers
+	err error
+	// User'а нет в keycloak: GetUserByID вернёт pkg.ErrUserNotFound, а GetUsers - пустой список
+	notFound atomic.Bool
+	calls    atomic.Int64
+}
+
+func (a *testUserAdapter) CreateUser(ctx context.Context, token, realm string, user userdata.User) (string, error) {
+	a.notFound.Store(false)
+	return *user.ID, nil
+}
+
+func (a *testUserAdapter) DeleteUser(ctx context.Context, token, realm, userID string) error {
+	a.notFound.Store(true)
+	return nil
+}
+
+func (a *testUserAdapter) UpdateUser(ctx context.Context, token, realm string, user userdata.User) error {
+	return nil
+}
+
+func (a *testUserAdapter) GetUserByID(ctx context.Context, accessToken, realm, userID string) (*userdata.User, error) {
+	a.calls.Add(1)
+	<-a.release
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if a.err != nil {
+		return nil, a.err
+	}
+	if a.notFound.Load() {
+		return nil, pkg.ErrUserNotFound
+	}
+	user := testUserFactory(userID, userID+"@test.test")
+	return &user, nil
+}
+
+func (a *testUserAdapter) GetUsers(ctx context.Context, token, realm string, params userdata.GetUsersParams) ([]*userdata.User, error) {
+	a.calls.Add(1)
+	<-a.release
+	if a.err != nil {
+		return nil, a.err
+	}
+	if a.notFound.Load() {
+		return []*userdata.User{}, nil
+	}
+	user := userdata.User{ID: GetPtr("1"), Email: params.Email, Username: params.Username}
+	if params.Email == nil {
+		user.Email = GetPtr("1@test.test")
+	}
+	if params.Q != nil {
+		key, value, _ := strings.Cut(*params.Q, ":")
+		user.Attributes = &map[string][]string{key: {value}}
+	}
+	return []*userdata.User{&user}, nil
+}
+
+func newTestDecorator(t *testing.T, adapter UserAdapter) *cacheDecorator {
+	provider := keycloak.NewUserCache(context.Background(), keycloak.UserCacheConfig{TTL: time.Minute}, nil)
+	t.Cleanup(func() { provider.Close() })
+	return NewCacheDecorator(adapter, provider, Config{})
+}
+
+func TestCacheDecoratorCoalescing(t *testing.T) {
+	errKeycloak := errors.New("keycloak unavailable")
+	testCases := []struct {
+		name string
+		err  error
+		call func(ctx context.Context, c *cacheDecorator) (*userdata.User, error)
+	}{
+		{
+			name: "GetUserByID объединяет параллельные промахи",
+			call: func(ctx context.Context, c *cacheDecorator) (*userdata.User, error) {
+				return c.GetUserByID(ctx, "token", testRealm, "1")
+			},
+		},
+		{
+			name: "GetUsers по email объединяет параллельные промахи",
+			call: func(ctx context.Context, c *cacheDecorator) (*userdata.User, error) {
+				users, err := c.GetUsers(ctx, "token", testRealm, userdata.GetUsersParams{Email: GetPtr("1@test.test")})
+				if err != nil {
+					return nil, err
+				}
+				return users[0], nil
+			},
+		},
+		{
+			name: "ошибка keycloak достаётся всем объединённым вызовам",
+			err:  errKeycloak,
+			call: func(ctx context.Context, c *cacheDecorator) (*userdata.User, error) {
+				return c.GetUserByID(ctx, "token", testRealm, "1")
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			adapter := &testUserAdapter{release: make(chan struct{}), err: tc.err}
+			decorator := newTestDecorator(t, adapter)
+
+			const callers = 50
+			var wg sync.WaitGroup
+			users := make([]*userdata.User, callers)
+			errs := make([]error, callers)
+			wg.Add(callers)
+			for i := 0; i < callers; i++ {
+				go func(i int) {
+					defer wg.Done()
+					users[i], errs[i] = tc.call(context.Background(), decorator)
+				}(i)
+			}
+			require.Eventually(t, func() bool { return adapter.calls.Load() == 1 }, time.Second, time.Millisecond)
+			// Даём остальным вызовам дойти до ожидания общего результата
+			time.Sleep(50 * time.Millisecond)
+			close(adapter.release)
+			wg.Wait()
+
+			require.Equal(t, int64(1), adapter.calls.Load())
+			for i := 0; i < callers; i++ {
+				if tc.err != nil {
+					require.ErrorIs(t, errs[i], tc.err)
+					continue
+				}
+				require.NoError(t, errs[i])
+				require.Equal(t, "1@test.test", *users[i].Email)
+				if i > 0 {
+					require.NotSame(t, users[0], users[i], "вызовы не должны делить один указатель")
+				}
+			}
+		})
+	}
+}
+
+func TestCacheDecoratorCoalescingCancel(t *testing.T) {
+	adapter := &testUserAdapter{release: make(chan struct{})}
+	decorator := newTestDecorator(t, adapter)
+
+	leaderCtx, cancel := context.WithCancel(context.Background())
+	leaderErr := make(chan error, 1)
+	go func() {
+		_, err := decorator.GetUserByID(leaderCtx, "token", testRealm, "1")
+		leaderErr <- err
+	}()
+	require.Eventually(t, func() bool { return adapter.calls.Load() == 1 }, time.Second, time.Millisecond)
+
+	type result struct {
+		user *userdata.User
+		err  error
+	}
+	followerResult := make(chan result, 1)
+	go func() {
+		user, err := decorator.GetUserByID(context.Background(), "token", testRealm, "1")
+		followerResult <- result{user: user, err: err}
+	}()
+	// Даём follower'у дойти до ожидания общего результата
+	time.Sleep(50 * time.Millisecond)
+
+	cancel()
+	require.ErrorIs(t, <-leaderErr, context.Canceled)
+	close(adapter.release)
+
+	follower := <-followerResult
+	require.NoError(t, follower.err)
+	require.Equal(t, "1@test.test", *follower.user.Email)
+	require.EqualValues(t, 1, adapter.calls.Load())
+}
+
+func TestCacheDecoratorStale(t *testing.T) {
+	ctx := context.Background()
+	errKeycloak := errors.New("keycloak unavailable")
+	cached := testUserFactory("1", "1@test.test")
+
+	testCases := []struct {
+		name      string
+		cfg       Config
+		err       error
+		wantErr   error
+		wantCalls int64
+	}{
+		{
+			name:      "при ошибке keycloak отдаём просроченного user'а",
+			cfg:       Config{ServeStaleOnError: true},
+			err:       errKeycloak,
+			wantErr:   errKeycloak,
+			wantCalls: 1,
+		},
+		{
+			name:      "stale-while-revalidate отдаёт просроченного user'а и обновляет его в фоне",
+			cfg:       Config{StaleWhileRevalidate: true},
+			wantCalls: 1,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			release := make(chan struct{})
+			close(release)
+			adapter := &testUserAdapter{release: release, err: tc.err}
+			provider := keycloak.NewUserCache(ctx, keycloak.UserCacheConfig{TTL: -time.Minute, StaleGrace: time.Hour}, nil)
+			defer provider.Close()
+			provider.SetUser(ctx, testRealm, *cached.ID, *cached.Email, cached)
+			decorator := NewCacheDecorator(adapter, provider, tc.cfg)
+
+			user, err := decorator.GetUserByID(ctx, "token", testRealm, "1")
+			require.ErrorIs(t, err, ErrStaleUser)
+			if tc.wantErr != nil {
+				require.ErrorIs(t, err, tc.wantErr)
+			}
+			require.Equal(t, cached, *user)
+
+			users, err := decorator.GetUsers(ctx, "token", testRealm, userdata.GetUsersParams{Email: cached.Email})
+			require.ErrorIs(t, err, ErrStaleUser)
+			require.Equal(t, []*userdata.User{&cached}, users)
+
+			require.Eventually(t, func() bool { return adapter.calls.Load() >= tc.wantCalls }, time.Second, time.Millisecond)
+		})
+	}
+
+	t.Run("stale-while-revalidate убирает удалённого в keycloak user'а", func(t *testing.T) {
+		release := make(chan struct{})
+		close(release)
+		adapter := &testUserAdapter{release: release}
+		adapter.notFound.Store(true)
+		provider := keycloak.NewUserCache(ctx, keycloak.UserCacheConfig{TTL: -time.Minute, StaleGrace: time.Hour}, nil)
+		defer provider.Close()
+		provider.SetUser(ctx, testRealm, *cached.ID, *cached.Email, cached)
+		decorator := NewCacheDecorator(adapter, provider, Config{StaleWhileRevalidate: true})
+
+		_, err := decorator.GetUserByID(ctx, "token", testRealm, "1")
+		require.ErrorIs(t, err, ErrStaleUser)
+		require.Eventually(t, func() bool {
+			_, err := provider.GetStaleUserByUserID(ctx, testRealm, "1")
+			return err != nil
+		}, time.Second, time.Millisecond)
+
+		user, err := decorator.GetUserByID(ctx, "token", testRealm, "1")
+		require.ErrorIs(t, err, pkg.ErrUserNotFound)
+		require.Nil(t, user)
+		_, err = provider.GetStaleUserByEmail(ctx, testRealm, *cached.Email)
+		require.Error(t, err)
+	})
+
+	t.Run("без включённого режима ошибка keycloak возвращается как есть", func(t *testing.T) {
+		adapter := &testUserAdapter{release: make(chan struct{}), err: errKeycloak}
+		close(adapter.release)
+		provider := keycloak.NewUserCache(ctx, keycloak.UserCacheConfig{TTL: -time.Minute, StaleGrace: time.Hour}, nil)
+		defer provider.Close()
+		provider.SetUser(ctx, testRealm, *cached.ID, *cached.Email, cached)
+		decorator := NewCacheDecorator(adapter, provider, Config{})
+
+		user, err := decorator.GetUserByID(ctx, "token", testRealm, "1")
+		require.ErrorIs(t, err, errKeycloak)
+		require.NotErrorIs(t, err, ErrStaleUser)
+		require.Nil(t, user)
+	})
+}
+
+func TestCacheDecoratorNegative(t *testing.T) {
+	ctx := context.Background()
+	release := make(chan struct{})
+	close(release)
+	adapter := &testUserAdapter{release: release}
+	adapter.notFound.Store(true)
+	provider := keycloak.NewUserCache(ctx, keycloak.UserCacheConfig{TTL: time.Minute}, nil)
+	defer provider.Close()
+	decorator := NewCacheDecorator(adapter, provider, Config{NegativeTTL: time.Minute})
+	params := userdata.GetUsersParams{Email: GetPtr("1@test.test")}
+
+	t.Run("повторные промахи не доходят до keycloak", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			user, err := decorator.GetUserByID(ctx, "token", testRealm, "1")
+			require.ErrorIs(t, err, pkg.ErrUserNotFound)
+			require.Nil(t, user)
+
+			users, err := decorator.GetUsers(ctx, "token", testRealm, params)
+			require.NoError(t, err)
+			require.Empty(t, users)
+		}
+		require.Equal(t, int64(2), adapter.calls.Load())
+	})
+
+	t.Run("промахи одного realm'а не влияют на другой", func(t *testing.T) {
+		_, err := decorator.GetUserByID(ctx, "token", "other", "1")
+		require.ErrorIs(t, err, pkg.ErrUserNotFound)
+		require.Equal(t, int64(3), adapter.calls.Load())
+	})
+
+	t.Run("CreateUser сбрасывает промахи по userID и email", func(t *testing.T) {
+		_, err := decorator.CreateUser(ctx, "token", testRealm, testUserFactory("1", "1@test.test"))
+		require.NoError(t, err)
+		// Вытесняем созданного user'а из cache, чтобы проверить именно negativeCache
+		provider.SetRealmTTL(testRealm, -time.Minute)
+		provider.SetUser(ctx, testRealm, "1", "1@test.test", testUserFactory("1", "1@test.test"))
+
+		user, err := decorator.GetUserByID(ctx, "token", testRealm, "1")
+		require.NoError(t, err)
+		require.Equal(t, "1", *user.ID)
+
+		users, err := decorator.GetUsers(ctx, "token", testRealm, params)
+		require.NoError(t, err)
+		require.Len(t, users, 1)
+		require.Equal(t, int64(5), adapter.calls.Load())
+	})
+}
+
+func TestCacheDecoratorEmailCase(t *testing.T) {
+	ctx := context.Background()
+	release := make(chan struct{})
+	close(release)
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer client.Close()
+
+	testCases := []struct {
+		name     string
+		provider func() cachedUsersProvider
+	}{
+		{
+			name: "cache в памяти",
+			provider: func() cachedUsersProvider {
+				provider := keycloak.NewUserCache(ctx, keycloak.UserCacheConfig{TTL: time.Minute}, nil)
+				t.Cleanup(func() { provider.Close() })
+				return provider
+			},
+		},
+		{
+			name: "redis",
+			provider: func() cachedUsersProvider {
+				return rediscache.NewUserCache(client, rediscache.UserCacheConfig{TTL: time.Minute})
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			adapter := &testUserAdapter{release: release}
+			adapter.notFound.Store(true)
+			decorator := NewCacheDecorator(adapter, tc.provider(), Config{NegativeTTL: time.Minute})
+			params := userdata.GetUsersParams{Email: GetPtr("User@Test.test")}
+
+			users, err := decorator.GetUsers(ctx, "token", testRealm, params)
+			require.NoError(t, err)
+			require.Empty(t, users)
+
+			// Создание под другим написанием email сбрасывает промах и находится по любому написанию
+			_, err = decorator.CreateUser(ctx, "token", testRealm, testUserFactory("1", "user@test.test"))
+			require.NoError(t, err)
+			users, err = decorator.GetUsers(ctx, "token", testRealm, params)
+			require.NoError(t, err)
+			require.Len(t, users, 1)
+			require.Equal(t, "1", *users[0].ID)
+			require.EqualValues(t, 1, adapter.calls.Load())
+		})
+	}
+}
+
+func TestCacheDecoratorInvalidateCreatedUser(t *testing.T) {
+	ctx := context.Background()
+	release := make(chan struct{})
+	close(release)
+	params := userdata.GetUsersParams{Email: GetPtr("1@test.test")}
+
+	testCases := []struct {
+		name  string
+		email string
+	}{
+		{
+			name:  "email из события сбрасывает промахи user'а",
+			email: "1@test.test",
+		},
+		{
+			name:  "без email сбрасываются все промахи realm'а",
+			email: "",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			adapter := &testUserAdapter{release: release}
+			adapter.notFound.Store(true)
+			provider := keycloak.NewUserCache(ctx, keycloak.UserCacheConfig{TTL: time.Minute}, nil)
+			defer provider.Close()
+			decorator := NewCacheDecorator(adapter, provider, Config{NegativeTTL: time.Minute})
+
+			_, err := decorator.GetUserByID(ctx, "token", testRealm, "1")
+			require.ErrorIs(t, err, pkg.ErrUserNotFound)
+			users, err := decorator.GetUsers(ctx, "token", testRealm, params)
+			require.NoError(t, err)
+			require.Empty(t, users)
+
+			// User создан в консоли keycloak, в обход сервиса
+			adapter.notFound.Store(false)
+			decorator.InvalidateCreatedUser(ctx, testRealm, "1", tc.email)
+
+			user, err := decorator.GetUserByID(ctx, "token", testRealm, "1")
+			require.NoError(t, err)
+			require.Equal(t, "1", *user.ID)
+			provider.InvalidateUser(ctx, testRealm, "1")
+			users, err = decorator.GetUsers(ctx, "token", testRealm, params)
+			require.NoError(t, err)
+			require.Len(t, users, 1)
+		})
+	}
+}
+
+func TestCacheDecoratorDeleteUser(t *testing.T) {
+	ctx := context.Background()
+	release := make(chan struct{})
+	close(release)
+	adapter := &testUserAdapter{release: release}
+	provider := keycloak.NewUserCache(ctx, keycloak.UserCacheConfig{TTL: time.Minute}, nil)
+	defer provider.Close()
+	decorator := NewCacheDecorator(adapter, provider, Config{})
+	user := testUserFactory("1", "1@test.test")
+	provider.SetUser(ctx, testRealm, *user.ID, *user.Email, user)
+
+	require.NoError(t, decorator.DeleteUser(ctx, "token", testRealm, "1"))
+
+	_, err := provider.GetUserByUserID(ctx, testRealm, "1")
+	require.Error(t, err)
+	_, err = provider.GetUserByEmail(ctx, testRealm, "1@test.test")
+	require.Error(t, err)
+
+	_, err = decorator.GetUserByID(ctx, "token", testRealm, "1")
+	require.ErrorIs(t, err, pkg.ErrUserNotFound)
+	users, err := decorator.GetUsers(ctx, "token", testRealm, userdata.GetUsersParams{Email: user.Email})
+	require.NoError(t, err)
+	require.Empty(t, users)
+}
+
+func Test_getUsersIndexQuery(t *testing.T) {
+	testCases := []struct {
+		name      string
+		params    userdata.GetUsersParams
+		wantIndex string
+		wantValue string
+		wantOk    bool
+	}{
+		{
+			name:      "точный поиск по username",
+			params:    userdata.GetUsersParams{Username: GetPtr("user"), Exact: GetPtr(true)},
+			wantIndex: pkg.IndexUsername,
+			wantValue: "user",
+			wantOk:    true,
+		},
+		{
+			name:   "поиск по username без Exact идёт по подстроке",
+			params: userdata.GetUsersParams{Username: GetPtr("user")},
+		},
+		{
+			name:      "поиск по одному атрибуту",
+			params:    userdata.GetUsersParams{Q: GetPtr("inn:7700000000")},
+			wantIndex: "inn",
+			wantValue: "7700000000",
+			wantOk:    true,
+		},
+		{
+			name:   "поиск по нескольким атрибутам",
+			params: userdata.GetUsersParams{Q: GetPtr("inn:7700000000 phone:+7")},
+		},
+		{
+			name:   "поиск с пагинацией",
+			params: userdata.GetUsersParams{Q: GetPtr("inn:7700000000"), Max: GetPtr(10)},
+		},
+		{
+			name:   "поиск по username и атрибуту",
+			params: userdata.GetUsersParams{Username: GetPtr("user"), Exact: GetPtr(true), Q: GetPtr("inn:1")},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			index, value, ok := getUsersIndexQuery(context.Background(), tc.params)
+			require.Equal(t, tc.wantOk, ok)
+			require.Equal(t, tc.wantIndex, index)
+			require.Equal(t, tc.wantValue, value)
+		})
+	}
+}
+
+func TestCacheDecoratorIndexes(t *testing.T) {
+	ctx := context.Background()
+	release := make(chan struct{})
+	close(release)
+	adapter := &testUserAdapter{release: release}
+	provider := keycloak.NewUserCache(ctx, keycloak.UserCacheConfig{TTL: time.Minute, Indexes: []string{pkg.IndexUsername, "inn"}}, nil)
+	defer provider.Close()
+	decorator := NewCacheDecorator(adapter, provider, Config{UniqueIndexes: []string{"inn"}})
+
+	for _, params := range []userdata.GetUsersParams{
+		{Username: GetPtr("user"), Exact: GetPtr(true)},
+		{Q: GetPtr("inn:7700000000")},
+	} {
+		for i := 0; i < 3; i++ {
+			users, err := decorator.GetUsers(ctx, "token", testRealm, params)
+			require.NoError(t, err)
+			require.Len(t, users, 1)
+		}
+	}
+	require.Equal(t, int64(2), adapter.calls.Load())
+}
+
+// testSharedAttributeAdapter - Keycloak, в котором у двух user'ов одинаковый site_client_id
+type testSharedAttributeAdapter struct {
+	UserAdapter
+	calls atomic.Int64
+}
+
+func (a *testSharedAttributeAdapter) GetUsers(ctx context.Context, token, realm string, params userdata.GetUsersParams) ([]*userdata.User, error) {
+	a.calls.Add(1)
+	users := make([]*userdata.User, 0, 2)
+	for _, userID := range []string{"1", "2"} {
+		user := testUserFactory(userID, userID+"@test.test")
+		user.SetSiteClientID("site")
+		users = append(users, &user)
+	}
+	return users, nil
+}
+
+func TestCacheDecoratorNonUniqueIndex(t *testing.T) {
+	ctx := context.Background()
+	params := userdata.GetUsersParams{Q: GetPtr("site_client_id:site")}
+	newDecorator := func(cfg Config) (*cacheDecorator, *testSharedAttributeAdapter) {
+		adapter := &testSharedAttributeAdapter{}
+		provider := keycloak.NewUserCache(ctx, keycloak.UserCacheConfig{TTL: time.Minute, Indexes: []string{"site_client_id"}}, nil)
+		t.Cleanup(func() { provider.Close() })
+		return NewCacheDecorator(adapter, provider, cfg), adapter
+	}
+
+	t.Run("без queryCache неуникальное значение всегда идёт в keycloak", func(t *testing.T) {
+		decorator, adapter := newDecorator(Config{})
+		for i := 0; i < 2; i++ {
+			users, err := decorator.GetUsers(ctx, "", testRealm, params)
+			require.NoError(t, err)
+			require.Len(t, users, 2)
+		}
+		require.EqualValues(t, 2, adapter.calls.Load())
+	})
+
+	t.Run("второй user значения не в cache", func(t *testing.T) {
+		adapter := &testSharedAttributeAdapter{}
+		provider := keycloak.NewUserCache(ctx, keycloak.UserCacheConfig{TTL: time.Minute, Indexes: []string{"site_client_id"}}, nil)
+		defer provider.Close()
+		user := testUserFactory("1", "1@test.test")
+		user.SetSiteClientID("site")
+		provider.SetUser(ctx, testRealm, *user.ID, *user.Email, user)
+		decorator := NewCacheDecorator(adapter, provider, Config{})
+
+		users, err := decorator.GetUsers(ctx, "", testRealm, params)
+		require.NoError(t, err)
+		require.Len(t, users, 2)
+		require.EqualValues(t, 1, adapter.calls.Load())
+	})
+
+	t.Run("с queryCache отдаются все user'ы значения", func(t *testing.T) {
+		decorator, adapter := newDecorator(Config{QueryTTL: time.Minute})
+		for i := 0; i < 2; i++ {
+			users, err := decorator.GetUsers(ctx, "", testRealm, params)
+			require.NoError(t, err)
+			require.Len(t, users, 2)
+		}
+		require.EqualValues(t, 1, adapter.calls.Load())
+	})
+}
+
+func TestCacheDecoratorRedisProvider(t *testing.T) {
+	ctx := context.Background()
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer client.Close()
+	release := make(chan struct{})
+	close(release)
+	adapter := &testUserAdapter{release: release}
+	// Две реплики с общим redis
+	first := NewCacheDecorator(adapter, rediscache.NewUserCache(client, rediscache.UserCacheConfig{TTL: time.Minute}), Config{})
+	second := NewCacheDecorator(adapter, rediscache.NewUserCache(client, rediscache.UserCacheConfig{TTL: time.Minute}), Config{})
+
+	user, err := first.GetUserByID(ctx, "token", testRealm, "1")
+	require.NoError(t, err)
+	cachedUser, err := second.GetUserByID(ctx, "token", testRealm, "1")
+	require.NoError(t, err)
+	require.Equal(t, user, cachedUser)
+	require.Equal(t, int64(1), adapter.calls.Load())
+}
+
+func TestTieredProvider(t *testing.T) {
+	ctx := context.Background()
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer client.Close()
+	l2 := rediscache.NewUserCache(client, rediscache.UserCacheConfig{TTL: time.Minute})
+	newL1 := func() cachedUsersProvider {
+		l1 := keycloak.NewUserCache(ctx, keycloak.UserCacheConfig{TTL: time.Minute, MaxEntries: 10}, nil)
+		t.Cleanup(func() { l1.Close() })
+		return l1
+	}
+	first, second := newL1(), newL1()
+	firstTiered := NewTieredProvider(first, l2)
+	secondTiered := NewTieredProvider(second, l2)
+
+	user := testUserFactory("1", "1@test.test")
+	firstTiered.SetUser(ctx, testRealm, *user.ID, *user.Email, user)
+
+	t.Run("запись попадает в оба уровня", func(t *testing.T) {
+		_, err := first.GetUserByUserID(ctx, testRealm, "1")
+		require.NoError(t, err)
+		_, err = l2.GetUserByUserID(ctx, testRealm, "1")
+		require.NoError(t, err)
+	})
+
+	t.Run("промах L1 читается из L2 и переносится в L1", func(t *testing.T) {
+		_, err := second.GetUserByEmail(ctx, testRealm, "1@test.test")
+		require.Error(t, err)
+
+		cachedUser, err := secondTiered.GetUserByEmail(ctx, testRealm, "1@test.test")
+		require.NoError(t, err)
+		require.Equal(t, user, cachedUser)
+
+		cachedUser, err = second.GetUserByUserID(ctx, testRealm, "1")
+		require.NoError(t, err)
+		require.Equal(t, user, cachedUser)
+	})
+
+	t.Run("инвалидация удаляет user'а с обоих уровней", func(t *testing.T) {
+		secondTiered.InvalidateUser(ctx, testRealm, "1")
+
+		_, err := secondTiered.GetUserByUserID(ctx, testRealm, "1")
+		require.Error(t, err)
+		_, err = l2.GetUserByUserID(ctx, testRealm, "1")
+		require.Error(t, err)
+	})
+}
+
+func TestCacheDecoratorInvalidationBus(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bus := invalidation.NewMemoryBus()
+	adapter := &testUserAdapter{release: make(chan struct{})}
+	close(adapter.release)
+	newReplica := func(provider cachedUsersProvider) *cacheDecorator {
+		decorator := NewCacheDecorator(adapter, provider, Config{Bus: bus})
+		require.NoError(t, decorator.ListenInvalidations(ctx))
+		return decorator
+	}
+	newLocal := func() cachedUsersProvider {
+		provider := keycloak.NewUserCache(ctx, keycloak.UserCacheConfig{TTL: time.Minute}, nil)
+		t.Cleanup(func() { provider.Close() })
+		return provider
+	}
+	oldUser := testUserFactory("1", "old@test.test")
+	newUser := testUserFactory("1", "new@test.test")
+
+	t.Run("UpdateUser сбрасывает user'а в cache других реплик", func(t *testing.T) {
+		firstCache, secondCache := newLocal(), newLocal()
+		first, _ := newReplica(firstCache), newReplica(secondCache)
+		secondCache.SetUser(ctx, testRealm, "1", "old@test.test", oldUser)
+
+		require.NoError(t, first.UpdateUser(ctx, "", testRealm, newUser))
+
+		_, err := secondCache.GetUserByUserID(ctx, testRealm, "1")
+		require.Error(t, err)
+		_, err = secondCache.GetUserByEmail(ctx, testRealm, "old@test.test")
+		require.Error(t, err)
+		// Собственное событие реплика не применяет
+		cachedUser, err := firstCache.GetUserByUserID(ctx, testRealm, "1")
+		require.NoError(t, err)
+		require.Equal(t, newUser, cachedUser)
+	})
+
+	t.Run("InvalidateRealm сбрасывает realm в cache других реплик", func(t *testing.T) {
+		firstCache, secondCache := newLocal(), newLocal()
+		first, _ := newReplica(firstCache), newReplica(secondCache)
+		secondCache.SetUser(ctx, testRealm, "1", "old@test.test", oldUser)
+
+		first.InvalidateRealm(ctx, testRealm)
+
+		_, err := secondCache.GetUserByUserID(ctx, testRealm, "1")
+		require.Error(t, err)
+	})
+
+	t.Run("события других реплик сбрасывают только локальный уровень", func(t *testing.T) {
+		server := miniredis.RunT(t)
+		client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+		defer client.Close()
+		l2 := rediscache.NewUserCache(client, rediscache.UserCacheConfig{TTL: time.Minute})
+		firstL1, secondL1 := newLocal(), newLocal()
+		first := newReplica(NewTieredProvider(firstL1, l2))
+		newReplica(NewTieredProvider(secondL1, l2))
+		secondL1.SetUser(ctx, testRealm, "1", "old@test.test", oldUser)
+
+		require.NoError(t, first.UpdateUser(ctx, "", testRealm, newUser))
+
+		_, err := secondL1.GetUserByUserID(ctx, testRealm, "1")
+		require.Error(t, err)
+		cachedUser, err := l2.GetUserByUserID(ctx, testRealm, "1")
+		require.NoError(t, err)
+		require.Equal(t, newUser, cachedUser)
+	})
+
+	t.Run("события не удаляют записи общего redis без локального уровня", func(t *testing.T) {
+		server := miniredis.RunT(t)
+		client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+		defer client.Close()
+		shared := rediscache.NewUserCache(client, rediscache.UserCacheConfig{TTL: time.Minute})
+		first := newReplica(shared)
+		newReplica(shared)
+
+		require.NoError(t, first.UpdateUser(ctx, "", testRealm, newUser))
+
+		cachedUser, err := shared.GetUserByUserID(ctx, testRealm, "1")
+		require.NoError(t, err)
+		require.Equal(t, newUser, cachedUser)
+	})
+}
+
+// testPagedAdapter - Отдаёт total user'ов постранично
+type testPagedAdapter struct {
+	UserAdapter
+	total int
+	// Ошибка, которую вернёт GetUsers
+	err   error
+	calls atomic.Int64
+	// Если задано - каждый token годится только на одну страницу, как истёкший
+	singleUseTokens bool
+	usedTokens      sync.Map
+}
+
+func (a *testPagedAdapter) LoginClient(ctx context.Context, clientID, clientSecret, realm string, scopes ...string) (*userdata.JWT, error) {
+	return &userdata.JWT{AccessToken: "token"}, nil
+}
+
+func (a *testPagedAdapter) GetUsers(ctx context.Context, token, realm string, params userdata.GetUsersParams) ([]*userdata.User, error) {
+	a.calls.Add(1)
+	if a.err != nil {
+		return nil, a.err
+	}
+	if _, used := a.usedTokens.LoadOrStore(token, struct{}{}); used && a.singleUseTokens {
+		return nil, pkg.ErrUnauthorized
+	}
+	users := []*userdata.User{}
+	for i := *params.First; i < a.total && i < *params.First+*params.Max; i++ {
+		user := testUserFactory(strconv.Itoa(i), strconv.Itoa(i)+"@test.test")
+		users = append(users, &user)
+	}
+	return users, nil
+}
+
+// testTokenSource - Отдаёт новый token на каждый вызов
+type testTokenSource struct {
+	calls atomic.Int64
+}
+
+func (s *testTokenSource) Token(ctx context.Context, realm string) (string, error) {
+	return "token-" + strconv.FormatInt(s.calls.Add(1), 10), nil
+}
+
+func TestPreloader(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("загружаем всех user'ов realm'а и открываем readiness", func(t *testing.T) {
+		provider := keycloak.NewUserCache(ctx, keycloak.UserCacheConfig{TTL: time.Minute}, nil)
+		defer provider.Close()
+		adapter := &testPagedAdapter{total: 95}
+		preloader := NewPreloader(adapter, provider, PreloadConfig{
+			Realms:            []string{testRealm},
+			PageSize:          10,
+			Concurrency:       3,
+			RequestsPerSecond: 1000,
+		})
+
+		rec := httptest.NewRecorder()
+		preloader.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ready", nil))
+		require.Equal(t, http.StatusServiceUnavailable, rec.Code)
+
+		require.NoError(t, preloader.Run(ctx))
+		require.NoError(t, preloader.Wait(ctx))
+		require.Equal(t, 95, provider.Stats(testRealm).Size)
+		_, err := provider.GetUserByEmail(ctx, testRealm, "94@test.test")
+		require.NoError(t, err)
+
+		rec = httptest.NewRecorder()
+		preloader.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ready", nil))
+		require.Equal(t, http.StatusOK, rec.Code)
+	})
+
+	t.Run("token берётся на каждую страницу", func(t *testing.T) {
+		provider := keycloak.NewUserCache(ctx, keycloak.UserCacheConfig{TTL: time.Minute}, nil)
+		defer provider.Close()
+		adapter := &testPagedAdapter{total: 95, singleUseTokens: true}
+		tokens := &testTokenSource{}
+		preloader := NewPreloader(adapter, provider, PreloadConfig{
+			Realms:      []string{testRealm},
+			PageSize:    10,
+			Concurrency: 1,
+			Tokens:      tokens,
+		})
+
+		require.NoError(t, preloader.Run(ctx))
+		require.Equal(t, 95, provider.Stats(testRealm).Size)
+		require.Equal(t, adapter.calls.Load(), tokens.calls.Load())
+	})
+
+	t.Run("ошибка keycloak прерывает предзагрузку и не открывает readiness", func(t *testing.T) {
+		provider := keycloak.NewUserCache(ctx, keycloak.UserCacheConfig{TTL: time.Minute}, nil)
+		defer provider.Close()
+		upstreamErr := errors.New("keycloak unavailable")
+		preloader := NewPreloader(&testPagedAdapter{total: 95, err: upstreamErr}, provider, PreloadConfig{
+			Realms: []string{testRealm},
+		})
+
+		require.ErrorIs(t, preloader.Run(ctx), upstreamErr)
+		<-preloader.Ready()
+
+		rec := httptest.NewRecorder()
+		preloader.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ready", nil))
+		require.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	})
+}
+
+func TestCacheDecoratorQueryCache(t *testing.T) {
+	ctx := context.Background()
+	adapter := &testUserAdapter{release: make(chan struct{})}
+	close(adapter.release)
+	provider := keycloak.NewUserCache(ctx, keycloak.UserCacheConfig{TTL: time.Minute}, nil)
+	defer provider.Close()
+	decorator := NewCacheDecorator(adapter, provider, Config{QueryTTL: time.Minute})
+	query := userdata.GetUsersParams{Search: GetPtr("test"), Enabled: GetPtr(true), First: GetPtr(0), Max: GetPtr(10)}
+
+	getUsers := func(params userdata.GetUsersParams) {
+		users, err := decorator.GetUsers(ctx, "", testRealm, params)
+		require.NoError(t, err)
+		require.Len(t, users, 1)
+		require.Equal(t, "1", *users[0].ID)
+	}
+
+	t.Run("повторный запрос отдаётся из cache", func(t *testing.T) {
+		getUsers(query)
+		getUsers(query)
+		require.EqualValues(t, 1, adapter.calls.Swap(0))
+	})
+
+	t.Run("другая страница - другой запрос", func(t *testing.T) {
+		next := query
+		next.First = GetPtr(10)
+		getUsers(next)
+		require.EqualValues(t, 1, adapter.calls.Swap(0))
+	})
+
+	t.Run("без user'а в cache запрос идёт в keycloak", func(t *testing.T) {
+		provider.InvalidateUser(ctx, testRealm, "1")
+		getUsers(query)
+		require.EqualValues(t, 1, adapter.calls.Swap(0))
+	})
+
+	t.Run("запись user'а сбрасывает запросы realm'а", func(t *testing.T) {
+		require.NoError(t, decorator.UpdateUser(ctx, "", testRealm, testUserFactory("2", "2@test.test")))
+		getUsers(query)
+		require.EqualValues(t, 1, adapter.calls.Swap(0))
+	})
+
+	t.Run("без QueryTTL запросы не кэшируются", func(t *testing.T) {
+		decorator := NewCacheDecorator(adapter, provider, Config{})
+		for i := 0; i < 2; i++ {
+			_, err := decorator.GetUsers(ctx, "", testRealm, query)
+			require.NoError(t, err)
+		}
+		require.EqualValues(t, 2, adapter.calls.Swap(0))
+	})
+}
+
+// testVerifier - Считает проверки и отдаёт claims известных token'ов
+type testVerifier struct {
+	claims map[string]*userdata.TokenClaims
+	calls  atomic.Int64
+}
+
+func (v *testVerifier) VerifyToken(ctx context.Context, accessToken, realm string) (*userdata.TokenClaims, error) {
+	v.calls.Add(1)
+	claims, ok := v.claims[accessToken]
+	if !ok {
+		return nil, errors.New("invalid token")
+	}
+	return claims, nil
+}
+
+func TestCacheDecoratorAuthorization(t *testing.T) {
+	ctx := context.Background()
+	adapter := &testUserAdapter{release: make(chan struct{})}
+	close(adapter.release)
+	provider := keycloak.NewUserCache(ctx, keycloak.UserCacheConfig{TTL: time.Minute}, nil)
+	defer provider.Close()
+	provider.SetUser(ctx, testRealm, "1", "1@test.test", testUserFactory("1", "1@test.test"))
+	verifier := &testVerifier{claims: map[string]*userdata.TokenClaims{
+		"admin": {
+			ExpiresAt:   time.Now().Add(time.Hour),
+			ClientRoles: map[string][]string{"realm-management": {"view-users"}},
+		},
+		"user": {
+			ExpiresAt:  time.Now().Add(time.Hour),
+			RealmRoles: []string{"default-roles-test"},
+		},
+	}}
+	decorator := NewCacheDecorator(adapter, provider, Config{Verifier: verifier})
+
+	testCases := []struct {
+		name    string
+		token   string
+		wantErr error
+	}{
+		{
+			name:    "без token'а cache не отдаётся",
+			token:   "",
+			wantErr: ErrUnauthorized,
+		},
+		{
+			name:    "невалидный token",
+			token:   "forged",
+			wantErr: ErrUnauthorized,
+		},
+		{
+			name:    "token без роли view-users",
+			token:   "user",
+			wantErr: ErrForbidden,
+		},
+		{
+			name:  "token с ролью view-users",
+			token: "admin",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			user, err := decorator.GetUserByID(ctx, tc.token, testRealm, "1")
+			require.ErrorIs(t, err, tc.wantErr)
+			if tc.wantErr != nil {
+				require.Nil(t, user)
+			}
+			_, err = decorator.GetUsers(ctx, tc.token, testRealm, userdata.GetUsersParams{Email: GetPtr("1@test.test")})
+			require.ErrorIs(t, err, tc.wantErr)
+		})
+	}
+
+	t.Run("проверенный token повторно не проверяется", func(t *testing.T) {
+		verifier.calls.Store(0)
+		for i := 0; i < 3; i++ {
+			_, err := decorator.GetUserByID(ctx, "admin", testRealm, "1")
+			require.NoError(t, err)
+		}
+		require.Zero(t, verifier.calls.Load())
+	})
+}
+
+// testRolesAdapter - Отдаёт роли user'а и считает походы за ними
+type testRolesAdapter struct {
+	UserAdapter
+	mu         sync.Mutex
+	realmRoles []string
+	calls      atomic.Int64
+}
+
+func roleFactory(names ...string) []*userdata.Role {
+	roles := make([]*userdata.Role, 0, len(names))
+	for _, name := range names {
+		roles = append(roles, &userdata.Role{Name: GetPtr(name)})
+	}
+	return roles
+}
+
+func (a *testRolesAdapter) GetCompositeRealmRolesByUserID(ctx context.Context, token, realm, userID string) ([]*userdata.Role, error) {
+	a.calls.Add(1)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return roleFactory(a.realmRoles...), nil
+}
+
+func (a *testRolesAdapter) GetCompositeClientRolesByUserID(ctx context.Context, token, realm, idOfClient, userID string) ([]*userdata.Role, error) {
+	return roleFactory(idOfClient + "-role"), nil
+}
+
+func (a *testRolesAdapter) AddRealmRolesToUser(ctx context.Context, token, realm, userID string, roles []userdata.Role) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, role := range roles {
+		a.realmRoles = append(a.realmRoles, *role.Name)
+	}
+	return nil
+}
+
+func TestCacheDecoratorEffectiveRoles(t *testing.T) {
+	ctx := context.Background()
+	adapter := &testRolesAdapter{realmRoles: []string{"user"}}
+	decorator := NewCacheDecorator(adapter, nil, Config{RolesTTL: time.Minute})
+
+	t.Run("роли кэшируются по user'у и набору client'ов", func(t *testing.T) {
+		for _, clients := range [][]string{{"a", "b"}, {"b", "a"}} {
+			roles, err := decorator.GetEffectiveRoles(ctx, "", testRealm, "1", clients...)
+			require.NoError(t, err)
+			require.Equal(t, &userdata.EffectiveRoles{
+				RealmRoles:  []string{"user"},
+				ClientRoles: map[string][]string{"a": {"a-role"}, "b": {"b-role"}},
+			}, roles)
+		}
+		require.EqualValues(t, 1, adapter.calls.Swap(0))
+
+		_, err := decorator.GetEffectiveRoles(ctx, "", testRealm, "1")
+		require.NoError(t, err)
+		require.EqualValues(t, 1, adapter.calls.Swap(0))
+	})
+
+	t.Run("изменение ролей сбрасывает роли user'а", func(t *testing.T) {
+		require.NoError(t, decorator.AddRealmRolesToUser(ctx, "", testRealm, "1", []userdata.Role{{Name: GetPtr("admin")}}))
+
+		roles, err := decorator.GetEffectiveRoles(ctx, "", testRealm, "1")
+		require.NoError(t, err)
+		require.Equal(t, []string{"user", "admin"}, roles.RealmRoles)
+		require.EqualValues(t, 1, adapter.calls.Swap(0))
+	})
+}
+
+// testActionsAdapter - Keycloak, в котором письма меняют required actions и EmailVerified user'а
+type testActionsAdapter struct {
+	UserAdapter
+	sync.Mutex
+	user  userdata.User
+	calls atomic.Int64
+	// Если задан - первый GetUserByID читает user'а и ждёт его закрытия
+	block chan struct{}
+}
+
+func (a *testActionsAdapter) GetUserByID(ctx context.Context, accessToken, realm, userID string) (*userdata.User, error) {
+	calls := a.calls.Add(1)
+	a.Lock()
+	user := a.user
+	a.Unlock()
+	if a.block != nil && calls == 1 {
+		<-a.block
+	}
+	return &user, nil
+}
+
+func (a *testActionsAdapter) ExecuteActionsEmail(ctx context.Context, token, realm, userID string, actions []userdata.RequiredAction, params userdata.ExecuteActionsEmailParams) error {
+	a.Lock()
+	defer a.Unlock()
+	requiredActions := make([]string, 0, len(actions))
+	for _, action := range actions {
+		requiredActions = append(requiredActions, string(action))
+	}
+	a.user.RequiredActions = &requiredActions
+	return nil
+}
+
+func (a *testActionsAdapter) SendVerifyEmail(ctx context.Context, token, realm, userID string, params userdata.SendVerifyEmailParams) error {
+	a.Lock()
+	defer a.Unlock()
+	a.user.EmailVerified = GetPtr(false)
+	return nil
+}
+
+func TestCacheDecoratorRequiredActions(t *testing.T) {
+	ctx := context.Background()
+	adapter := &testActionsAdapter{user: testUserFactory("1", "1@test.test")}
+	decorator := newTestDecorator(t, adapter)
+
+	_, err := decorator.GetUserByID(ctx, "", testRealm, "1")
+	require.NoError(t, err)
+	require.EqualValues(t, 1, adapter.calls.Swap(0))
+
+	t.Run("письмо с required actions перечитывает user'а", func(t *testing.T) {
+		actions := []userdata.RequiredAction{userdata.RequiredActionUpdatePassword, userdata.RequiredActionConfigureTOTP}
+		require.NoError(t, decorator.ExecuteActionsEmail(ctx, "", testRealm, "1", actions, userdata.ExecuteActionsEmailParams{}))
+		require.EqualValues(t, 1, adapter.calls.Swap(0))
+
+		user, err := decorator.GetUserByID(ctx, "", testRealm, "1")
+		require.NoError(t, err)
+		require.Equal(t, &[]string{"UPDATE_PASSWORD", "CONFIGURE_TOTP"}, user.RequiredActions)
+		require.EqualValues(t, 0, adapter.calls.Load())
+	})
+
+	t.Run("письмо с подтверждением email перечитывает user'а", func(t *testing.T) {
+		require.NoError(t, decorator.SendVerifyEmail(ctx, "", testRealm, "1", userdata.SendVerifyEmailParams{}))
+		require.EqualValues(t, 1, adapter.calls.Swap(0))
+
+		user, err := decorator.GetUserByID(ctx, "", testRealm, "1")
+		require.NoError(t, err)
+		require.Equal(t, GetPtr(false), user.EmailVerified)
+		require.EqualValues(t, 0, adapter.calls.Load())
+	})
+}
+
+func TestCacheDecoratorRequiredActionsInFlight(t *testing.T) {
+	ctx := context.Background()
+	adapter := &testActionsAdapter{user: testUserFactory("1", "1@test.test"), block: make(chan struct{})}
+	decorator := newTestDecorator(t, adapter)
+
+	// Поход в keycloak, начатый до письма, прочитал user'а без required actions
+	fetched := make(chan struct{})
+	go func() {
+		defer close(fetched)
+		decorator.GetUserByID(ctx, "", testRealm, "1")
+	}()
+	require.Eventually(t, func() bool { return adapter.calls.Load() == 1 }, time.Second, time.Millisecond)
+	var once sync.Once
+	release := func() { once.Do(func() { close(adapter.block) }) }
+	defer release()
+
+	sent := make(chan error, 1)
+	go func() {
+		sent <- decorator.ExecuteActionsEmail(ctx, "", testRealm, "1", []userdata.RequiredAction{userdata.RequiredActionVerifyEmail}, userdata.ExecuteActionsEmailParams{})
+	}()
+	select {
+	case err := <-sent:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("ExecuteActionsEmail ждёт поход, начатый до письма")
+	}
+	require.EqualValues(t, 2, adapter.calls.Load())
+
+	// Поход, начатый до письма, завершается позже и не перетирает перечитанного user'а
+	release()
+	<-fetched
+	user, err := decorator.GetUserByID(ctx, "", testRealm, "1")
+	require.NoError(t, err)
+	require.Equal(t, &[]string{"VERIFY_EMAIL"}, user.RequiredActions)
+	require.EqualValues(t, 2, adapter.calls.Load())
+}
+
+// errBatchItem - Ошибка keycloak по одному user'у batch'а
+var errBatchItem = errors.New("batch item failed")
+
+// testBatchAdapter - Считает одновременные походы в keycloak
+type testBatchAdapter struct {
+	UserAdapter
+	inFlight    atomic.Int64
+	maxInFlight atomic.Int64
+	calls       atomic.Int64
+}
+
+func (a *testBatchAdapter) enter() func() {
+	a.calls.Add(1)
+	current := a.inFlight.Add(1)
+	for {
+		peak := a.maxInFlight.Load()
+		if current <= peak || a.maxInFlight.CompareAndSwap(peak, current) {
+			break
+		}
+	}
+	time.Sleep(5 * time.Millisecond)
+	return func() { a.inFlight.Add(-1) }
+}
+
+func (a *testBatchAdapter) CreateUser(ctx context.Context, token, realm string, user userdata.User) (string, error) {
+	defer a.enter()()
+	if *user.Email == "duplicate@test.test" {
+		return "", errBatchItem
+	}
+	return *user.ID, nil
+}
+
+func (a *testBatchAdapter) UpdateUser(ctx context.Context, token, realm string, user userdata.User) error {
+	defer a.enter()()
+	if user.ID == nil {
+		return errBatchItem
+	}
+	return nil
+}
+
+func (a *testBatchAdapter) GetUserByID(ctx context.Context, accessToken, realm, userID string) (*userdata.User, error) {
+	defer a.enter()()
+	if userID == "missing" {
+		return nil, pkg.ErrUserNotFound
+	}
+	user := testUserFactory(userID, userID+"@test.test")
+	return &user, nil
+}
+
+func TestCacheDecoratorBatch(t *testing.T) {
+	ctx := context.Background()
+	adapter := &testBatchAdapter{}
+	provider := keycloak.NewUserCache(ctx, keycloak.UserCacheConfig{TTL: time.Minute}, nil)
+	t.Cleanup(func() { provider.Close() })
+	decorator := NewCacheDecorator(adapter, provider, Config{BatchConcurrency: 3})
+
+	t.Run("CreateUsers возвращает результат по каждому user'у", func(t *testing.T) {
+		users := make([]userdata.User, 10)
+		for i := range users {
+			users[i] = testUserFactory(strconv.Itoa(i), strconv.Itoa(i)+"@test.test")
+		}
+		users[4].Email = GetPtr("duplicate@test.test")
+
+		results := decorator.CreateUsers(ctx, "", testRealm, users)
+		require.Len(t, results, len(users))
+		for i, result := range results {
+			if i == 4 {
+				require.ErrorIs(t, result.Err, errBatchItem)
+				continue
+			}
+			require.NoError(t, result.Err)
+			require.Equal(t, strconv.Itoa(i), result.UserID)
+		}
+		require.EqualValues(t, 10, adapter.calls.Swap(0))
+		require.LessOrEqual(t, adapter.maxInFlight.Load(), int64(3))
+	})
+
+	t.Run("UpdateUsers не прерывается на ошибке", func(t *testing.T) {
+		results := decorator.UpdateUsers(ctx, "", testRealm, []userdata.User{
+			testUserFactory("1", "updated@test.test"),
+			{Email: GetPtr("no-id@test.test")},
+		})
+		require.Equal(t, []BatchResult{{UserID: "1"}, {Err: errBatchItem}}, results)
+		require.EqualValues(t, 2, adapter.calls.Swap(0))
+	})
+
+	t.Run("GetUsersByIDs отдаёт найденных в cache без похода в keycloak", func(t *testing.T) {
+		results := decorator.GetUsersByIDs(ctx, "", testRealm, []string{"1", "2", "new", "missing"})
+		require.Len(t, results, 4)
+		require.Equal(t, GetPtr("updated@test.test"), results[0].User.Email)
+		require.Equal(t, GetPtr("2@test.test"), results[1].User.Email)
+		require.NoError(t, results[2].Err)
+		require.Equal(t, GetPtr("new@test.test"), results[2].User.Email)
+		require.ErrorIs(t, results[3].Err, pkg.ErrUserNotFound)
+		require.Nil(t, results[3].User)
+		require.EqualValues(t, 2, adapter.calls.Swap(0))
+	})
+}
+
+func TestCacheDecoratorErrors(t *testing.T) {
+	ctx := context.Background()
+	release := make(chan struct{})
+	close(release)
+
+	t.Run("ошибка keycloak доходит до вызывающего вместе с категорией", func(t *testing.T) {
+		keycloakErr := &pkg.KeycloakError{Code: http.StatusTooManyRequests, Kind: pkg.ErrRateLimited, Err: errors.New("429 Too Many Requests")}
+		decorator := newTestDecorator(t, &testUserAdapter{release: release, err: keycloakErr})
+
+		_, err := decorator.GetUserByID(ctx, "", testRealm, "1")
+		require.ErrorIs(t, err, pkg.ErrRateLimited)
+		var gotErr *pkg.KeycloakError
+		require.ErrorAs(t, err, &gotErr)
+		require.Equal(t, http.StatusTooManyRequests, gotErr.Code)
+	})
+
+	t.Run("промах по user'у - pkg.ErrNotFound", func(t *testing.T) {
+		adapter := &testUserAdapter{release: release}
+		adapter.notFound.Store(true)
+		provider := keycloak.NewUserCache(ctx, keycloak.UserCacheConfig{TTL: time.Minute}, nil)
+		t.Cleanup(func() { provider.Close() })
+		decorator := NewCacheDecorator(adapter, provider, Config{NegativeTTL: time.Minute})
+
+		for i := 0; i < 2; i++ {
+			_, err := decorator.GetUserByID(ctx, "", testRealm, "1")
+			require.ErrorIs(t, err, pkg.ErrUserNotFound)
+			require.ErrorIs(t, err, pkg.ErrNotFound)
+		}
+	})
+
+	t.Run("ошибки проверки token'а попадают в категории pkg", func(t *testing.T) {
+		require.ErrorIs(t, ErrUnauthorized, pkg.ErrUnauthorized)
+		require.ErrorIs(t, ErrForbidden, pkg.ErrForbidden)
+	})
+}
+
+func TestCacheDecoratorWithoutSecrets(t *testing.T) {
+	ctx := context.Background()
+	adapter := &testUserAdapter{release: make(chan struct{})}
+	decorator := newTestDecorator(t, adapter)
+	credentials := &[]userdata.CredentialRepresentation{{Type: GetPtr("password"), Value: GetPtr("plain-password")}}
+
+	t.Run("CreateUser не кладёт пароль в cache", func(t *testing.T) {
+		user := testUserFactory("1", "1@test.test")
+		user.Credentials = credentials
+		_, err := decorator.CreateUser(ctx, "", testRealm, user)
+		require.NoError(t, err)
+
+		cachedUser, err := decorator.GetUserByID(ctx, "", testRealm, "1")
+		require.NoError(t, err)
+		require.Nil(t, cachedUser.Credentials)
+	})
+
+	t.Run("UpdateUser не кладёт пароль в cache", func(t *testing.T) {
+		user := testUserFactory("2", "2@test.test")
+		user.Credentials = credentials
+		require.NoError(t, decorator.UpdateUser(ctx, "", testRealm, user))
+
+		cachedUser, err := decorator.GetUserByID(ctx, "", testRealm, "2")
+		require.NoError(t, err)
+		require.Nil(t, cachedUser.Credentials)
+	})
+	require.EqualValues(t, 0, adapter.calls.Load())
+}
+
+func TestCacheDecoratorRevalidateOnce(t *testing.T) {
+	decorator := NewCacheDecorator(&testUserAdapter{}, nil, Config{})
+	release := make(chan struct{})
+	var calls atomic.Int64
+	revalidate := func(ctx context.Context) {
+		calls.Add(1)
+		<-release
+	}
+
+	for i := 0; i < 100; i++ {
+		decorator.revalidate("key", revalidate)
+	}
+	close(release)
+	require.Eventually(t, func() bool {
+		_, running := decorator.revalidating.Load("key")
+		return !running
+	}, time.Second, time.Millisecond)
+	require.EqualValues(t, 1, calls.Load())
+
+	// После завершения ключ можно обновлять снова
+	decorator.revalidate("key", revalidate)
+	require.Eventually(t, func() bool { return calls.Load() == 2 }, time.Second, time.Millisecond)
+}
@@ -0,0 +1,95 @@
+package cache
+
+import "sync"
+
+// userGeneration - Поколение user'а и количество незавершённых походов за ним в keycloak
+type userGeneration struct {
+	generation uint64
+	fetching   int
+}
+
+// userGenerations - Поколения user'ов, за которыми сейчас идут в keycloak.
+// Любой сброс или запись user'а увеличивает его поколение, и поход, начатый до этого,
+// не сеттит в cache прочитанную до изменения копию. Хранятся только user'ы с незавершёнными походами
+type userGenerations struct {
+	sync.Mutex
+	// Ключ - realm, значение - маппа userID -> поколение
+	realms map[string]map[string]*userGeneration
+}
+
+func newUserGenerations() *userGenerations {
+	return &userGenerations{realms: make(map[string]map[string]*userGeneration)}
+}
+
+// Begin - Начинаем поход за user'ом и возвращаем текущее поколение. Парный вызов - End
+func (g *userGenerations) Begin(realm, userID string) uint64 {
+	g.Lock()
+	defer g.Unlock()
+	users, ok := g.realms[realm]
+	if !ok {
+		users = make(map[string]*userGeneration)
+		g.realms[realm] = users
+	}
+	entry, ok := users[userID]
+	if !ok {
+		entry = &userGeneration{}
+		users[userID] = entry
+	}
+	entry.fetching++
+	return entry.generation
+}
+
+// End - Завершаем поход за user'ом, без незавершённых походов поколение больше не храним
+func (g *userGenerations) End(realm, userID string) {
+	g.Lock()
+	defer g.Unlock()
+	entry, ok := g.realms[realm][userID]
+	if !ok {
+		return
+	}
+	entry.fetching--
+	if entry.fetching > 0 {
+		return
+	}
+	delete(g.realms[realm], userID)
+	if len(g.realms[realm]) == 0 {
+		delete(g.realms, realm)
+	}
+}
+
+// Changed - Менялся ли user после Begin, вернувшего generation
+func (g *userGenerations) Changed(realm, userID string, generation uint64) bool {
+	g.Lock()
+	defer g.Unlock()
+	entry, ok := g.realms[realm][userID]
+	return !ok || entry.generation != generation
+}
+
+// Bump - User изменился: походы, начатые до этого, устарели
+func (g *userGenerations) Bump(realm, userID string) {
+	g.Lock()
+	defer g.Unlock()
+	if entry, ok := g.realms[realm][userID]; ok {
+		entry.generation++
+	}
+}
+
+// BumpRealm - Изменились все user'ы realm'а
+func (g *userGenerations) BumpRealm(realm string) {
+	g.Lock()
+	defer g.Unlock()
+	for _, entry := range g.realms[realm] {
+		entry.generation++
+	}
+}
+
+// BumpAll - Изменились user'ы всех realm'ов
+func (g *userGenerations) BumpAll() {
+	g.Lock()
+	defer g.Unlock()
+	for _, users := range g.realms {
+		for _, entry := range users {
+			entry.generation++
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package cache
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// negativeSweepThreshold - Размер negativeCache, после которого при записи удаляем просроченные ключи
+const negativeSweepThreshold = 10000
+
+// negativeCache - Запоминает ключи, по которым keycloak не нашёл user'а
+type negativeCache struct {
+	// Время жизни записи о промахе
+	ttl time.Duration
+	sync.RWMutex
+	// Ключ - realm + userID или realm + email, значение - deadline записи
+	deadlines map[string]time.Time
+}
+
+func newNegativeCache(ttl time.Duration) *negativeCache {
+	return &negativeCache{
+		ttl:       ttl,
+		deadlines: make(map[string]time.Time),
+	}
+}
+
+// Add - Запоминаем промах по ключу
+func (n *negativeCache) Add(key string) {
+	if n.ttl <= 0 {
+		return
+	}
+	now := time.Now().UTC()
+	n.Lock()
+	defer n.Unlock()
+	if len(n.deadlines) >= negativeSweepThreshold {
+		for k, deadline := range n.deadlines {
+			if !deadline.After(now) {
+				delete(n.deadlines, k)
+			}
+		}
+	}
+	n.deadlines[key] = now.Add(n.ttl)
+}
+
+// Has - Есть ли не истёкшая запись о промахе по ключу
+func (n *negativeCache) Has(key string) bool {
+	n.RLock()
+	defer n.RUnlock()
+	deadline, ok := n.deadlines[key]
+	return ok && deadline.After(time.Now().UTC())
+}
+
+// Delete - Забываем промахи по ключам
+func (n *negativeCache) Delete(keys ...string) {
+	n.Lock()
+	defer n.Unlock()
+	for _, key := range keys {
+		delete(n.deadlines, key)
+	}
+}
+
+// DeleteRealm - Забываем все промахи realm'а
+func (n *negativeCache) DeleteRealm(realm string) {
+	prefix := realm + "/"
+	n.Lock()
+	defer n.Unlock()
+	for key := range n.deadlines {
+		if strings.HasPrefix(key, prefix) {
+			delete(n.deadlines, key)
+		}
+	}
+}
+
+// Purge - Забываем все промахи
+func (n *negativeCache) Purge() {
+	n.Lock()
+	defer n.Unlock()
+	n.deadlines = make(map[string]time.Time)
+}
@@ -0,0 +1,196 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mtvy/cached_updater/internal/metrics"
+	"github.com/mtvy/cached_updater/internal/token"
+	"github.com/mtvy/cached_updater/internal/userdata"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	defaultPreloadPageSize    = 100
+	defaultPreloadConcurrency = 4
+)
+
+// errPreloadNotFinished - Предзагрузка ещё идёт
+var errPreloadNotFinished = errors.New("preload is not finished")
+
+// PreloadConfig - Настройки preloader
+type PreloadConfig struct {
+	// Realm'ы, user'ов которых загружаем в cache
+	Realms []string
+	// Размер страницы GetUsers, если не задан - используем defaultPreloadPageSize
+	PageSize int
+	// Количество одновременных запросов страниц, если не задано - используем defaultPreloadConcurrency
+	Concurrency int
+	// Максимум запросов страниц в секунду на realm, 0 - без ограничения
+	RequestsPerSecond float64
+	// Service-account, под которым через LoginClient получаем token
+	ClientID     string
+	ClientSecret string
+	// Источник token'ов service-account'а, например token.Manager.Source.
+	// Если не задан - создаём свой manager по ClientID/ClientSecret
+	Tokens token.Source
+}
+
+// preloader - Заполняет cache user'ами realm'ов при старте сервиса,
+// чтобы первые запросы не шли в keycloak
+type preloader struct {
+	userAdapter  UserAdapter
+	userProvider cachedUsersProvider
+	cfg          PreloadConfig
+	// Отдаёт token на каждую страницу, чтобы он не истёк посреди большого realm'а
+	tokens token.Source
+
+	// Закрывается после завершения Run
+	done chan struct{}
+	once sync.Once
+	// Ошибка Run, читается после закрытия done
+	err error
+}
+
+func NewPreloader(userAdapter UserAdapter, userProvider cachedUsersProvider, cfg PreloadConfig) *preloader {
+	if cfg.PageSize <= 0 {
+		cfg.PageSize = defaultPreloadPageSize
+	}
+	if cfg.Concurrency <= 0 {
+		cfg.Concurrency = defaultPreloadConcurrency
+	}
+	tokens := cfg.Tokens
+	if tokens == nil {
+		tokens = token.NewManager(userAdapter, token.Config{}).Source(cfg.ClientID, cfg.ClientSecret)
+	}
+	return &preloader{
+		userAdapter:  userAdapter,
+		userProvider: userProvider,
+		cfg:          cfg,
+		tokens:       tokens,
+		done:         make(chan struct{}),
+	}
+}
+
+// Run - Загружаем все realm'ы по очереди. Повторный вызов ничего не делает
+func (p *preloader) Run(ctx context.Context) error {
+	p.once.Do(func() {
+		defer close(p.done)
+		for _, realm := range p.cfg.Realms {
+			metrics.SetKeycloakCachePreloadDone(realm, false)
+		}
+		for _, realm := range p.cfg.Realms {
+			if _, err := p.Preload(ctx, realm); err != nil {
+				p.err = err
+				return
+			}
+			metrics.SetKeycloakCachePreloadDone(realm, true)
+		}
+	})
+	<-p.done
+	return p.err
+}
+
+// Ready - Закрывается после завершения Run, в том числе с ошибкой
+func (p *preloader) Ready() <-chan struct{} {
+	return p.done
+}
+
+// Wait - Ждём завершения Run и возвращаем его ошибку
+func (p *preloader) Wait(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-p.done:
+		return p.err
+	}
+}
+
+// ServeHTTP - Readiness probe: 200 после успешной предзагрузки, иначе 503
+func (p *preloader) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	err := errPreloadNotFinished
+	select {
+	case <-p.done:
+		err = p.err
+	default:
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// Preload - Постранично загружаем user'ов realm'а в cache.
+// Страницы запрашиваются cfg.Concurrency воркерами, пока одна из них не окажется неполной.
+// Token берём из p.tokens перед каждой страницей, он обновляется до истечения.
+// Возвращаем количество загруженных user'ов
+func (p *preloader) Preload(ctx context.Context, realm string) (int, error) {
+	var limiter <-chan time.Time
+	if p.cfg.RequestsPerSecond > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / p.cfg.RequestsPerSecond))
+		defer ticker.Stop()
+		limiter = ticker.C
+	}
+
+	var (
+		// Номер следующей страницы
+		nextPage atomic.Int64
+		loaded   atomic.Int64
+		// Одна из страниц оказалась неполной, дальше user'ов нет
+		exhausted atomic.Bool
+	)
+	group, ctx := errgroup.WithContext(ctx)
+	for i := 0; i < p.cfg.Concurrency; i++ {
+		group.Go(func() error {
+			for !exhausted.Load() {
+				if limiter != nil {
+					select {
+					case <-ctx.Done():
+						return ctx.Err()
+					case <-limiter:
+					}
+				}
+				accessToken, err := p.tokens.Token(ctx, realm)
+				if err != nil {
+					return err
+				}
+				first := int(nextPage.Add(1)-1) * p.cfg.PageSize
+				users, err := p.userAdapter.GetUsers(ctx, accessToken, realm, userdata.GetUsersParams{
+					First: &first,
+					Max:   &p.cfg.PageSize,
+				})
+				if err != nil {
+					return err
+				}
+				p.setUsers(ctx, realm, users)
+				loaded.Add(int64(len(users)))
+				metrics.AddKeycloakCachePreloaded(realm, len(users))
+				if len(users) < p.cfg.PageSize {
+					exhausted.Store(true)
+				}
+			}
+			return nil
+		})
+	}
+	err := group.Wait()
+	return int(loaded.Load()), err
+}
+
+// setUsers - Сеттим страницу user'ов в cache, пропуская user'ов без ID
+func (p *preloader) setUsers(ctx context.Context, realm string, users []*userdata.User) {
+	for _, user := range users {
+		if user == nil || user.ID == nil {
+			continue
+		}
+		email := ""
+		if user.Email != nil {
+			email = *user.Email
+		}
+		p.userProvider.SetUser(ctx, realm, *user.ID, email, *user)
+	}
+}
@@ -0,0 +1,112 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/mtvy/cached_updater/internal/userdata"
+)
+
+// queryCacheSweepThreshold - Количество запросов realm'а, после которого при записи удаляем просроченные
+const queryCacheSweepThreshold = 10000
+
+// queryResult - Результат запроса GetUsers: userID в порядке ответа keycloak
+type queryResult struct {
+	userIDs  []string
+	deadline time.Time
+}
+
+// queryCache - Запоминает результаты произвольных запросов GetUsers как списки userID.
+// Сами user'ы достаются из cachedUsersProvider
+type queryCache struct {
+	// Время жизни результата, 0 - запросы не кэшируются
+	ttl time.Duration
+	sync.RWMutex
+	// Ключ - realm, значение - маппа ключ запроса -> результат
+	realms map[string]map[string]queryResult
+	// Увеличивается при каждом сбросе, чтобы не сохранить результат,
+	// полученный из keycloak до записи user'а
+	version uint64
+}
+
+func newQueryCache(ttl time.Duration) *queryCache {
+	return &queryCache{
+		ttl:    ttl,
+		realms: make(map[string]map[string]queryResult),
+	}
+}
+
+// Enabled - Кэшируются ли запросы
+func (q *queryCache) Enabled() bool {
+	return q.ttl > 0
+}
+
+// Get - Достаём не истёкший результат запроса realm'а
+func (q *queryCache) Get(realm, key string) ([]string, bool) {
+	q.RLock()
+	defer q.RUnlock()
+	result, ok := q.realms[realm][key]
+	if !ok || !result.deadline.After(time.Now().UTC()) {
+		return nil, false
+	}
+	return result.userIDs, true
+}
+
+// Version - Текущая версия, берётся перед походом в keycloak и передаётся в Set
+func (q *queryCache) Version() uint64 {
+	q.RLock()
+	defer q.RUnlock()
+	return q.version
+}
+
+// Set - Запоминаем результат запроса realm'а, если с version не было сбросов
+func (q *queryCache) Set(realm, key string, version uint64, userIDs []string) {
+	if q.ttl <= 0 {
+		return
+	}
+	now := time.Now().UTC()
+	q.Lock()
+	defer q.Unlock()
+	if version != q.version {
+		return
+	}
+	results, ok := q.realms[realm]
+	if !ok {
+		results = make(map[string]queryResult)
+		q.realms[realm] = results
+	}
+	if len(results) >= queryCacheSweepThreshold {
+		for k, result := range results {
+			if !result.deadline.After(now) {
+				delete(results, k)
+			}
+		}
+	}
+	results[key] = queryResult{userIDs: userIDs, deadline: now.Add(q.ttl)}
+}
+
+// DeleteRealm - Забываем все запросы realm'а: после записи любого user'а они могли измениться
+func (q *queryCache) DeleteRealm(realm string) {
+	q.Lock()
+	defer q.Unlock()
+	delete(q.realms, realm)
+	q.version++
+}
+
+// Purge - Забываем запросы всех realm'ов
+func (q *queryCache) Purge() {
+	q.Lock()
+	defer q.Unlock()
+	q.realms = make(map[string]map[string]queryResult)
+	q.version++
+}
+
+// queryKey - Канонический ключ запроса: hash от params, где поля идут в порядке объявления
+func queryKey(params userdata.GetUsersParams) string {
+	data, _ := json.Marshal(params)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
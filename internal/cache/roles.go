@@ -0,0 +1,255 @@
+package cache
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mtvy/cached_updater/internal/invalidation"
+	"github.com/mtvy/cached_updater/internal/metrics"
+	"github.com/mtvy/cached_updater/internal/userdata"
+)
+
+const (
+	// Отдали эффективные роли user'а из cache
+	cacheRolesHit = "cache_roles_hit"
+	// Получили эффективные роли user'а из keycloak
+	getKeycloakRoles = "keycloak_get_effective_roles"
+)
+
+// cachedRoles - Эффективные роли user'а с deadline
+type cachedRoles struct {
+	roles    *userdata.EffectiveRoles
+	deadline time.Time
+}
+
+// rolesCache - Эффективные роли user'ов. Набор client'ов входит в ключ,
+// поэтому у одного user'а может быть несколько записей
+type rolesCache struct {
+	// Время жизни записи, 0 - роли не кэшируются
+	ttl time.Duration
+	sync.RWMutex
+	// Ключ - realm, значение - маппа userID -> набор client'ов -> роли
+	realms map[string]map[string]map[string]cachedRoles
+	// Увеличивается при каждом сбросе, как в queryCache
+	version uint64
+}
+
+func newRolesCache(ttl time.Duration) *rolesCache {
+	return &rolesCache{
+		ttl:    ttl,
+		realms: make(map[string]map[string]map[string]cachedRoles),
+	}
+}
+
+// clientsKey - Ключ набора client'ов независимо от порядка
+func clientsKey(idOfClients []string) string {
+	sorted := append([]string(nil), idOfClients...)
+	sort.Strings(sorted)
+	return strings.Join(sorted, ",")
+}
+
+func (r *rolesCache) Get(realm, userID, clients string) (*userdata.EffectiveRoles, bool) {
+	r.RLock()
+	defer r.RUnlock()
+	cached, ok := r.realms[realm][userID][clients]
+	if !ok || !cached.deadline.After(time.Now().UTC()) {
+		return nil, false
+	}
+	return cached.roles, true
+}
+
+func (r *rolesCache) Version() uint64 {
+	r.RLock()
+	defer r.RUnlock()
+	return r.version
+}
+
+// Set - Запоминаем роли user'а, если с version не было сбросов
+func (r *rolesCache) Set(realm, userID, clients string, version uint64, roles *userdata.EffectiveRoles) {
+	if r.ttl <= 0 {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	if version != r.version {
+		return
+	}
+	users, ok := r.realms[realm]
+	if !ok {
+		users = make(map[string]map[string]cachedRoles)
+		r.realms[realm] = users
+	}
+	entries, ok := users[userID]
+	if !ok {
+		entries = make(map[string]cachedRoles)
+		users[userID] = entries
+	}
+	entries[clients] = cachedRoles{roles: roles, deadline: time.Now().UTC().Add(r.ttl)}
+}
+
+// DeleteUser - Забываем роли user'а по всем наборам client'ов
+func (r *rolesCache) DeleteUser(realm, userID string) {
+	r.Lock()
+	defer r.Unlock()
+	delete(r.realms[realm], userID)
+	r.version++
+}
+
+func (r *rolesCache) DeleteRealm(realm string) {
+	r.Lock()
+	defer r.Unlock()
+	delete(r.realms, realm)
+	r.version++
+}
+
+func (r *rolesCache) Purge() {
+	r.Lock()
+	defer r.Unlock()
+	r.realms = make(map[string]map[string]map[string]cachedRoles)
+	r.version++
+}
+
+// copyEffectiveRoles - Копия ролей, чтобы вызывающий не менял запись cache
+func copyEffectiveRoles(roles *userdata.EffectiveRoles) *userdata.EffectiveRoles {
+	if roles == nil {
+		return nil
+	}
+	copied := &userdata.EffectiveRoles{
+		RealmRoles:  append([]string(nil), roles.RealmRoles...),
+		ClientRoles: make(map[string][]string, len(roles.ClientRoles)),
+	}
+	for idOfClient, clientRoles := range roles.ClientRoles {
+		copied.ClientRoles[idOfClient] = append([]string(nil), clientRoles...)
+	}
+	return copied
+}
+
+func roleNames(roles []*userdata.Role) []string {
+	names := make([]string, 0, len(roles))
+	for _, role := range roles {
+		if role != nil && role.Name != nil {
+			names = append(names, *role.Name)
+		}
+	}
+	return names
+}
+
+// GetEffectiveRoles - Роли user'а realm'а с учётом групп и composite ролей:
+// роли realm'а и роли перечисленных client'ов. Результат кэшируется на Config.RolesTTL
+// и сбрасывается при изменении групп и ролей user'а
+func (c *cacheDecorator) GetEffectiveRoles(ctx context.Context, token, realm, userID string, idOfClients ...string) (*userdata.EffectiveRoles, error) {
+	if err := c.authorize(ctx, token, realm); err != nil {
+		return nil, err
+	}
+	clients := clientsKey(idOfClients)
+	if roles, ok := c.roles.Get(realm, userID, clients); ok {
+		metrics.IncKeycloakCacheEvent(realm, cacheRolesHit)
+		return copyEffectiveRoles(roles), nil
+	}
+	result, err := c.do(ctx, realm, userIDKey(realm, userID)+"/roles:"+clients, func(ctx context.Context) (interface{}, error) {
+		version := c.roles.Version()
+		realmRoles, err := c.userAdapter.GetCompositeRealmRolesByUserID(ctx, token, realm, userID)
+		if err != nil {
+			return nil, err
+		}
+		roles := &userdata.EffectiveRoles{
+			RealmRoles:  roleNames(realmRoles),
+			ClientRoles: make(map[string][]string, len(idOfClients)),
+		}
+		for _, idOfClient := range idOfClients {
+			clientRoles, err := c.userAdapter.GetCompositeClientRolesByUserID(ctx, token, realm, idOfClient, userID)
+			if err != nil {
+				return nil, err
+			}
+			roles.ClientRoles[idOfClient] = roleNames(clientRoles)
+		}
+		c.roles.Set(realm, userID, clients, version, roles)
+		metrics.IncKeycloakCacheEvent(realm, getKeycloakRoles)
+		return roles, nil
+	})
+	roles, _ := result.(*userdata.EffectiveRoles)
+	return copyEffectiveRoles(roles), err
+}
+
+// membershipChanged - Сбрасываем роли user'а после изменения его групп или ролей
+func (c *cacheDecorator) membershipChanged(ctx context.Context, realm, userID string) {
+	c.roles.DeleteUser(realm, userID)
+	c.publish(ctx, invalidation.Event{Realm: realm, UserID: userID})
+}
+
+func (c *cacheDecorator) GetUserGroups(ctx context.Context, token, realm, userID string) ([]*userdata.Group, error) {
+	return c.userAdapter.GetUserGroups(ctx, token, realm, userID)
+}
+
+// AddUserToGroup - Добавляем user'а в группу и сбрасываем его роли
+func (c *cacheDecorator) AddUserToGroup(ctx context.Context, token, realm, userID, groupID string) error {
+	if err := c.userAdapter.AddUserToGroup(ctx, token, realm, userID, groupID); err != nil {
+		return err
+	}
+	c.membershipChanged(ctx, realm, userID)
+	return nil
+}
+
+// DeleteUserFromGroup - Удаляем user'а из группы и сбрасываем его роли
+func (c *cacheDecorator) DeleteUserFromGroup(ctx context.Context, token, realm, userID, groupID string) error {
+	if err := c.userAdapter.DeleteUserFromGroup(ctx, token, realm, userID, groupID); err != nil {
+		return err
+	}
+	c.membershipChanged(ctx, realm, userID)
+	return nil
+}
+
+func (c *cacheDecorator) GetRealmRolesByUserID(ctx context.Context, token, realm, userID string) ([]*userdata.Role, error) {
+	return c.userAdapter.GetRealmRolesByUserID(ctx, token, realm, userID)
+}
+
+func (c *cacheDecorator) GetCompositeRealmRolesByUserID(ctx context.Context, token, realm, userID string) ([]*userdata.Role, error) {
+	return c.userAdapter.GetCompositeRealmRolesByUserID(ctx, token, realm, userID)
+}
+
+// AddRealmRolesToUser - Назначаем роли realm'а и сбрасываем роли user'а
+func (c *cacheDecorator) AddRealmRolesToUser(ctx context.Context, token, realm, userID string, roles []userdata.Role) error {
+	if err := c.userAdapter.AddRealmRolesToUser(ctx, token, realm, userID, roles); err != nil {
+		return err
+	}
+	c.membershipChanged(ctx, realm, userID)
+	return nil
+}
+
+// DeleteRealmRolesFromUser - Снимаем роли realm'а и сбрасываем роли user'а
+func (c *cacheDecorator) DeleteRealmRolesFromUser(ctx context.Context, token, realm, userID string, roles []userdata.Role) error {
+	if err := c.userAdapter.DeleteRealmRolesFromUser(ctx, token, realm, userID, roles); err != nil {
+		return err
+	}
+	c.membershipChanged(ctx, realm, userID)
+	return nil
+}
+
+func (c *cacheDecorator) GetClientRolesByUserID(ctx context.Context, token, realm, idOfClient, userID string) ([]*userdata.Role, error) {
+	return c.userAdapter.GetClientRolesByUserID(ctx, token, realm, idOfClient, userID)
+}
+
+func (c *cacheDecorator) GetCompositeClientRolesByUserID(ctx context.Context, token, realm, idOfClient, userID string) ([]*userdata.Role, error) {
+	return c.userAdapter.GetCompositeClientRolesByUserID(ctx, token, realm, idOfClient, userID)
+}
+
+// AddClientRolesToUser - Назначаем роли client'а и сбрасываем роли user'а
+func (c *cacheDecorator) AddClientRolesToUser(ctx context.Context, token, realm, idOfClient, userID string, roles []userdata.Role) error {
+	if err := c.userAdapter.AddClientRolesToUser(ctx, token, realm, idOfClient, userID, roles); err != nil {
+		return err
+	}
+	c.membershipChanged(ctx, realm, userID)
+	return nil
+}
+
+// DeleteClientRolesFromUser - Снимаем роли client'а и сбрасываем роли user'а
+func (c *cacheDecorator) DeleteClientRolesFromUser(ctx context.Context, token, realm, idOfClient, userID string, roles []userdata.Role) error {
+	if err := c.userAdapter.DeleteClientRolesFromUser(ctx, token, realm, idOfClient, userID, roles); err != nil {
+		return err
+	}
+	c.membershipChanged(ctx, realm, userID)
+	return nil
+}
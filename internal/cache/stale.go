@@ -0,0 +1,31 @@
+package cache
+
+import (
+	"errors"
+)
+
+// ErrStaleUser - User отдан из cache после истечения его deadline
+var ErrStaleUser = errors.New("stale cached user")
+
+// StaleError - Сопровождает user'а, отданного из cache после истечения deadline.
+// errors.Is(err, ErrStaleUser) позволяет вызывающему решить, подходят ли ему такие данные
+type StaleError struct {
+	// Ошибка keycloak, из-за которой отдали просроченного user'а.
+	// nil, если user отдан в режиме stale-while-revalidate
+	Err error
+}
+
+func (e *StaleError) Error() string {
+	if e.Err == nil {
+		return ErrStaleUser.Error()
+	}
+	return ErrStaleUser.Error() + ": " + e.Err.Error()
+}
+
+func (e *StaleError) Is(target error) bool {
+	return target == ErrStaleUser
+}
+
+func (e *StaleError) Unwrap() error {
+	return e.Err
+}
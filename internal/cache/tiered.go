@@ -0,0 +1,136 @@
+package cache
+
+import (
+	"context"
+
+	"github.com/mtvy/cached_updater/internal/metrics"
+	"github.com/mtvy/cached_updater/internal/userdata"
+)
+
+const (
+	tierL1 = "l1"
+	tierL2 = "l2"
+
+	tierHit  = "hit"
+	tierMiss = "miss"
+)
+
+// tieredProvider - Двухуровневый cache: быстрый локальный L1 с коротким ttl
+// перед общим для всех реплик L2. Чтение идёт L1 -> L2, запись - в оба уровня
+type tieredProvider struct {
+	// Локальный cache реплики
+	l1 cachedUsersProvider
+	// Общий cache
+	l2 cachedUsersProvider
+}
+
+func NewTieredProvider(l1, l2 cachedUsersProvider) *tieredProvider {
+	return &tieredProvider{
+		l1: l1,
+		l2: l2,
+	}
+}
+
+// SetUser - Сеттим user'а в L2, затем в L1
+func (t *tieredProvider) SetUser(ctx context.Context, realm, userID, email string, newUser userdata.User) {
+	t.l2.SetUser(ctx, realm, userID, email, newUser)
+	t.l1.SetUser(ctx, realm, userID, email, newUser)
+}
+
+// promote - Сеттим найденного в L2 user'а в L1
+func (t *tieredProvider) promote(ctx context.Context, realm, userID string, user userdata.User) {
+	if user.ID != nil {
+		userID = *user.ID
+	}
+	if userID == "" {
+		return
+	}
+	email := ""
+	if user.Email != nil {
+		email = *user.Email
+	}
+	t.l1.SetUser(ctx, realm, userID, email, user)
+}
+
+// get - Ищем user'а в L1, затем в L2 с переносом найденного в L1
+func (t *tieredProvider) get(ctx context.Context, realm, userID string, getter func(p cachedUsersProvider) (userdata.User, error)) (userdata.User, error) {
+	if user, err := getter(t.l1); err == nil {
+		metrics.IncKeycloakCacheTierEvent(realm, tierL1, tierHit)
+		return user, nil
+	}
+	metrics.IncKeycloakCacheTierEvent(realm, tierL1, tierMiss)
+	user, err := getter(t.l2)
+	if err != nil {
+		metrics.IncKeycloakCacheTierEvent(realm, tierL2, tierMiss)
+		return userdata.User{}, err
+	}
+	metrics.IncKeycloakCacheTierEvent(realm, tierL2, tierHit)
+	t.promote(ctx, realm, userID, user)
+	return user, nil
+}
+
+// GetUserByUserID - Достаём User'а realm'а по userID из L1, затем из L2
+func (t *tieredProvider) GetUserByUserID(ctx context.Context, realm, userID string) (userdata.User, error) {
+	return t.get(ctx, realm, userID, func(p cachedUsersProvider) (userdata.User, error) {
+		return p.GetUserByUserID(ctx, realm, userID)
+	})
+}
+
+// GetUserByEmail - Достаём User'а realm'а по email из L1, затем из L2
+func (t *tieredProvider) GetUserByEmail(ctx context.Context, realm, email string) (userdata.User, error) {
+	return t.get(ctx, realm, "", func(p cachedUsersProvider) (userdata.User, error) {
+		return p.GetUserByEmail(ctx, realm, email)
+	})
+}
+
+// GetUserByIndex - Достаём User'а realm'а по значению индекса из L1, затем из L2
+func (t *tieredProvider) GetUserByIndex(ctx context.Context, realm, index, value string) (userdata.User, error) {
+	return t.get(ctx, realm, "", func(p cachedUsersProvider) (userdata.User, error) {
+		return p.GetUserByIndex(ctx, realm, index, value)
+	})
+}
+
+// GetStaleUserByUserID - Достаём просроченного User'а из L1, затем из L2.
+// В L1 не переносим, чтобы не продлевать жизнь просроченным данным
+func (t *tieredProvider) GetStaleUserByUserID(ctx context.Context, realm, userID string) (userdata.User, error) {
+	if user, err := t.l1.GetStaleUserByUserID(ctx, realm, userID); err == nil {
+		return user, nil
+	}
+	return t.l2.GetStaleUserByUserID(ctx, realm, userID)
+}
+
+// GetStaleUserByEmail - Достаём просроченного User'а из L1, затем из L2
+func (t *tieredProvider) GetStaleUserByEmail(ctx context.Context, realm, email string) (userdata.User, error) {
+	if user, err := t.l1.GetStaleUserByEmail(ctx, realm, email); err == nil {
+		return user, nil
+	}
+	return t.l2.GetStaleUserByEmail(ctx, realm, email)
+}
+
+// InvalidateUser - Удаляем user'а с обоих уровней
+func (t *tieredProvider) InvalidateUser(ctx context.Context, realm, userID string) {
+	t.l2.InvalidateUser(ctx, realm, userID)
+	t.l1.InvalidateUser(ctx, realm, userID)
+}
+
+// InvalidateRealm - Удаляем user'ов realm'а с обоих уровней
+func (t *tieredProvider) InvalidateRealm(ctx context.Context, realm string) {
+	t.l2.InvalidateRealm(ctx, realm)
+	t.l1.InvalidateRealm(ctx, realm)
+}
+
+// InvalidateLocalUser - Удаляем user'а только из L1: применяется для событий от других реплик
+func (t *tieredProvider) InvalidateLocalUser(ctx context.Context, realm, userID string) {
+	t.l1.InvalidateUser(ctx, realm, userID)
+}
+
+// InvalidateLocalRealm - Удаляем user'ов realm'а только из L1
+func (t *tieredProvider) InvalidateLocalRealm(ctx context.Context, realm string) {
+	t.l1.InvalidateRealm(ctx, realm)
+}
+
+// Purge - Очищаем оба уровня
+func (t *tieredProvider) Purge(ctx context.Context) {
+	t.l2.Purge(ctx)
+	t.l1.Purge(ctx)
+}
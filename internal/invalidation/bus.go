@@ -0,0 +1,25 @@
+package invalidation
+
+import "context"
+
+// Event - Сообщение о том, что user изменился и его нужно убрать из локальных cache
+type Event struct {
+	// Реплика, отправившая событие, чтобы не применять собственные события
+	Origin string `json:"origin"`
+	Realm  string `json:"realm"`
+	// Пустой UserID - инвалидируем весь realm
+	UserID string `json:"user_id,omitempty"`
+	Email  string `json:"email,omitempty"`
+}
+
+// Handler - Применяет событие к локальному cache
+type Handler func(ctx context.Context, event Event)
+
+// Bus - Шина инвалидаций между репликами сервиса
+type Bus interface {
+	// Publish - Рассылаем событие всем подписчикам
+	Publish(ctx context.Context, event Event) error
+	// Subscribe - Подписываемся на события. Возвращается после установки подписки,
+	// handler вызывается до отмены ctx
+	Subscribe(ctx context.Context, handler Handler) error
+}
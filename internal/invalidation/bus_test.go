@@ -0,0 +1,58 @@
+package invalidation
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBus(t *testing.T) {
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer client.Close()
+
+	testCases := []struct {
+		name string
+		bus  Bus
+	}{
+		{
+			name: "шина в памяти",
+			bus:  NewMemoryBus(),
+		},
+		{
+			name: "шина поверх redis pub/sub",
+			bus:  NewRedisBus(client, ""),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			received := make(chan Event, 2)
+			for i := 0; i < 2; i++ {
+				require.NoError(t, tc.bus.Subscribe(ctx, func(ctx context.Context, event Event) {
+					received <- event
+				}))
+			}
+
+			event := Event{Origin: "replica", Realm: "test", UserID: "1", Email: "1@test.test"}
+			require.NoError(t, tc.bus.Publish(ctx, event))
+
+			// Событие получает каждый подписчик
+			for i := 0; i < 2; i++ {
+				select {
+				case got := <-received:
+					require.Equal(t, event, got)
+				case <-time.After(time.Second):
+					t.Fatal("событие не доставлено")
+				}
+			}
+		})
+	}
+}
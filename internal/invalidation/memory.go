@@ -0,0 +1,52 @@
+package invalidation
+
+import (
+	"context"
+	"sync"
+)
+
+// memoryBus - Шина в памяти процесса: для тестов и запуска в одну реплику
+type memoryBus struct {
+	sync.RWMutex
+	// Ключ - номер подписки, значение - её handler
+	handlers map[int]Handler
+	nextID   int
+}
+
+func NewMemoryBus() *memoryBus {
+	return &memoryBus{
+		handlers: make(map[int]Handler),
+	}
+}
+
+// Publish - Синхронно вызываем handler'ы всех подписчиков
+func (b *memoryBus) Publish(ctx context.Context, event Event) error {
+	b.RLock()
+	handlers := make([]Handler, 0, len(b.handlers))
+	for _, handler := range b.handlers {
+		handlers = append(handlers, handler)
+	}
+	b.RUnlock()
+
+	for _, handler := range handlers {
+		handler(ctx, event)
+	}
+	return nil
+}
+
+// Subscribe - Регистрируем handler до отмены ctx
+func (b *memoryBus) Subscribe(ctx context.Context, handler Handler) error {
+	b.Lock()
+	id := b.nextID
+	b.nextID++
+	b.handlers[id] = handler
+	b.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		b.Lock()
+		delete(b.handlers, id)
+		b.Unlock()
+	}()
+	return nil
+}
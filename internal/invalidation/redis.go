@@ -0,0 +1,68 @@
+package invalidation
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// defaultChannel - Канал redis pub/sub, если он не задан
+const defaultChannel = "cached_updater:invalidation"
+
+// redisBus - Шина поверх redis pub/sub. Доставка не гарантирована:
+// реплика, не подписанная в момент публикации, событие не получит и дождётся ttl
+type redisBus struct {
+	client  redis.UniversalClient
+	channel string
+}
+
+func NewRedisBus(client redis.UniversalClient, channel string) *redisBus {
+	if channel == "" {
+		channel = defaultChannel
+	}
+	return &redisBus{
+		client:  client,
+		channel: channel,
+	}
+}
+
+// Publish - Публикуем событие в канал
+func (b *redisBus) Publish(ctx context.Context, event Event) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return b.client.Publish(ctx, b.channel, payload).Err()
+}
+
+// Subscribe - Подписываемся на канал и разбираем события в фоне до отмены ctx
+func (b *redisBus) Subscribe(ctx context.Context, handler Handler) error {
+	pubsub := b.client.Subscribe(ctx, b.channel)
+	// Дожидаемся подтверждения подписки, чтобы не потерять события, опубликованные сразу после
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		return err
+	}
+
+	go func() {
+		defer pubsub.Close()
+		messages := pubsub.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case message, ok := <-messages:
+				if !ok {
+					return
+				}
+				var event Event
+				if err := json.Unmarshal([]byte(message.Payload), &event); err != nil {
+					continue
+				}
+				handler(ctx, event)
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,36 @@
+package keycloak
+
+import (
+	"context"
+
+	"github.com/Nerzal/gocloak/v13"
+	"github.com/mtvy/cached_updater/internal/userdata"
+)
+
+// executeActionsEmailToKeyCloak - переводим параметры письма к gocloak.ExecuteActionsEmail
+func executeActionsEmailToKeyCloak(userID string, actions []userdata.RequiredAction, params userdata.ExecuteActionsEmailParams) gocloak.ExecuteActionsEmail {
+	keycloakActions := make([]string, 0, len(actions))
+	for _, action := range actions {
+		keycloakActions = append(keycloakActions, string(action))
+	}
+	return gocloak.ExecuteActionsEmail{
+		UserID:      &userID,
+		ClientID:    params.ClientID,
+		Lifespan:    params.Lifespan,
+		RedirectURI: params.RedirectURI,
+		Actions:     &keycloakActions,
+	}
+}
+
+// ExecuteActionsEmail - Отправляем письмо с required actions через keycloak
+func (a *adapter) ExecuteActionsEmail(ctx context.Context, token, realm, userID string, actions []userdata.RequiredAction, params userdata.ExecuteActionsEmailParams) error {
+	return wrapError(a.repo.ExecuteActionsEmail(ctx, token, realm, executeActionsEmailToKeyCloak(userID, actions, params)))
+}
+
+// SendVerifyEmail - Отправляем письмо с подтверждением email через keycloak
+func (a *adapter) SendVerifyEmail(ctx context.Context, token, realm, userID string, params userdata.SendVerifyEmailParams) error {
+	return wrapError(a.repo.SendVerifyEmail(ctx, token, userID, realm, gocloak.SendVerificationMailParams{
+		ClientID:    params.ClientID,
+		RedirectURI: params.RedirectURI,
+	}))
+}
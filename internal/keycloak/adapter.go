@@ -2,6 +2,7 @@ package keycloak
 
 import (
 	"context"
+	"errors"
 
 	"github.com/Nerzal/gocloak/v13"
 	"github.com/mtvy/cached_updater/internal/userdata"
@@ -243,49 +244,60 @@ func jwtToService(keycloakJWT *gocloak.JWT) *userdata.JWT {
 
 // CreateUser - Проставляем значение user'а делая запрос в keycloak
 func (a *adapter) CreateUser(ctx context.Context, token, realm string, user userdata.User) (string, error) {
-	return a.repo.CreateUser(ctx, token, realm, userToKeyCloak(user))
+	userID, err := a.repo.CreateUser(ctx, token, realm, userToKeyCloak(user))
+	return userID, wrapError(err)
 }
 
 // GetUsers - Получаем значение user'ов из keycloak
 func (a *adapter) GetUsers(ctx context.Context, token, realm string, params userdata.GetUsersParams) ([]*userdata.User, error) {
 	keycloakUser, err := a.repo.GetUsers(ctx, token, realm, getUsersParamsToKeyCloak(params))
-	return usersToService(keycloakUser), err
+	return usersToService(keycloakUser), wrapError(err)
 }
 
 // GetUserByID - Получаем значение user'а из keycloak по userID
 func (a *adapter) GetUserByID(ctx context.Context, accessToken, realm, userID string) (*userdata.User, error) {
 	keycloakUser, err := a.repo.GetUserByID(ctx, accessToken, realm, userID)
+	err = wrapError(err)
+	var keycloakErr *pkg.KeycloakError
+	if errors.As(err, &keycloakErr) && keycloakErr.Kind == pkg.ErrNotFound {
+		keycloakErr.Kind = pkg.ErrUserNotFound
+	}
 	return userToService(keycloakUser), err
 }
 
 func (a *adapter) LoginClient(ctx context.Context, clientID, clientSecret, realm string, scopes ...string) (*userdata.JWT, error) {
 	keycloakJWT, err := a.repo.LoginClient(ctx, clientID, clientSecret, realm, scopes...)
-	return jwtToService(keycloakJWT), err
+	return jwtToService(keycloakJWT), wrapError(err)
 }
 
 func (a *adapter) SetPassword(ctx context.Context, token, userID, realm, password string, temporary bool) error {
-	return a.repo.SetPassword(ctx, token, userID, realm, password, temporary)
+	return wrapError(a.repo.SetPassword(ctx, token, userID, realm, password, temporary))
 }
 
 func (a *adapter) GetCredentials(ctx context.Context, token, realm, userID string) ([]*userdata.CredentialRepresentation, error) {
 	keycloakCR, err := a.repo.GetCredentials(ctx, token, realm, userID)
-	return credentialRepresentationToService(keycloakCR), err
+	return credentialRepresentationToService(keycloakCR), wrapError(err)
 }
 
 func (a *adapter) DeleteCredentials(ctx context.Context, token, realm, userID, credentialID string) error {
-	return a.repo.DeleteCredentials(ctx, token, realm, userID, credentialID)
+	return wrapError(a.repo.DeleteCredentials(ctx, token, realm, userID, credentialID))
 }
 
 func (a *adapter) LogoutAllSessions(ctx context.Context, accessToken, realm, userID string) error {
-	return a.repo.LogoutAllSessions(ctx, accessToken, realm, userID)
+	return wrapError(a.repo.LogoutAllSessions(ctx, accessToken, realm, userID))
 }
 
 func (a *adapter) Login(ctx context.Context, clientID, clientSecret, realm, username, password string) (*userdata.JWT, error) {
 	keycloakJWT, err := a.repo.Login(ctx, clientID, clientSecret, realm, username, password)
-	return jwtToService(keycloakJWT), err
+	return jwtToService(keycloakJWT), wrapError(err)
 }
 
 func (a *adapter) UpdateUser(ctx context.Context, token, realm string, user userdata.User) error {
 	keycloakUser := userToKeyCloak(user)
-	return a.repo.UpdateUser(ctx, token, realm, keycloakUser)
+	return wrapError(a.repo.UpdateUser(ctx, token, realm, keycloakUser))
+}
+
+// DeleteUser - Удаляем user'а из keycloak по userID
+func (a *adapter) DeleteUser(ctx context.Context, token, realm, userID string) error {
+	return wrapError(a.repo.DeleteUser(ctx, token, realm, userID))
 }
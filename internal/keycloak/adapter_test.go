@@ -1,11 +1,17 @@
 package keycloak
 
 import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
 	"testing"
 
 	"github.com/Nerzal/gocloak/v13"
 	"github.com/mtvy/cached_updater/internal/userdata"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func GetPtr[T any](v T) *T {
@@ -132,3 +138,108 @@ func Test_userToService(t *testing.T) {
 		})
 	}
 }
+
+func Test_rolesToKeyCloak(t *testing.T) {
+	roles := []userdata.Role{
+		{ID: GetPtr("id"), Name: GetPtr("view-users"), ClientRole: GetPtr(true), ContainerID: GetPtr("client")},
+		{Name: GetPtr("admin")},
+	}
+
+	keycloakRoles := rolesToKeyCloak(roles)
+
+	assert.Equal(t, []gocloak.Role{
+		{ID: GetPtr("id"), Name: GetPtr("view-users"), ClientRole: GetPtr(true), ContainerID: GetPtr("client")},
+		{Name: GetPtr("admin")},
+	}, keycloakRoles)
+	for i := range keycloakRoles {
+		assert.Equal(t, &roles[i], roleToService(&keycloakRoles[i]))
+	}
+}
+
+func Test_userSessionsToService(t *testing.T) {
+	testCases := []struct {
+		name     string
+		sessions []*gocloak.UserSessionRepresentation
+		want     []*userdata.UserSession
+	}{
+		{
+			name: "валидный тест с конвертированием",
+			sessions: []*gocloak.UserSessionRepresentation{{
+				ID:         GetPtr("session"),
+				UserID:     GetPtr("id"),
+				Username:   GetPtr("user"),
+				IPAddress:  GetPtr("127.0.0.1"),
+				Start:      GetPtr(int64(1)),
+				LastAccess: GetPtr(int64(2)),
+				Clients:    GetPtr(map[string]string{"client-id": "client"}),
+			}},
+			want: []*userdata.UserSession{{
+				ID:         GetPtr("session"),
+				UserID:     GetPtr("id"),
+				Username:   GetPtr("user"),
+				IPAddress:  GetPtr("127.0.0.1"),
+				Start:      GetPtr(int64(1)),
+				LastAccess: GetPtr(int64(2)),
+				Clients:    GetPtr(map[string]string{"client-id": "client"}),
+			}},
+		},
+		{
+			name:     "валидный тест с nil",
+			sessions: nil,
+			want:     nil,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, userSessionsToService(tc.sessions))
+		})
+	}
+}
+
+func Test_executeActionsEmailToKeyCloak(t *testing.T) {
+	params := userdata.ExecuteActionsEmailParams{
+		ClientID:    GetPtr("client"),
+		RedirectURI: GetPtr("https://test.test"),
+		Lifespan:    GetPtr(3600),
+	}
+
+	got := executeActionsEmailToKeyCloak("id", []userdata.RequiredAction{
+		userdata.RequiredActionVerifyEmail,
+		userdata.RequiredActionUpdatePassword,
+	}, params)
+
+	assert.Equal(t, gocloak.ExecuteActionsEmail{
+		UserID:      GetPtr("id"),
+		ClientID:    GetPtr("client"),
+		Lifespan:    GetPtr(3600),
+		RedirectURI: GetPtr("https://test.test"),
+		Actions:     GetPtr([]string{"VERIFY_EMAIL", "UPDATE_PASSWORD"}),
+	}, got)
+}
+
+func Test_adapterGetUserGroups(t *testing.T) {
+	const total = 2*userGroupsPageSize + 5
+	requests := 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/realms/"+testRealm+"/users/1/groups", func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		first, _ := strconv.Atoi(r.URL.Query().Get("first"))
+		max, _ := strconv.Atoi(r.URL.Query().Get("max"))
+		page := []*gocloak.Group{}
+		for i := first; i < total && i < first+max; i++ {
+			page = append(page, &gocloak.Group{ID: GetPtr(strconv.Itoa(i))})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(page)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	adapter := NewAdapter(NewRepository(gocloak.NewClient(server.URL), server.URL))
+
+	groups, err := adapter.GetUserGroups(context.Background(), "token", testRealm, "1")
+	require.NoError(t, err)
+	require.Len(t, groups, total)
+	assert.Equal(t, strconv.Itoa(total-1), *groups[total-1].ID)
+	assert.Equal(t, 3, requests)
+}
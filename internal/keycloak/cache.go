@@ -3,17 +3,19 @@ package keycloak
 import (
 	"context"
 	"errors"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/mtvy/cached_updater/internal/metrics"
+	"github.com/mtvy/cached_updater/internal/token"
 	"github.com/mtvy/cached_updater/internal/userdata"
 	"github.com/mtvy/cached_updater/pkg"
 )
 
-var (
-	errNoCachedUser = errors.New("no cached user")
-)
+// defaultCleanupInterval - Период очистки cache, если он не задан в UserCacheConfig
+const defaultCleanupInterval = time.Minute
 
 const (
 	getCacheUserByEmail = "cache_get_user_by_email"
@@ -25,71 +27,786 @@ const (
 	getCacheUserByIDErr = "cache_error_get_user_by_id"
 	getUserByID         = "get_user_by_id"
 	getUserByIDErr      = "error_get_user_by_id"
+
+	cacheEvicted  = "cache_evicted"
+	cacheRejected = "cache_rejected"
+
+	cacheRefreshed  = "cache_refreshed"
+	cacheRefreshErr = "cache_error_refresh"
+
+	getCacheStaleUser    = "cache_get_stale_user"
+	getCacheStaleUserErr = "cache_error_get_stale_user"
+
+	cacheInvalidated = "cache_invalidated"
+
+	getCacheUserByIndex    = "cache_get_user_by_index"
+	getCacheUserByIndexErr = "cache_error_get_user_by_index"
+
+	cacheSnapshotSaved    = "cache_snapshot_saved"
+	cacheSnapshotRestored = "cache_snapshot_restored"
+	cacheSnapshotErr      = "cache_error_snapshot"
 )
 
 // cachedUser - Запись о пользователе с deadline
 type cachedUser struct {
 	user     *userdata.User
 	deadline time.Time
+	// Ключ записи в emailMap, чтобы удалять её вместе с userIDMap
+	email string
+	// Приблизительный размер записи в байтах, считается только при заданном MaxBytes
+	size int64
+	// Ключ - имя индекса, значение - ключи записи в нём
+	indexKeys map[string][]string
 }
 
-// userCache - Хранит данные пол user'ам
-// есть deadline у каждой записи user'а
-type userCache struct {
-	// Время жизни cachedUser
+// CacheStats - Статистика обращений к cache в рамках одного realm'а
+type CacheStats struct {
+	// Количество успешных чтений из cache
+	Hits int64
+	// Количество чтений, для которых не нашлось валидной записи
+	Misses int64
+	// Количество записей в cache
+	Sets int64
+	// Текущее количество user'ов в realm'е
+	Size int
+}
+
+// realmStats - Счётчики realm'а, меняются под RLock, поэтому atomic
+type realmStats struct {
+	hits   atomic.Int64
+	misses atomic.Int64
+	sets   atomic.Int64
+}
+
+// realmCache - Партиция cache с user'ами одного realm'а
+type realmCache struct {
+	// Время жизни cachedUser в этом realm'е
 	ttl time.Duration
-	// Чтобы при чтении не было проблем
-	sync.RWMutex
 	// Ключ - userID, значение - user с датой очистки.
 	// userIDMap имеет соответсвие с элементом emailMap
 	userIDMap map[string]*cachedUser
 	// Ключ - email, значение - user с датой очистки.
 	// emailMap имеет соответсвие с элементом userIDMap
 	emailMap map[string]*cachedUser
+	// Ключ - имя индекса, значение - маппа значение индекса -> user'ы с этим значением
+	indexMaps map[string]map[string]userSet
+	// Статистика обращений к realm'у
+	stats realmStats
 }
 
-func NewUserCache(ttl time.Duration, kcr pkg.UserAdapter) *userCache {
-	return &userCache{
+func newRealmCache(ttl time.Duration) *realmCache {
+	return &realmCache{
 		ttl:       ttl,
 		userIDMap: make(map[string]*cachedUser),
 		emailMap:  make(map[string]*cachedUser),
+		indexMaps: make(map[string]map[string]userSet),
+	}
+}
+
+// userSet - User'ы с одним значением индекса. Значения атрибутов могут повторяться у разных user'ов
+type userSet map[*cachedUser]struct{}
+
+// index - Сеттим user'а в индексы по его indexKeys
+func (rc *realmCache) index(cached *cachedUser) {
+	for name, keys := range cached.indexKeys {
+		indexMap, ok := rc.indexMaps[name]
+		if !ok {
+			indexMap = make(map[string]userSet)
+			rc.indexMaps[name] = indexMap
+		}
+		for _, key := range keys {
+			users, ok := indexMap[key]
+			if !ok {
+				users = make(userSet)
+				indexMap[key] = users
+			}
+			users[cached] = struct{}{}
+		}
+	}
+}
+
+// unindex - Удаляем user'а из индексов
+func (rc *realmCache) unindex(cached *cachedUser) {
+	for name, keys := range cached.indexKeys {
+		indexMap := rc.indexMaps[name]
+		for _, key := range keys {
+			delete(indexMap[key], cached)
+			if len(indexMap[key]) == 0 {
+				delete(indexMap, key)
+			}
+		}
+	}
+}
+
+// UserCacheConfig - Настройки userCache
+type UserCacheConfig struct {
+	// Время жизни cachedUser по умолчанию
+	TTL time.Duration
+	// Период запуска очистки просроченных записей.
+	// Если не задан - используем defaultCleanupInterval
+	CleanupInterval time.Duration
+	// Максимальное количество user'ов во всех realm'ах, 0 - без ограничения
+	MaxEntries int
+	// Приблизительный максимальный объём user'ов в байтах, 0 - без ограничения
+	MaxBytes int64
+	// Политика вытеснения при превышении MaxEntries или MaxBytes.
+	// Если не задана, а лимиты есть - используем LRU
+	Eviction EvictionPolicy
+
+	// Окно перед deadline, в которое чтение user'а запускает его фоновое обновление.
+	// 0 - refresh-ahead выключен
+	RefreshAhead time.Duration
+	// Таймаут фонового обновления одного user'а, 0 - без таймаута
+	RefreshTimeout time.Duration
+	// Источник token'ов service-account'а для обновления, например token.Manager.Source.
+	// nil - refresh-ahead выключен
+	Tokens token.Source
+
+	// Сколько хранить user'а после deadline, чтобы отдавать его через GetStale*.
+	// 0 - просроченные записи удаляются при первой очистке
+	StaleGrace time.Duration
+
+	// Дополнительные индексы для GetUserByIndex: pkg.IndexUsername или ключи атрибутов
+	// (inn, phone, site_client_id). Значение, которое есть у нескольких user'ов в cache,
+	// из индекса не отдаётся
+	Indexes []string
+
+	// Файл snapshot'а: читается в NewUserCache и пишется в Close. Пустой - без snapshot'ов
+	SnapshotPath string
+	// Период записи snapshot'а, 0 - только в Close
+	SnapshotInterval time.Duration
+}
+
+// userCache - Хранит данные пол user'ам, разбитые по realm'ам.
+// есть deadline у каждой записи user'а
+type userCache struct {
+	// Время жизни cachedUser по умолчанию
+	ttl time.Duration
+	// Чтобы при чтении не было проблем
+	sync.RWMutex
+	// Ключ - realm, значение - время жизни cachedUser в нём.
+	// Переопределяет ttl для отдельных realm'ов
+	realmTTL map[string]time.Duration
+	// Ключ - realm, значение - партиция с user'ами этого realm'а
+	realms map[string]*realmCache
+
+	// Лимиты cache, 0 - без ограничения
+	maxEntries int
+	maxBytes   int64
+	// Текущее количество user'ов и их объём во всех realm'ах
+	entries int
+	bytes   int64
+	// Политика вытеснения, nil если лимиты не заданы
+	policy EvictionPolicy
+	// Сколько хранить user'а после deadline
+	staleGrace time.Duration
+	// Имена дополнительных индексов
+	indexes []string
+	// Файл snapshot'а, пустой - без snapshot'ов
+	snapshotPath string
+
+	// Адаптер, через который обновляем user'ов перед истечением deadline
+	kcr            pkg.UserAdapter
+	refreshAhead   time.Duration
+	refreshTimeout time.Duration
+	tokens         token.Source
+	// Контекст фоновых обновлений, отменяется в Close
+	refreshCtx context.Context
+	refreshMu  sync.Mutex
+	// Обновляемые сейчас user'ы, чтобы не запускать повторное обновление
+	refreshing map[EntryKey]struct{}
+	// Ждём завершения фоновых обновлений в Close
+	refreshWG sync.WaitGroup
+
+	// Останавливает фоновую очистку
+	cancel context.CancelFunc
+	// Закрывается после остановки фоновой очистки
+	done chan struct{}
+}
+
+// NewUserCache - Заводим cache и запускаем фоновую очистку просроченных записей.
+// Очистка останавливается при отмене ctx или вызове Close
+func NewUserCache(ctx context.Context, cfg UserCacheConfig, kcr pkg.UserAdapter) *userCache {
+	interval := cfg.CleanupInterval
+	if interval <= 0 {
+		interval = defaultCleanupInterval
+	}
+	policy := cfg.Eviction
+	if policy == nil && (cfg.MaxEntries > 0 || cfg.MaxBytes > 0) {
+		policy = NewLRUPolicy()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	c := &userCache{
+		ttl:        cfg.TTL,
+		realmTTL:   make(map[string]time.Duration),
+		realms:     make(map[string]*realmCache),
+		maxEntries: cfg.MaxEntries,
+		maxBytes:   cfg.MaxBytes,
+		policy:     policy,
+		staleGrace: cfg.StaleGrace,
+		indexes:    cfg.Indexes,
+
+		snapshotPath: cfg.SnapshotPath,
+
+		kcr:            kcr,
+		refreshAhead:   cfg.RefreshAhead,
+		refreshTimeout: cfg.RefreshTimeout,
+		tokens:         cfg.Tokens,
+		refreshCtx:     ctx,
+		refreshing:     make(map[EntryKey]struct{}),
+
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	if c.snapshotPath != "" {
+		// Битый или несовместимый snapshot пропускаем и стартуем с пустым cache
+		if _, err := c.LoadSnapshot(c.snapshotPath); err != nil {
+			metrics.IncKeycloakCacheEvent("", cacheSnapshotErr)
+		}
+	}
+	snapshotInterval := cfg.SnapshotInterval
+	if c.snapshotPath == "" {
+		snapshotInterval = 0
+	}
+	go c.runJanitor(ctx, interval, snapshotInterval)
+	return c
+}
+
+// Close - Останавливаем фоновую очистку и обновления, дожидаемся их завершения
+// и пишем snapshot, если задан SnapshotPath
+func (c *userCache) Close() error {
+	c.cancel()
+	<-c.done
+	c.refreshWG.Wait()
+	if c.snapshotPath == "" {
+		return nil
+	}
+	return c.SaveSnapshot(c.snapshotPath)
+}
+
+// runJanitor - Периодически удаляем просроченные записи и пишем snapshot, пока не отменён ctx.
+// snapshotInterval 0 - snapshot периодически не пишется
+func (c *userCache) runJanitor(ctx context.Context, interval, snapshotInterval time.Duration) {
+	defer close(c.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var snapshots <-chan time.Time
+	if snapshotInterval > 0 {
+		snapshotTicker := time.NewTicker(snapshotInterval)
+		defer snapshotTicker.Stop()
+		snapshots = snapshotTicker.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.sweep()
+		case <-snapshots:
+			if err := c.SaveSnapshot(c.snapshotPath); err != nil {
+				metrics.IncKeycloakCacheEvent("", cacheSnapshotErr)
+			}
+		}
+	}
+}
+
+// sweep - Удаляем записи с истёкшими deadline и staleGrace из userIDMap и emailMap всех realm'ов
+func (c *userCache) sweep() {
+	c.Lock()
+	start := time.Now()
+	now := start.UTC().Add(-c.staleGrace)
+	swept := make(map[string]int, len(c.realms))
+	for realm, rc := range c.realms {
+		for userID, cached := range rc.userIDMap {
+			if !cached.deadline.After(now) {
+				c.removeLocked(EntryKey{Realm: realm, UserID: userID})
+				swept[realm]++
+			}
+		}
+		// Дочищаем записи emailMap и индексов, на которые уже не ссылается userIDMap
+		for email, cached := range rc.emailMap {
+			if !cached.deadline.After(now) {
+				delete(rc.emailMap, email)
+			}
+		}
+		for _, indexMap := range rc.indexMaps {
+			for key, users := range indexMap {
+				for cached := range users {
+					if !cached.deadline.After(now) {
+						delete(users, cached)
+					}
+				}
+				if len(users) == 0 {
+					delete(indexMap, key)
+				}
+			}
+		}
+	}
+	c.Unlock()
+	metrics.ObserveKeycloakCacheSweepDuration(time.Since(start))
+
+	for realm, count := range swept {
+		metrics.AddKeycloakCacheSwept(realm, count)
+	}
+}
+
+// SetRealmTTL - Задаём отдельное время жизни записей для realm'а
+func (c *userCache) SetRealmTTL(realm string, ttl time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.realmTTL[realm] = ttl
+	if rc, ok := c.realms[realm]; ok {
+		rc.ttl = ttl
+	}
+}
+
+// Stats - Статистика обращений к cache по realm'у
+func (c *userCache) Stats(realm string) CacheStats {
+	c.RLock()
+	defer c.RUnlock()
+	rc, ok := c.realms[realm]
+	if !ok {
+		return CacheStats{}
+	}
+	return CacheStats{
+		Hits:   rc.stats.hits.Load(),
+		Misses: rc.stats.misses.Load(),
+		Sets:   rc.stats.sets.Load(),
+		Size:   len(rc.userIDMap),
+	}
+}
+
+// realmLocked - Достаём партицию realm'а, при отсутствии заводим новую.
+// Вызывается под Lock
+func (c *userCache) realmLocked(realm string) *realmCache {
+	if rc, ok := c.realms[realm]; ok {
+		return rc
+	}
+	ttl, ok := c.realmTTL[realm]
+	if !ok {
+		ttl = c.ttl
+	}
+	rc := newRealmCache(ttl)
+	c.realms[realm] = rc
+	return rc
+}
+
+// removeLocked - Удаляем user'а из userIDMap и emailMap его realm'а.
+// Вызывается под Lock
+func (c *userCache) removeLocked(key EntryKey) {
+	rc, ok := c.realms[key.Realm]
+	if !ok {
+		return
+	}
+	cached, ok := rc.userIDMap[key.UserID]
+	if !ok {
+		return
+	}
+	delete(rc.userIDMap, key.UserID)
+	// emailMap мог уже указывать на другого user'а
+	if rc.emailMap[cached.email] == cached {
+		delete(rc.emailMap, cached.email)
+	}
+	rc.unindex(cached)
+	c.entries--
+	c.bytes -= cached.size
+	if c.policy != nil {
+		c.policy.Remove(key)
+	}
+}
+
+// overflowsLocked - Проверяем, выйдет ли cache за лимиты после записи размером size вместо replaced.
+// Вызывается под Lock
+func (c *userCache) overflowsLocked(size int64, replaced *cachedUser) bool {
+	entries, bytes := c.entries, c.bytes+size
+	if replaced != nil {
+		bytes -= replaced.size
+	} else {
+		entries++
+	}
+	return (c.maxEntries > 0 && entries > c.maxEntries) ||
+		(c.maxBytes > 0 && bytes > c.maxBytes)
+}
+
+// makeRoomLocked - Вытесняем записи, пока запись key размером size не влезет в лимиты.
+// Вернём false, если политика вытеснения не допустила новую запись. Вызывается под Lock
+func (c *userCache) makeRoomLocked(key EntryKey, size int64, replaced *cachedUser) bool {
+	if c.policy == nil {
+		return true
 	}
+	// Перезапись существующего user'а допускаем всегда
+	admitted := replaced != nil
+	for c.overflowsLocked(size, replaced) {
+		victim, ok := c.policy.Victim()
+		if !ok || victim == key {
+			break
+		}
+		if !admitted {
+			if !c.policy.Admit(key, victim) {
+				return false
+			}
+			admitted = true
+		}
+		c.removeLocked(victim)
+		metrics.IncKeycloakCacheEvent(victim.Realm, cacheEvicted)
+	}
+	return true
+}
+
+// SetUser - Сеттим новое значение в маппу realm'а с lock
+func (c *userCache) SetUser(ctx context.Context, realm, userID, email string, newUser userdata.User) {
+	c.Lock()
+	defer c.Unlock()
+	rc := c.realmLocked(realm)
+	c.setUserLocked(rc, realm, userID, email, newUser, time.Now().UTC().Add(rc.ttl))
 }
 
-// SetUser - Сеттим новое значение в маппу с lock
-func (c *userCache) SetUser(ctx context.Context, userID, email string, newUser userdata.User) {
+// setUserLocked - Сеттим user'а с заданным deadline в партицию realm'а.
+// Вызывается под Lock
+func (c *userCache) setUserLocked(rc *realmCache, realm, userID, email string, newUser userdata.User, deadline time.Time) {
+	// Keycloak хранит email в нижнем регистре и ищет по нему без учёта регистра
+	email = strings.ToLower(email)
+	key := EntryKey{Realm: realm, UserID: userID}
 	// Заводим кэшированного пользователя, который будет и в userIDMap и emailMap
-	cached := cachedUser{
-		user:     &newUser,
-		deadline: time.Now().UTC().Add(c.ttl),
+	cached := &cachedUser{
+		user:      &newUser,
+		deadline:  deadline,
+		email:     email,
+		indexKeys: c.indexKeys(newUser),
+	}
+	if c.maxBytes > 0 {
+		cached.size = estimateUserSize(newUser)
 	}
+	replaced := rc.userIDMap[userID]
+	if !c.makeRoomLocked(key, cached.size, replaced) {
+		metrics.IncKeycloakCacheEvent(realm, cacheRejected)
+		return
+	}
+	if replaced != nil {
+		c.bytes -= replaced.size
+		// У user'а сменился email - старый ключ больше не должен на него указывать
+		if replaced.email != email && rc.emailMap[replaced.email] == replaced {
+			delete(rc.emailMap, replaced.email)
+		}
+		rc.unindex(replaced)
+	} else {
+		c.entries++
+	}
+	c.bytes += cached.size
+	rc.userIDMap[userID] = cached
+	if email != "" {
+		rc.emailMap[email] = cached
+	}
+	rc.index(cached)
+	rc.stats.sets.Add(1)
+	if c.policy != nil {
+		if replaced != nil {
+			c.policy.Touch(key)
+		} else {
+			c.policy.Add(key)
+		}
+	}
+}
+
+// InvalidateUser - Удаляем user'а realm'а из userIDMap и emailMap
+func (c *userCache) InvalidateUser(ctx context.Context, realm, userID string) {
+	c.Lock()
+	defer c.Unlock()
+	c.removeLocked(EntryKey{Realm: realm, UserID: userID})
+	metrics.IncKeycloakCacheEvent(realm, cacheInvalidated)
+}
+
+// InvalidateRealm - Удаляем всех user'ов realm'а
+func (c *userCache) InvalidateRealm(ctx context.Context, realm string) {
+	c.Lock()
+	defer c.Unlock()
+	c.invalidateRealmLocked(realm)
+}
+
+// InvalidateLocalUser - Cache целиком в памяти реплики, поэтому событие другой реплики удаляет user'а как InvalidateUser
+func (c *userCache) InvalidateLocalUser(ctx context.Context, realm, userID string) {
+	c.InvalidateUser(ctx, realm, userID)
+}
+
+// InvalidateLocalRealm - Удаляем всех user'ов realm'а по событию другой реплики
+func (c *userCache) InvalidateLocalRealm(ctx context.Context, realm string) {
+	c.InvalidateRealm(ctx, realm)
+}
+
+// Purge - Удаляем user'ов всех realm'ов
+func (c *userCache) Purge(ctx context.Context) {
 	c.Lock()
 	defer c.Unlock()
-	c.userIDMap[userID] = &cached
-	c.emailMap[email] = &cached
+	for realm := range c.realms {
+		c.invalidateRealmLocked(realm)
+	}
 }
 
-// SetUGetUserByUserIDser - Безопасно достаём User'а по userID
-func (c *userCache) GetUserByUserID(ctx context.Context, userID string) (userdata.User, error) {
+// invalidateRealmLocked - Удаляем всех user'ов realm'а, статистику realm'а сохраняем.
+// Вызывается под Lock
+func (c *userCache) invalidateRealmLocked(realm string) {
+	rc, ok := c.realms[realm]
+	if !ok {
+		return
+	}
+	for userID := range rc.userIDMap {
+		c.removeLocked(EntryKey{Realm: realm, UserID: userID})
+	}
+	rc.emailMap = make(map[string]*cachedUser)
+	rc.indexMaps = make(map[string]map[string]userSet)
+	metrics.IncKeycloakCacheEvent(realm, cacheInvalidated)
+}
+
+// touch - Сообщаем политике вытеснения об обращении к user'у
+func (c *userCache) touch(realm, userID string) {
+	if c.policy != nil {
+		c.policy.Touch(EntryKey{Realm: realm, UserID: userID})
+	}
+}
+
+// GetUserByUserID - Безопасно достаём User'а realm'а по userID
+func (c *userCache) GetUserByUserID(ctx context.Context, realm, userID string) (userdata.User, error) {
 	c.RLock()
 	defer c.RUnlock()
+	rc, ok := c.realms[realm]
+	if !ok {
+		metrics.IncKeycloakCacheEvent(realm, getCacheUserByIDErr)
+		return userdata.User{}, pkg.ErrNoCachedUser
+	}
+	c.touch(realm, userID)
 	// Проверяем наличие валидной записи в userIDMap
-	if cached, ok := c.userIDMap[userID]; ok && cached.deadline.After(time.Now().UTC()) {
-		metrics.IncKeycloakCacheEvent(getCacheUserByID)
+	if cached, ok := rc.userIDMap[userID]; ok && cached.deadline.After(time.Now().UTC()) {
+		c.refreshIfExpiring(realm, userID, cached)
+		rc.stats.hits.Add(1)
+		metrics.IncKeycloakCacheEvent(realm, getCacheUserByID)
 		return *cached.user, nil
 	}
-	metrics.IncKeycloakCacheEvent(getCacheUserByEmail)
-	return userdata.User{}, errNoCachedUser
+	rc.stats.misses.Add(1)
+	metrics.IncKeycloakCacheEvent(realm, getCacheUserByIDErr)
+	return userdata.User{}, pkg.ErrNoCachedUser
 }
 
-// GetUserByEmail - Безопасно достаём User'а по email
-func (c *userCache) GetUserByEmail(ctx context.Context, email string) (userdata.User, error) {
+// GetUserByEmail - Безопасно достаём User'а realm'а по email
+func (c *userCache) GetUserByEmail(ctx context.Context, realm, email string) (userdata.User, error) {
 	c.RLock()
 	defer c.RUnlock()
-	if cached, ok := c.emailMap[email]; ok && cached.deadline.After(time.Now().UTC()) {
-		metrics.IncKeycloakCacheEvent(getCacheUserByEmail)
+	rc, ok := c.realms[realm]
+	if !ok {
+		metrics.IncKeycloakCacheEvent(realm, getCacheUsersErr)
+		return userdata.User{}, pkg.ErrNoCachedUser
+	}
+	if cached, ok := rc.emailMap[strings.ToLower(email)]; ok && cached.deadline.After(time.Now().UTC()) {
+		if cached.user.ID != nil {
+			c.touch(realm, *cached.user.ID)
+			c.refreshIfExpiring(realm, *cached.user.ID, cached)
+		}
+		rc.stats.hits.Add(1)
+		metrics.IncKeycloakCacheEvent(realm, getCacheUserByEmail)
 		return *cached.user, nil
 	}
-	metrics.IncKeycloakCacheEvent(getUserByIDErr)
-	return userdata.User{}, errNoCachedUser
+	rc.stats.misses.Add(1)
+	metrics.IncKeycloakCacheEvent(realm, getCacheUsersErr)
+	return userdata.User{}, pkg.ErrNoCachedUser
+}
+
+// GetUserByIndex - Безопасно достаём User'а realm'а по значению дополнительного индекса.
+// Если значение есть у нескольких user'ов, отдаём промах: одного из них вернуть нельзя
+func (c *userCache) GetUserByIndex(ctx context.Context, realm, index, value string) (userdata.User, error) {
+	c.RLock()
+	defer c.RUnlock()
+	rc, ok := c.realms[realm]
+	if !ok {
+		metrics.IncKeycloakCacheEvent(realm, getCacheUserByIndexErr)
+		return userdata.User{}, pkg.ErrNoCachedUser
+	}
+	if cached, ok := rc.indexMaps[index][pkg.IndexValue(index, value)].single(); ok && cached.deadline.After(time.Now().UTC()) {
+		if cached.user.ID != nil {
+			c.touch(realm, *cached.user.ID)
+			c.refreshIfExpiring(realm, *cached.user.ID, cached)
+		}
+		rc.stats.hits.Add(1)
+		metrics.IncKeycloakCacheEvent(realm, getCacheUserByIndex)
+		return *cached.user, nil
+	}
+	rc.stats.misses.Add(1)
+	metrics.IncKeycloakCacheEvent(realm, getCacheUserByIndexErr)
+	return userdata.User{}, pkg.ErrNoCachedUser
+}
+
+// single - Единственный user с этим значением индекса
+func (users userSet) single() (*cachedUser, bool) {
+	if len(users) != 1 {
+		return nil, false
+	}
+	for cached := range users {
+		return cached, true
+	}
+	return nil, false
+}
+
+// indexKeys - Достаём ключи user'а во всех настроенных индексах
+func (c *userCache) indexKeys(user userdata.User) map[string][]string {
+	if len(c.indexes) == 0 {
+		return nil
+	}
+	keys := make(map[string][]string, len(c.indexes))
+	for _, index := range c.indexes {
+		if values := pkg.IndexValues(user, index); len(values) > 0 {
+			keys[index] = values
+		}
+	}
+	return keys
+}
+
+// GetStaleUserByUserID - Достаём User'а realm'а по userID, в том числе с истёкшим deadline,
+// пока не прошёл staleGrace
+func (c *userCache) GetStaleUserByUserID(ctx context.Context, realm, userID string) (userdata.User, error) {
+	c.RLock()
+	defer c.RUnlock()
+	if rc, ok := c.realms[realm]; ok {
+		if cached, ok := rc.userIDMap[userID]; ok && c.withinGrace(cached) {
+			metrics.IncKeycloakCacheEvent(realm, getCacheStaleUser)
+			return *cached.user, nil
+		}
+	}
+	metrics.IncKeycloakCacheEvent(realm, getCacheStaleUserErr)
+	return userdata.User{}, pkg.ErrNoCachedUser
+}
+
+// GetStaleUserByEmail - Достаём User'а realm'а по email, в том числе с истёкшим deadline,
+// пока не прошёл staleGrace
+func (c *userCache) GetStaleUserByEmail(ctx context.Context, realm, email string) (userdata.User, error) {
+	c.RLock()
+	defer c.RUnlock()
+	if rc, ok := c.realms[realm]; ok {
+		if cached, ok := rc.emailMap[strings.ToLower(email)]; ok && c.withinGrace(cached) {
+			metrics.IncKeycloakCacheEvent(realm, getCacheStaleUser)
+			return *cached.user, nil
+		}
+	}
+	metrics.IncKeycloakCacheEvent(realm, getCacheStaleUserErr)
+	return userdata.User{}, pkg.ErrNoCachedUser
+}
+
+// withinGrace - Не прошёл ли staleGrace после deadline записи
+func (c *userCache) withinGrace(cached *cachedUser) bool {
+	return cached.deadline.Add(c.staleGrace).After(time.Now().UTC())
+}
+
+// refreshIfExpiring - Если до deadline user'а осталось меньше refreshAhead,
+// запускаем его фоновое обновление. Читатели до конца обновления получают старое значение
+func (c *userCache) refreshIfExpiring(realm, userID string, cached *cachedUser) {
+	if c.refreshAhead <= 0 || c.kcr == nil || c.tokens == nil {
+		return
+	}
+	if time.Until(cached.deadline) > c.refreshAhead {
+		return
+	}
+	key := EntryKey{Realm: realm, UserID: userID}
+	c.refreshMu.Lock()
+	defer c.refreshMu.Unlock()
+	if _, ok := c.refreshing[key]; ok || c.refreshCtx.Err() != nil {
+		return
+	}
+	c.refreshing[key] = struct{}{}
+	c.refreshWG.Add(1)
+	go c.refresh(key, cached)
+}
+
+// refresh - Получаем token service-account'а и заново достаём user'а из keycloak.
+// Запись cached служит версией: если за время запроса user'а перезаписали или удалили,
+// результат обновления устарел и в cache не попадает
+func (c *userCache) refresh(key EntryKey, cached *cachedUser) {
+	defer c.refreshWG.Done()
+	defer func() {
+		c.refreshMu.Lock()
+		delete(c.refreshing, key)
+		c.refreshMu.Unlock()
+	}()
+
+	ctx := c.refreshCtx
+	if c.refreshTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.refreshTimeout)
+		defer cancel()
+	}
+	accessToken, err := c.tokens.Token(ctx, key.Realm)
+	if err != nil {
+		metrics.IncKeycloakCacheEvent(key.Realm, cacheRefreshErr)
+		return
+	}
+	user, err := c.kcr.GetUserByID(ctx, accessToken, key.Realm, key.UserID)
+	if errors.Is(err, pkg.ErrUserNotFound) {
+		// User удалён в keycloak, оставлять его до deadline незачем
+		c.replaceIfUnchanged(key, cached, nil)
+		metrics.IncKeycloakCacheEvent(key.Realm, cacheInvalidated)
+		return
+	}
+	if err != nil || user == nil {
+		metrics.IncKeycloakCacheEvent(key.Realm, cacheRefreshErr)
+		return
+	}
+	if c.replaceIfUnchanged(key, cached, user) {
+		metrics.IncKeycloakCacheEvent(key.Realm, cacheRefreshed)
+	}
+}
+
+// replaceIfUnchanged - Заменяем запись cached на user'а или удаляем её, если user nil.
+// Ничего не делаем и возвращаем false, если запись key уже не cached
+func (c *userCache) replaceIfUnchanged(key EntryKey, cached *cachedUser, user *userdata.User) bool {
+	c.Lock()
+	defer c.Unlock()
+	rc, ok := c.realms[key.Realm]
+	if !ok || rc.userIDMap[key.UserID] != cached {
+		return false
+	}
+	if user == nil {
+		c.removeLocked(key)
+		return true
+	}
+	email := ""
+	if user.Email != nil {
+		email = *user.Email
+	}
+	c.setUserLocked(rc, key.Realm, key.UserID, email, *user, time.Now().UTC().Add(rc.ttl))
+	return true
+}
+
+// userBaseSize - Приблизительный размер userdata.User и cachedUser без содержимого полей
+const userBaseSize = 256
+
+// estimateUserSize - Приблизительный размер user'а в памяти в байтах
+func estimateUserSize(user userdata.User) int64 {
+	size := int64(userBaseSize)
+	for _, field := range []*string{
+		user.ID, user.Username, user.FirstName, user.LastName,
+		user.Email, user.FederationLink, user.ServiceAccountClientID,
+	} {
+		if field != nil {
+			size += int64(len(*field))
+		}
+	}
+	for _, values := range []*map[string][]string{user.Attributes, user.ClientRoles} {
+		if values == nil {
+			continue
+		}
+		for key, vals := range *values {
+			size += int64(len(key))
+			for _, val := range vals {
+				size += int64(len(val))
+			}
+		}
+	}
+	for _, values := range []*[]string{user.RequiredActions, user.RealmRoles, user.Groups} {
+		if values == nil {
+			continue
+		}
+		for _, val := range *values {
+			size += int64(len(val))
+		}
+	}
+	if user.Credentials != nil {
+		size += int64(len(*user.Credentials)) * userBaseSize
+	}
+	return size
 }
@@ -4,13 +4,17 @@ import (
 	"context"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/mtvy/cached_updater/internal/userdata"
+	"github.com/mtvy/cached_updater/pkg"
 	"github.com/stretchr/testify/require"
 )
 
+const testRealm = "test"
+
 func testUserFactory(userID, email string) userdata.User {
 	return userdata.User{
 		ID:    GetPtr(userID),
@@ -43,13 +47,13 @@ func TestUserCache(t *testing.T) {
 			name:    "тест с ошибкой при просрочке user'а в cache",
 			user:    testUsersFactory(10000),
 			ttl:     -time.Minute,
-			wantErr: errNoCachedUser,
+			wantErr: pkg.ErrNoCachedUser,
 		},
 	}
 
 	for _, tc := range testCases {
 
-		cache := NewUserCache(tc.ttl, nil)
+		cache := NewUserCache(context.Background(), UserCacheConfig{TTL: tc.ttl}, nil)
 		var wg sync.WaitGroup
 
 		t.Run(tc.name+" проверяем setter user'ов в cache", func(t *testing.T) {
@@ -57,13 +61,13 @@ func TestUserCache(t *testing.T) {
 			for _, user := range tc.user {
 				go func(user userdata.User) {
 					defer wg.Done()
-					cache.SetUser(context.Background(), *user.ID, *user.Email, user)
+					cache.SetUser(context.Background(), testRealm, *user.ID, *user.Email, user)
 				}(user)
 			}
 			wg.Wait()
 
-			require.Equal(t, len(cache.userIDMap), len(tc.user))
-			require.Equal(t, len(cache.emailMap), len(tc.user))
+			require.Equal(t, len(cache.realms[testRealm].userIDMap), len(tc.user))
+			require.Equal(t, len(cache.realms[testRealm].emailMap), len(tc.user))
 		})
 
 		t.Run(tc.name+" проверяем GetUserByUserID и GetUserByEmail из cache", func(t *testing.T) {
@@ -71,7 +75,7 @@ func TestUserCache(t *testing.T) {
 			for _, user := range tc.user {
 				go func(user userdata.User) {
 					defer wg.Done()
-					cachedUser, err := cache.GetUserByUserID(context.Background(), *user.ID)
+					cachedUser, err := cache.GetUserByUserID(context.Background(), testRealm, *user.ID)
 					if tc.wantErr == nil {
 						require.NoError(t, err, "GetUserByUserID ошибка при получении user.ID: "+*user.ID)
 						require.Equal(t, user, cachedUser, "user != cachedUser user.ID: "+*user.ID)
@@ -81,7 +85,7 @@ func TestUserCache(t *testing.T) {
 				}(user)
 				go func(user userdata.User) {
 					defer wg.Done()
-					cachedUser, err := cache.GetUserByEmail(context.Background(), *user.Email)
+					cachedUser, err := cache.GetUserByEmail(context.Background(), testRealm, *user.Email)
 					if tc.wantErr == nil {
 						require.NoError(t, err, "GetUserByEmail ошибка при получении user.Email: "+*user.Email)
 						require.Equal(t, user, cachedUser, "user != cachedUser user.Email: "+*user.Email)
@@ -98,7 +102,7 @@ func TestUserCache(t *testing.T) {
 			for _, user := range tc.user {
 				go func(user userdata.User) {
 					defer wg.Done()
-					cachedUser, err := cache.GetUserByUserID(context.Background(), *user.ID)
+					cachedUser, err := cache.GetUserByUserID(context.Background(), testRealm, *user.ID)
 					if tc.wantErr == nil {
 						require.NoError(t, err, "GetUserByUserID ошибка при получении user.ID: "+*user.ID)
 						require.Equal(t, user, cachedUser, "user != cachedUser user.ID: "+*user.ID)
@@ -108,11 +112,11 @@ func TestUserCache(t *testing.T) {
 				}(user)
 				go func(user userdata.User) {
 					defer wg.Done()
-					cache.SetUser(context.Background(), *user.ID, *user.Email, user)
+					cache.SetUser(context.Background(), testRealm, *user.ID, *user.Email, user)
 				}(user)
 				go func(user userdata.User) {
 					defer wg.Done()
-					cachedUser, err := cache.GetUserByEmail(context.Background(), *user.Email)
+					cachedUser, err := cache.GetUserByEmail(context.Background(), testRealm, *user.Email)
 					if tc.wantErr == nil {
 						require.NoError(t, err, "GetUserByEmail ошибка при получении user.Email: "+*user.Email)
 						require.Equal(t, user, cachedUser, "user != cachedUser user.Email: "+*user.Email)
@@ -123,5 +127,314 @@ func TestUserCache(t *testing.T) {
 			}
 			wg.Wait()
 		})
+
+		require.NoError(t, cache.Close())
+	}
+}
+
+func TestUserCacheRealms(t *testing.T) {
+	ctx := context.Background()
+	cache := NewUserCache(ctx, UserCacheConfig{TTL: time.Minute}, nil)
+	defer cache.Close()
+	cache.SetRealmTTL("expired", -time.Minute)
+
+	first := testUserFactory("1", "same@test.test")
+	first.FirstName = GetPtr("first")
+	second := testUserFactory("1", "same@test.test")
+	second.FirstName = GetPtr("second")
+
+	cache.SetUser(ctx, "first", *first.ID, *first.Email, first)
+	cache.SetUser(ctx, "second", *second.ID, *second.Email, second)
+	cache.SetUser(ctx, "expired", *first.ID, *first.Email, first)
+
+	t.Run("user'ы с одинаковыми ключами не пересекаются между realm'ами", func(t *testing.T) {
+		cachedUser, err := cache.GetUserByEmail(ctx, "first", "same@test.test")
+		require.NoError(t, err)
+		require.Equal(t, first, cachedUser)
+
+		cachedUser, err = cache.GetUserByUserID(ctx, "second", "1")
+		require.NoError(t, err)
+		require.Equal(t, second, cachedUser)
+
+		_, err = cache.GetUserByUserID(ctx, "unknown", "1")
+		require.ErrorIs(t, err, pkg.ErrNoCachedUser)
+	})
+
+	t.Run("ttl realm'а переопределяет ttl по умолчанию", func(t *testing.T) {
+		_, err := cache.GetUserByUserID(ctx, "expired", "1")
+		require.ErrorIs(t, err, pkg.ErrNoCachedUser)
+	})
+
+	t.Run("статистика считается по realm'у", func(t *testing.T) {
+		require.Equal(t, CacheStats{Hits: 1, Sets: 1, Size: 1}, cache.Stats("first"))
+		require.Equal(t, CacheStats{Hits: 1, Sets: 1, Size: 1}, cache.Stats("second"))
+		require.Equal(t, CacheStats{Misses: 1, Sets: 1, Size: 1}, cache.Stats("expired"))
+		require.Equal(t, CacheStats{}, cache.Stats("unknown"))
+	})
+}
+
+func TestUserCacheSweep(t *testing.T) {
+	ctx := context.Background()
+	cache := NewUserCache(ctx, UserCacheConfig{TTL: time.Minute, CleanupInterval: time.Hour}, nil)
+	defer cache.Close()
+	cache.SetRealmTTL("expired", -time.Minute)
+
+	for _, user := range testUsersFactory(100) {
+		cache.SetUser(ctx, testRealm, *user.ID, *user.Email, user)
+		cache.SetUser(ctx, "expired", *user.ID, *user.Email, user)
 	}
+
+	cache.sweep()
+
+	require.Len(t, cache.realms[testRealm].userIDMap, 100)
+	require.Len(t, cache.realms[testRealm].emailMap, 100)
+	require.Empty(t, cache.realms["expired"].userIDMap)
+	require.Empty(t, cache.realms["expired"].emailMap)
+}
+
+func TestUserCacheJanitor(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cache := NewUserCache(ctx, UserCacheConfig{TTL: -time.Minute, CleanupInterval: time.Millisecond}, nil)
+
+	user := testUserFactory("1", "1@test.test")
+	cache.SetUser(ctx, testRealm, *user.ID, *user.Email, user)
+
+	require.Eventually(t, func() bool {
+		return cache.Stats(testRealm).Size == 0
+	}, time.Second, time.Millisecond)
+
+	// После отмены ctx janitor завершается, Close не должен зависнуть
+	cancel()
+	require.NoError(t, cache.Close())
+}
+
+// testRefreshAdapter - Отдаёт из GetUserByID user'а с FirstName, заданным в тесте
+type testRefreshAdapter struct {
+	pkg.UserAdapter
+	firstName string
+	// Разблокирует GetUserByID
+	release chan struct{}
+	calls   atomic.Int64
+	// Ошибка, которую вернёт GetUserByID
+	err error
+}
+
+// testTokenSource - Отдаёт один и тот же token и считает обращения
+type testTokenSource struct {
+	calls atomic.Int64
+}
+
+func (s *testTokenSource) Token(ctx context.Context, realm string) (string, error) {
+	s.calls.Add(1)
+	return "token", nil
+}
+
+func (a *testRefreshAdapter) GetUserByID(ctx context.Context, accessToken, realm, userID string) (*userdata.User, error) {
+	a.calls.Add(1)
+	<-a.release
+	if a.err != nil {
+		return nil, a.err
+	}
+	user := testUserFactory(userID, userID+"@test.test")
+	user.FirstName = GetPtr(a.firstName)
+	return &user, nil
+}
+
+func TestUserCacheRefreshAhead(t *testing.T) {
+	ctx := context.Background()
+	adapter := &testRefreshAdapter{firstName: "refreshed", release: make(chan struct{})}
+	tokens := &testTokenSource{}
+	cache := NewUserCache(ctx, UserCacheConfig{
+		TTL:          time.Minute,
+		RefreshAhead: 2 * time.Minute,
+		Tokens:       tokens,
+	}, adapter)
+	defer cache.Close()
+
+	user := testUserFactory("1", "1@test.test")
+	user.FirstName = GetPtr("old")
+	cache.SetUser(ctx, testRealm, *user.ID, *user.Email, user)
+
+	// Пока обновление не завершилось, читатели получают старое значение,
+	// а повторные чтения не запускают новых обновлений
+	for i := 0; i < 10; i++ {
+		cachedUser, err := cache.GetUserByUserID(ctx, testRealm, "1")
+		require.NoError(t, err)
+		require.Equal(t, "old", *cachedUser.FirstName)
+	}
+	require.Eventually(t, func() bool { return adapter.calls.Load() == 1 }, time.Second, time.Millisecond)
+	close(adapter.release)
+
+	require.Eventually(t, func() bool {
+		cachedUser, err := cache.GetUserByEmail(ctx, testRealm, "1@test.test")
+		return err == nil && *cachedUser.FirstName == "refreshed"
+	}, time.Second, time.Millisecond)
+	require.NotZero(t, tokens.calls.Load())
+}
+
+func TestUserCacheRefreshAheadRace(t *testing.T) {
+	ctx := context.Background()
+	newCache := func(adapter *testRefreshAdapter) *userCache {
+		cache := NewUserCache(ctx, UserCacheConfig{
+			TTL:          time.Minute,
+			RefreshAhead: 2 * time.Minute,
+			Tokens:       &testTokenSource{},
+		}, adapter)
+		t.Cleanup(func() { cache.Close() })
+		user := testUserFactory("1", "1@test.test")
+		user.FirstName = GetPtr("old")
+		cache.SetUser(ctx, testRealm, *user.ID, *user.Email, user)
+		_, err := cache.GetUserByUserID(ctx, testRealm, "1")
+		require.NoError(t, err)
+		require.Eventually(t, func() bool { return adapter.calls.Load() == 1 }, time.Second, time.Millisecond)
+		return cache
+	}
+
+	t.Run("запись во время обновления не перетирается", func(t *testing.T) {
+		adapter := &testRefreshAdapter{firstName: "refreshed", release: make(chan struct{})}
+		cache := newCache(adapter)
+		user := testUserFactory("1", "1@test.test")
+		user.FirstName = GetPtr("written")
+		cache.SetUser(ctx, testRealm, *user.ID, *user.Email, user)
+		close(adapter.release)
+		cache.refreshWG.Wait()
+
+		cachedUser, err := cache.GetUserByUserID(ctx, testRealm, "1")
+		require.NoError(t, err)
+		require.Equal(t, "written", *cachedUser.FirstName)
+	})
+
+	t.Run("сброс во время обновления не откатывается", func(t *testing.T) {
+		adapter := &testRefreshAdapter{firstName: "refreshed", release: make(chan struct{})}
+		cache := newCache(adapter)
+		cache.InvalidateUser(ctx, testRealm, "1")
+		close(adapter.release)
+		cache.refreshWG.Wait()
+
+		_, err := cache.GetUserByUserID(ctx, testRealm, "1")
+		require.Error(t, err)
+	})
+
+	t.Run("удалённый в keycloak user удаляется из cache", func(t *testing.T) {
+		adapter := &testRefreshAdapter{release: make(chan struct{}), err: pkg.ErrUserNotFound}
+		cache := newCache(adapter)
+		close(adapter.release)
+		cache.refreshWG.Wait()
+
+		_, err := cache.GetUserByUserID(ctx, testRealm, "1")
+		require.Error(t, err)
+		_, err = cache.GetUserByEmail(ctx, testRealm, "1@test.test")
+		require.Error(t, err)
+	})
+}
+
+func TestUserCacheInvalidation(t *testing.T) {
+	ctx := context.Background()
+	cache := NewUserCache(ctx, UserCacheConfig{TTL: time.Minute}, nil)
+	defer cache.Close()
+	for _, realm := range []string{testRealm, "other"} {
+		for _, user := range testUsersFactory(3) {
+			cache.SetUser(ctx, realm, *user.ID, *user.Email, user)
+		}
+	}
+
+	t.Run("смена email удаляет старый ключ", func(t *testing.T) {
+		user := testUserFactory("0", "new@test.test")
+		cache.SetUser(ctx, testRealm, *user.ID, *user.Email, user)
+
+		_, err := cache.GetUserByEmail(ctx, testRealm, "0@test.test")
+		require.ErrorIs(t, err, pkg.ErrNoCachedUser)
+		cachedUser, err := cache.GetUserByEmail(ctx, testRealm, "new@test.test")
+		require.NoError(t, err)
+		require.Equal(t, user, cachedUser)
+	})
+
+	t.Run("InvalidateUser удаляет user'а по userID и email", func(t *testing.T) {
+		cache.InvalidateUser(ctx, testRealm, "1")
+
+		_, err := cache.GetUserByUserID(ctx, testRealm, "1")
+		require.ErrorIs(t, err, pkg.ErrNoCachedUser)
+		_, err = cache.GetUserByEmail(ctx, testRealm, "1@test.test")
+		require.ErrorIs(t, err, pkg.ErrNoCachedUser)
+		_, err = cache.GetUserByUserID(ctx, "other", "1")
+		require.NoError(t, err)
+	})
+
+	t.Run("InvalidateRealm не трогает другие realm'ы", func(t *testing.T) {
+		cache.InvalidateRealm(ctx, testRealm)
+
+		require.Empty(t, cache.realms[testRealm].userIDMap)
+		require.Empty(t, cache.realms[testRealm].emailMap)
+		require.Len(t, cache.realms["other"].userIDMap, 3)
+	})
+
+	t.Run("Purge очищает все realm'ы", func(t *testing.T) {
+		cache.Purge(ctx)
+
+		require.Empty(t, cache.realms["other"].userIDMap)
+		require.Empty(t, cache.realms["other"].emailMap)
+		require.Zero(t, cache.entries)
+	})
+}
+
+func TestUserCacheIndexes(t *testing.T) {
+	ctx := context.Background()
+	cache := NewUserCache(ctx, UserCacheConfig{TTL: time.Minute, Indexes: []string{pkg.IndexUsername, "inn"}}, nil)
+	defer cache.Close()
+
+	user := testUserFactory("1", "1@test.test")
+	user.Username = GetPtr("user")
+	user.SetINN("7700000000")
+	user.SetSiteClientID("site")
+	cache.SetUser(ctx, testRealm, *user.ID, *user.Email, user)
+
+	t.Run("user находится по username без учёта регистра и по атрибуту", func(t *testing.T) {
+		cachedUser, err := cache.GetUserByIndex(ctx, testRealm, pkg.IndexUsername, "USER")
+		require.NoError(t, err)
+		require.Equal(t, user, cachedUser)
+
+		cachedUser, err = cache.GetUserByIndex(ctx, testRealm, "inn", "7700000000")
+		require.NoError(t, err)
+		require.Equal(t, user, cachedUser)
+	})
+
+	t.Run("атрибуты без индекса не ищутся", func(t *testing.T) {
+		_, err := cache.GetUserByIndex(ctx, testRealm, "site_client_id", "site")
+		require.ErrorIs(t, err, pkg.ErrNoCachedUser)
+	})
+
+	t.Run("при смене значения старый ключ индекса удаляется", func(t *testing.T) {
+		updated := testUserFactory("1", "1@test.test")
+		updated.Username = GetPtr("renamed")
+		cache.SetUser(ctx, testRealm, *updated.ID, *updated.Email, updated)
+
+		_, err := cache.GetUserByIndex(ctx, testRealm, pkg.IndexUsername, "user")
+		require.ErrorIs(t, err, pkg.ErrNoCachedUser)
+		_, err = cache.GetUserByIndex(ctx, testRealm, "inn", "7700000000")
+		require.ErrorIs(t, err, pkg.ErrNoCachedUser)
+		_, err = cache.GetUserByIndex(ctx, testRealm, pkg.IndexUsername, "renamed")
+		require.NoError(t, err)
+	})
+
+	t.Run("InvalidateUser удаляет user'а из индексов", func(t *testing.T) {
+		cache.InvalidateUser(ctx, testRealm, "1")
+
+		_, err := cache.GetUserByIndex(ctx, testRealm, pkg.IndexUsername, "renamed")
+		require.ErrorIs(t, err, pkg.ErrNoCachedUser)
+	})
+
+	t.Run("значение нескольких user'ов не отдаётся из индекса", func(t *testing.T) {
+		for _, userID := range []string{"2", "3"} {
+			user := testUserFactory(userID, userID+"@test.test")
+			user.SetINN("7800000000")
+			cache.SetUser(ctx, testRealm, *user.ID, *user.Email, user)
+		}
+		_, err := cache.GetUserByIndex(ctx, testRealm, "inn", "7800000000")
+		require.ErrorIs(t, err, pkg.ErrNoCachedUser)
+
+		cache.InvalidateUser(ctx, testRealm, "2")
+		cachedUser, err := cache.GetUserByIndex(ctx, testRealm, "inn", "7800000000")
+		require.NoError(t, err)
+		require.Equal(t, GetPtr("3"), cachedUser.ID)
+	})
 }
@@ -0,0 +1,37 @@
+package keycloak
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/Nerzal/gocloak/v13"
+	"github.com/mtvy/cached_updater/pkg"
+)
+
+// errorKind - Категория ошибки по коду ответа keycloak, nil - код не попал ни в одну категорию
+func errorKind(code int) error {
+	switch code {
+	case 0:
+		return pkg.ErrTransport
+	case http.StatusUnauthorized:
+		return pkg.ErrUnauthorized
+	case http.StatusForbidden:
+		return pkg.ErrForbidden
+	case http.StatusNotFound:
+		return pkg.ErrNotFound
+	case http.StatusConflict:
+		return pkg.ErrConflict
+	case http.StatusTooManyRequests:
+		return pkg.ErrRateLimited
+	}
+	return nil
+}
+
+// wrapError - Оборачиваем *gocloak.APIError в *pkg.KeycloakError, остальные ошибки отдаём как есть
+func wrapError(err error) error {
+	var apiErr *gocloak.APIError
+	if !errors.As(err, &apiErr) {
+		return err
+	}
+	return &pkg.KeycloakError{Code: apiErr.Code, Kind: errorKind(apiErr.Code), Err: err}
+}
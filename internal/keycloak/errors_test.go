@@ -0,0 +1,61 @@
+package keycloak
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/Nerzal/gocloak/v13"
+	"github.com/mtvy/cached_updater/pkg"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_wrapError(t *testing.T) {
+	testCases := []struct {
+		name     string
+		code     int
+		wantKind error
+	}{
+		{name: "keycloak не ответил", code: 0, wantKind: pkg.ErrTransport},
+		{name: "401", code: http.StatusUnauthorized, wantKind: pkg.ErrUnauthorized},
+		{name: "403", code: http.StatusForbidden, wantKind: pkg.ErrForbidden},
+		{name: "404", code: http.StatusNotFound, wantKind: pkg.ErrNotFound},
+		{name: "409", code: http.StatusConflict, wantKind: pkg.ErrConflict},
+		{name: "429", code: http.StatusTooManyRequests, wantKind: pkg.ErrRateLimited},
+		{name: "500 без категории", code: http.StatusInternalServerError, wantKind: nil},
+	}
+
+	kinds := []error{pkg.ErrTransport, pkg.ErrUnauthorized, pkg.ErrForbidden, pkg.ErrNotFound, pkg.ErrConflict, pkg.ErrRateLimited}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			apiErr := &gocloak.APIError{Code: tc.code, Message: "message"}
+			err := wrapError(apiErr)
+
+			var keycloakErr *pkg.KeycloakError
+			require.ErrorAs(t, err, &keycloakErr)
+			assert.Equal(t, tc.code, keycloakErr.Code)
+			var gotAPIErr *gocloak.APIError
+			require.ErrorAs(t, err, &gotAPIErr)
+			assert.Same(t, apiErr, gotAPIErr)
+			for _, kind := range kinds {
+				assert.Equal(t, kind == tc.wantKind, errors.Is(err, kind), kind.Error())
+			}
+		})
+	}
+
+	t.Run("прочие ошибки отдаются как есть", func(t *testing.T) {
+		err := errors.New("decode failed")
+		assert.Same(t, err, wrapError(err))
+		assert.NoError(t, wrapError(nil))
+	})
+}
+
+func TestKeycloakErrorUserNotFound(t *testing.T) {
+	err := error(&pkg.KeycloakError{Code: http.StatusNotFound, Kind: pkg.ErrUserNotFound, Err: &gocloak.APIError{Code: http.StatusNotFound, Message: "404 Not Found"}})
+
+	assert.ErrorIs(t, err, pkg.ErrUserNotFound)
+	assert.ErrorIs(t, err, pkg.ErrNotFound)
+	assert.NotErrorIs(t, err, pkg.ErrConflict)
+	assert.Equal(t, "user not found: 404 Not Found", err.Error())
+}
@@ -0,0 +1,415 @@
+package keycloak
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mtvy/cached_updater/internal/metrics"
+	"github.com/mtvy/cached_updater/internal/token"
+)
+
+const (
+	// Применили admin event к cache
+	adminEventApplied = "admin_event_applied"
+	// Не удалось получить admin events из keycloak
+	adminEventsPollErr = "admin_events_poll_error"
+)
+
+const (
+	defaultAdminEventsPollInterval = 30 * time.Second
+	defaultAdminEventsPageSize     = 100
+	// Максимальный размер тела webhook'а
+	maxAdminEventsWebhookBody = 1 << 20
+)
+
+// UserInvalidator - Куда применяются события keycloak: userCache или декоратор cache
+type UserInvalidator interface {
+	InvalidateUser(ctx context.Context, realm, userID string)
+}
+
+// CreatedUserInvalidator - UserInvalidator, запоминающий промахи по userID и email.
+// После CREATE промахи нового user'а нужно сбросить. email пустой, если в событии нет representation
+type CreatedUserInvalidator interface {
+	InvalidateCreatedUser(ctx context.Context, realm, userID, email string)
+}
+
+// AdminEventsConfig - Настройки adminEventsConsumer
+type AdminEventsConfig struct {
+	// Realm'ы, admin events которых опрашиваем
+	Realms []string
+	// Период опроса, если не задан - используем defaultAdminEventsPollInterval
+	PollInterval time.Duration
+	// Размер страницы admin events, если не задан - используем defaultAdminEventsPageSize
+	PageSize int
+	// Service-account с ролью view-events, под которым через LoginClient получаем token
+	ClientID     string
+	ClientSecret string
+	// Источник token'ов service-account'а, например token.Manager.Source.
+	// Если не задан - создаём свой manager по ClientID/ClientSecret
+	Tokens token.Source
+	// Файл, в котором храним время последнего обработанного события по realm'ам.
+	// Пустой - после рестарта события читаются с момента запуска
+	CheckpointPath string
+
+	// Секрет, который webhook ожидает в заголовке Authorization: Bearer. Пустой - без проверки
+	WebhookSecret string
+	// Ключ - realmId из события webhook'а, значение - имя realm'а.
+	// Не заданные realmId считаются именами realm'ов
+	RealmIDs map[string]string
+}
+
+// adminEventsConsumer - Сбрасывает из cache user'ов, изменённых в обход сервиса,
+// например в консоли администратора keycloak. События получает опросом
+// admin events или через webhook
+type adminEventsConsumer struct {
+	repo        *repository
+	invalidator UserInvalidator
+	cfg         AdminEventsConfig
+	tokens      token.Source
+
+	mu sync.Mutex
+	// Ключ - realm, значение - последнее обработанное событие
+	checkpoints map[string]adminEventsCheckpoint
+}
+
+// adminEventsCheckpoint - Время последнего обработанного события и ключи событий с этим временем.
+// Keycloak хранит время с точностью до миллисекунды, и в ту же миллисекунду
+// после опроса может появиться ещё событие, поэтому такие события отличаем по ключам
+type adminEventsCheckpoint struct {
+	// Время события в миллисекундах
+	Time int64    `json:"time"`
+	Keys []string `json:"keys,omitempty"`
+}
+
+// has - Событие уже обработано
+func (c adminEventsCheckpoint) has(event *AdminEvent) bool {
+	if event.Time != c.Time {
+		return event.Time < c.Time
+	}
+	key := adminEventKey(event)
+	for _, seen := range c.Keys {
+		if seen == key {
+			return true
+		}
+	}
+	return false
+}
+
+// adminEventKey - Ключ события. Id в admin events есть не во всех версиях keycloak,
+// поэтому собираем ключ из полей события
+func adminEventKey(event *AdminEvent) string {
+	return event.OperationType + " " + event.ResourceType + " " + event.ResourcePath + " " + event.Representation
+}
+
+// NewAdminEventsConsumer - Заводим consumer и читаем сохранённые checkpoint'ы
+func NewAdminEventsConsumer(repo *repository, invalidator UserInvalidator, cfg AdminEventsConfig) (*adminEventsConsumer, error) {
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = defaultAdminEventsPollInterval
+	}
+	if cfg.PageSize <= 0 {
+		cfg.PageSize = defaultAdminEventsPageSize
+	}
+	tokens := cfg.Tokens
+	if tokens == nil {
+		tokens = token.NewManager(NewAdapter(repo), token.Config{}).Source(cfg.ClientID, cfg.ClientSecret)
+	}
+	c := &adminEventsConsumer{
+		repo:        repo,
+		invalidator: invalidator,
+		cfg:         cfg,
+		tokens:      tokens,
+		checkpoints: make(map[string]adminEventsCheckpoint),
+	}
+	if err := c.loadCheckpoints(); err != nil {
+		return nil, err
+	}
+	// Realm'ы без checkpoint'а читаем с момента запуска, а не всю историю
+	now := time.Now().UnixMilli()
+	for _, realm := range cfg.Realms {
+		if _, ok := c.checkpoints[realm]; !ok {
+			c.checkpoints[realm] = adminEventsCheckpoint{Time: now}
+		}
+	}
+	return c, nil
+}
+
+// Run - Опрашиваем admin events до отмены ctx
+func (c *adminEventsConsumer) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.cfg.PollInterval)
+	defer ticker.Stop()
+	for {
+		for _, realm := range c.cfg.Realms {
+			if err := c.Poll(ctx, realm); err != nil {
+				metrics.IncKeycloakCacheEvent(realm, adminEventsPollErr)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Poll - Читаем admin events realm'а после checkpoint'а, применяем их от старых к новым
+// и сохраняем время и ключи последних событий
+func (c *adminEventsConsumer) Poll(ctx context.Context, realm string) error {
+	accessToken, err := c.tokens.Token(ctx, realm)
+	if err != nil {
+		return err
+	}
+	since := c.checkpoint(realm)
+	events, err := c.fetch(ctx, accessToken, realm, since)
+	if err != nil {
+		return err
+	}
+	if len(events) == 0 {
+		return nil
+	}
+	for i := len(events) - 1; i >= 0; i-- {
+		c.apply(ctx, realm, events[i])
+	}
+	next := adminEventsCheckpoint{Time: events[0].Time}
+	if next.Time == since.Time {
+		next.Keys = append(next.Keys, since.Keys...)
+	}
+	for _, event := range events {
+		if event.Time == next.Time {
+			next.Keys = append(next.Keys, adminEventKey(event))
+		}
+	}
+	return c.saveCheckpoint(realm, next)
+}
+
+// fetch - Постранично читаем ещё не обработанные события. Keycloak отдаёт новые события первыми,
+// поэтому останавливаемся на первом событии старше since
+func (c *adminEventsConsumer) fetch(ctx context.Context, token, realm string, since adminEventsCheckpoint) ([]*AdminEvent, error) {
+	params := AdminEventsParams{
+		// dateFrom принимает только дату в часовом поясе keycloak, поэтому берём с запасом в сутки
+		DateFrom:      time.UnixMilli(since.Time).UTC().AddDate(0, 0, -1).Format("2006-01-02"),
+		ResourceTypes: userResourceTypes,
+		Max:           c.cfg.PageSize,
+	}
+	var result []*AdminEvent
+	for {
+		page, err := c.repo.GetAdminEvents(ctx, token, realm, params)
+		if err != nil {
+			return nil, err
+		}
+		for _, event := range page {
+			if event.Time < since.Time {
+				return result, nil
+			}
+			if !since.has(event) {
+				result = append(result, event)
+			}
+		}
+		if len(page) < params.Max {
+			return result, nil
+		}
+		params.First += params.Max
+	}
+}
+
+const (
+	resourceTypeUser = "USER"
+	// Включение user'а в группу или исключение из неё: users/{userID}/groups/{groupID}
+	resourceTypeGroupMembership = "GROUP_MEMBERSHIP"
+	// Роли realm'а user'а: users/{userID}/role-mappings/realm
+	resourceTypeRealmRoleMapping = "REALM_ROLE_MAPPING"
+	// Роли client'а user'а: users/{userID}/role-mappings/clients/{clientID}
+	resourceTypeClientRoleMapping = "CLIENT_ROLE_MAPPING"
+	// Префикс resourcePath события user'а
+	userResourcePrefix = "users/"
+)
+
+// userResourceTypes - Типы admin events, меняющие user'а, его группы или роли
+var userResourceTypes = []string{
+	resourceTypeUser,
+	resourceTypeGroupMembership,
+	resourceTypeRealmRoleMapping,
+	resourceTypeClientRoleMapping,
+}
+
+// apply - Сбрасываем user'а события из cache. Кроме CREATE, UPDATE и DELETE
+// учитываем ACTION: например сброс пароля по users/{userID}/reset-password.
+// После CREATE дополнительно сбрасываем промахи по userID и email нового user'а.
+// Изменения групп и ролей сбрасывают user'а из users/{userID}/...: вместе с ним сбрасываются и его роли.
+// Роли групп (groups/{groupID}/role-mappings) не учитываем, они дождутся ttl
+func (c *adminEventsConsumer) apply(ctx context.Context, realm string, event *AdminEvent) {
+	if event == nil {
+		return
+	}
+	userID := userIDFromResourcePath(event.ResourcePath)
+	if userID == "" {
+		return
+	}
+	switch event.ResourceType {
+	case resourceTypeUser:
+	case resourceTypeGroupMembership, resourceTypeRealmRoleMapping, resourceTypeClientRoleMapping:
+		c.invalidator.InvalidateUser(ctx, realm, userID)
+		metrics.IncKeycloakCacheEvent(realm, adminEventApplied)
+		return
+	default:
+		return
+	}
+	switch event.OperationType {
+	case "CREATE":
+		if created, ok := c.invalidator.(CreatedUserInvalidator); ok {
+			created.InvalidateCreatedUser(ctx, realm, userID, emailFromRepresentation(event.Representation))
+		} else {
+			c.invalidator.InvalidateUser(ctx, realm, userID)
+		}
+		metrics.IncKeycloakCacheEvent(realm, adminEventApplied)
+	case "UPDATE", "DELETE", "ACTION":
+		c.invalidator.InvalidateUser(ctx, realm, userID)
+		metrics.IncKeycloakCacheEvent(realm, adminEventApplied)
+	}
+}
+
+// userIDFromResourcePath - Достаём userID из users/{userID}[/...]
+func userIDFromResourcePath(resourcePath string) string {
+	if !strings.HasPrefix(resourcePath, userResourcePrefix) {
+		return ""
+	}
+	userID, _, _ := strings.Cut(strings.TrimPrefix(resourcePath, userResourcePrefix), "/")
+	return userID
+}
+
+// emailFromRepresentation - Достаём email из JSON user'а, пустой - representation нет или в нём нет email
+func emailFromRepresentation(representation string) string {
+	if representation == "" {
+		return ""
+	}
+	var user struct {
+		Email string `json:"email"`
+	}
+	if err := json.Unmarshal([]byte(representation), &user); err != nil {
+		return ""
+	}
+	return user.Email
+}
+
+// ServeHTTP - Webhook, принимающий admin event или массив admin events.
+// Checkpoint не двигает: события webhook'а могут приходить не по порядку
+func (c *adminEventsConsumer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if c.cfg.WebhookSecret != "" {
+		expected := "Bearer " + c.cfg.WebhookSecret
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(expected)) != 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxAdminEventsWebhookBody))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	events, err := decodeAdminEvents(body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	for _, event := range events {
+		if event == nil {
+			continue
+		}
+		realm := event.RealmID
+		if name, ok := c.cfg.RealmIDs[realm]; ok {
+			realm = name
+		}
+		c.apply(r.Context(), realm, event)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// decodeAdminEvents - Разбираем одно событие или массив событий
+func decodeAdminEvents(body []byte) ([]*AdminEvent, error) {
+	body = bytes.TrimSpace(body)
+	if bytes.HasPrefix(body, []byte("[")) {
+		var events []*AdminEvent
+		err := json.Unmarshal(body, &events)
+		return events, err
+	}
+	var event AdminEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		return nil, err
+	}
+	return []*AdminEvent{&event}, nil
+}
+
+func (c *adminEventsConsumer) checkpoint(realm string) adminEventsCheckpoint {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.checkpoints[realm]
+}
+
+// loadCheckpoints - Читаем checkpoint'ы из файла, отсутствующий файл - не ошибка
+func (c *adminEventsConsumer) loadCheckpoints() error {
+	if c.cfg.CheckpointPath == "" {
+		return nil
+	}
+	data, err := os.ReadFile(c.cfg.CheckpointPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &c.checkpoints)
+}
+
+// saveCheckpoint - Запоминаем последнее событие realm'а и атомарно перезаписываем файл
+func (c *adminEventsConsumer) saveCheckpoint(realm string, checkpoint adminEventsCheckpoint) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checkpoints[realm] = checkpoint
+	if c.cfg.CheckpointPath == "" {
+		return nil
+	}
+	data, err := json.Marshal(c.checkpoints)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(c.cfg.CheckpointPath, data, 0600)
+}
+
+// writeFileAtomic - Пишем во временный файл рядом с правами perm и переименовываем,
+// чтобы при падении не остался наполовину записанный файл
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
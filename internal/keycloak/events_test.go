@@ -0,0 +1,251 @@
+package keycloak
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Nerzal/gocloak/v13"
+	"github.com/stretchr/testify/require"
+)
+
+// testInvalidator - Запоминает сброшенных user'ов и email'ы созданных
+type testInvalidator struct {
+	sync.Mutex
+	invalidated   []string
+	createdEmails []string
+}
+
+func (i *testInvalidator) InvalidateUser(ctx context.Context, realm, userID string) {
+	i.Lock()
+	defer i.Unlock()
+	i.invalidated = append(i.invalidated, realm+"/"+userID)
+}
+
+func (i *testInvalidator) InvalidateCreatedUser(ctx context.Context, realm, userID, email string) {
+	i.Lock()
+	defer i.Unlock()
+	i.invalidated = append(i.invalidated, realm+"/"+userID)
+	i.createdEmails = append(i.createdEmails, email)
+}
+
+func (i *testInvalidator) take() []string {
+	i.Lock()
+	defer i.Unlock()
+	invalidated := i.invalidated
+	i.invalidated = nil
+	return invalidated
+}
+
+// newTestKeycloak - Keycloak, отдающий token и admin events из events (новые первыми)
+func newTestKeycloak(t *testing.T, events func() []*AdminEvent) *repository {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/realms/"+testRealm+"/protocol/openid-connect/token", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(gocloak.JWT{AccessToken: "token"})
+	})
+	mux.HandleFunc("/admin/realms/"+testRealm+"/admin-events", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		first, _ := strconv.Atoi(r.URL.Query().Get("first"))
+		max, _ := strconv.Atoi(r.URL.Query().Get("max"))
+		// Как keycloak, отдаём только события запрошенных типов
+		resourceTypes := map[string]bool{}
+		for _, resourceType := range r.URL.Query()["resourceTypes"] {
+			resourceTypes[resourceType] = true
+		}
+		all := []*AdminEvent{}
+		for _, event := range events() {
+			if len(resourceTypes) == 0 || resourceTypes[event.ResourceType] {
+				all = append(all, event)
+			}
+		}
+		page := []*AdminEvent{}
+		for i := first; i < len(all) && i < first+max; i++ {
+			page = append(page, all[i])
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(page)
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return NewRepository(gocloak.NewClient(server.URL), server.URL)
+}
+
+func userEvent(eventTime int64, operationType, resourcePath string) *AdminEvent {
+	return &AdminEvent{
+		Time:          eventTime,
+		RealmID:       testRealm,
+		OperationType: operationType,
+		ResourceType:  resourceTypeUser,
+		ResourcePath:  resourcePath,
+	}
+}
+
+func TestAdminEventsConsumerPoll(t *testing.T) {
+	ctx := context.Background()
+	// Checkpoint нового consumer'а - момент запуска, поэтому новые события сдвигаем в будущее
+	start := time.Now().Add(time.Minute).UnixMilli()
+	var (
+		mu     sync.Mutex
+		events []*AdminEvent
+	)
+	repo := newTestKeycloak(t, func() []*AdminEvent {
+		mu.Lock()
+		defer mu.Unlock()
+		return events
+	})
+	invalidator := &testInvalidator{}
+	cfg := AdminEventsConfig{
+		Realms:         []string{testRealm},
+		PageSize:       2,
+		CheckpointPath: filepath.Join(t.TempDir(), "checkpoint.json"),
+	}
+	consumer, err := NewAdminEventsConsumer(repo, invalidator, cfg)
+	require.NoError(t, err)
+
+	t.Run("события до запуска пропускаются, новые применяются от старых к новым", func(t *testing.T) {
+		mu.Lock()
+		events = []*AdminEvent{
+			userEvent(start+4, "DELETE", "users/3"),
+			{Time: start + 3, RealmID: testRealm, OperationType: "UPDATE", ResourceType: "GROUP", ResourcePath: "groups/1"},
+			userEvent(start+2, "ACTION", "users/2/reset-password"),
+			userEvent(start+1, "UPDATE", "users/1"),
+			userEvent(time.Now().Add(-time.Minute).UnixMilli(), "UPDATE", "users/0"),
+		}
+		mu.Unlock()
+
+		require.NoError(t, consumer.Poll(ctx, testRealm))
+		require.Equal(t, []string{testRealm + "/1", testRealm + "/2", testRealm + "/3"}, invalidator.take())
+	})
+
+	t.Run("после рестарта читаем события после сохранённого checkpoint'а", func(t *testing.T) {
+		mu.Lock()
+		events = append([]*AdminEvent{userEvent(start+5, "CREATE", "users/4")}, events...)
+		mu.Unlock()
+
+		restarted, err := NewAdminEventsConsumer(repo, invalidator, cfg)
+		require.NoError(t, err)
+		require.NoError(t, restarted.Poll(ctx, testRealm))
+		require.Equal(t, []string{testRealm + "/4"}, invalidator.take())
+	})
+
+	t.Run("событие в ту же миллисекунду, что и checkpoint, не теряется", func(t *testing.T) {
+		mu.Lock()
+		events = append([]*AdminEvent{userEvent(start+6, "UPDATE", "users/5")}, events...)
+		mu.Unlock()
+		require.NoError(t, consumer.Poll(ctx, testRealm))
+		require.Equal(t, []string{testRealm + "/4", testRealm + "/5"}, invalidator.take())
+
+		mu.Lock()
+		events = append([]*AdminEvent{userEvent(start+6, "DELETE", "users/6")}, events...)
+		mu.Unlock()
+		require.NoError(t, consumer.Poll(ctx, testRealm))
+		require.Equal(t, []string{testRealm + "/6"}, invalidator.take())
+
+		require.NoError(t, consumer.Poll(ctx, testRealm))
+		require.Empty(t, invalidator.take())
+	})
+
+	t.Run("CREATE передаёт email из representation", func(t *testing.T) {
+		created := userEvent(start+7, "CREATE", "users/7")
+		created.Representation = `{"username":"7","email":"7@test.test"}`
+		mu.Lock()
+		events = append([]*AdminEvent{created}, events...)
+		mu.Unlock()
+		require.NoError(t, consumer.Poll(ctx, testRealm))
+		require.Equal(t, []string{testRealm + "/7"}, invalidator.take())
+
+		invalidator.Lock()
+		defer invalidator.Unlock()
+		require.Equal(t, []string{"", "", "7@test.test"}, invalidator.createdEmails)
+	})
+
+	t.Run("изменения групп и ролей user'а сбрасывают его", func(t *testing.T) {
+		membership := userEvent(start+8, "CREATE", "users/8/groups/group")
+		membership.ResourceType = resourceTypeGroupMembership
+		realmRoles := userEvent(start+9, "DELETE", "users/9/role-mappings/realm")
+		realmRoles.ResourceType = resourceTypeRealmRoleMapping
+		clientRoles := userEvent(start+10, "CREATE", "users/10/role-mappings/clients/client")
+		clientRoles.ResourceType = resourceTypeClientRoleMapping
+		groupRoles := userEvent(start+11, "CREATE", "groups/group/role-mappings/realm")
+		groupRoles.ResourceType = resourceTypeRealmRoleMapping
+		mu.Lock()
+		events = append([]*AdminEvent{groupRoles, clientRoles, realmRoles, membership}, events...)
+		mu.Unlock()
+
+		require.NoError(t, consumer.Poll(ctx, testRealm))
+		require.Equal(t, []string{testRealm + "/8", testRealm + "/9", testRealm + "/10"}, invalidator.take())
+
+		// CREATE membership'а не считается созданием user'а
+		invalidator.Lock()
+		defer invalidator.Unlock()
+		require.Len(t, invalidator.createdEmails, 3)
+	})
+}
+
+func TestAdminEventsConsumerWebhook(t *testing.T) {
+	invalidator := &testInvalidator{}
+	consumer, err := NewAdminEventsConsumer(nil, invalidator, AdminEventsConfig{
+		WebhookSecret: "secret",
+		RealmIDs:      map[string]string{"realm-uuid": testRealm},
+	})
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name       string
+		auth       string
+		body       string
+		wantStatus int
+		want       []string
+	}{
+		{
+			name:       "одно событие",
+			auth:       "Bearer secret",
+			body:       `{"realmId":"test","operationType":"UPDATE","resourceType":"USER","resourcePath":"users/1"}`,
+			wantStatus: http.StatusNoContent,
+			want:       []string{testRealm + "/1"},
+		},
+		{
+			name:       "массив событий с realmId вместо имени realm'а",
+			auth:       "Bearer secret",
+			body:       `[{"realmId":"realm-uuid","operationType":"DELETE","resourceType":"USER","resourcePath":"users/2"},{"realmId":"realm-uuid","operationType":"CREATE","resourceType":"CLIENT","resourcePath":"clients/1"}]`,
+			wantStatus: http.StatusNoContent,
+			want:       []string{testRealm + "/2"},
+		},
+		{
+			name:       "неверный секрет",
+			auth:       "Bearer wrong",
+			body:       `{"realmId":"test","operationType":"UPDATE","resourceType":"USER","resourcePath":"users/1"}`,
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "невалидное тело",
+			auth:       "Bearer secret",
+			body:       `{`,
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/keycloak/events", strings.NewReader(tc.body))
+			req.Header.Set("Authorization", tc.auth)
+			rec := httptest.NewRecorder()
+
+			consumer.ServeHTTP(rec, req)
+
+			require.Equal(t, tc.wantStatus, rec.Code)
+			require.Equal(t, tc.want, invalidator.take())
+		})
+	}
+}
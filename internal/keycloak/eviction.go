@@ -0,0 +1,318 @@
+package keycloak
+
+import (
+	"container/heap"
+	"container/list"
+	"hash/fnv"
+	"sync"
+)
+
+// EntryKey - Ключ записи userCache: user в рамках realm'а
+type EntryKey struct {
+	Realm  string
+	UserID string
+}
+
+// EvictionPolicy - Политика вытеснения записей из userCache при превышении лимитов.
+// Add, Remove, Victim и Admit вызываются под Lock userCache,
+// Touch вызывается под RLock, поэтому реализации должны быть потокобезопасными
+type EvictionPolicy interface {
+	// Add - В cache появилась новая запись
+	Add(key EntryKey)
+	// Touch - Было обращение к записи
+	Touch(key EntryKey)
+	// Remove - Запись удалена из cache
+	Remove(key EntryKey)
+	// Victim - Достаём запись, которую следует вытеснить первой
+	Victim() (EntryKey, bool)
+	// Admit - Решаем, стоит ли вытеснять victim ради новой записи candidate
+	Admit(candidate, victim EntryKey) bool
+}
+
+// lruPolicy - Вытесняем запись, к которой дольше всего не обращались
+type lruPolicy struct {
+	sync.Mutex
+	// Начало списка - самые свежие записи, конец - кандидаты на вытеснение
+	order *list.List
+	// Ключ - запись cache, значение - её элемент в order
+	elements map[EntryKey]*list.Element
+}
+
+func NewLRUPolicy() *lruPolicy {
+	return &lruPolicy{
+		order:    list.New(),
+		elements: make(map[EntryKey]*list.Element),
+	}
+}
+
+func (p *lruPolicy) Add(key EntryKey) {
+	p.Lock()
+	defer p.Unlock()
+	if el, ok := p.elements[key]; ok {
+		p.order.MoveToFront(el)
+		return
+	}
+	p.elements[key] = p.order.PushFront(key)
+}
+
+func (p *lruPolicy) Touch(key EntryKey) {
+	p.Lock()
+	defer p.Unlock()
+	if el, ok := p.elements[key]; ok {
+		p.order.MoveToFront(el)
+	}
+}
+
+func (p *lruPolicy) Remove(key EntryKey) {
+	p.Lock()
+	defer p.Unlock()
+	if el, ok := p.elements[key]; ok {
+		p.order.Remove(el)
+		delete(p.elements, key)
+	}
+}
+
+func (p *lruPolicy) Victim() (EntryKey, bool) {
+	p.Lock()
+	defer p.Unlock()
+	el := p.order.Back()
+	if el == nil {
+		return EntryKey{}, false
+	}
+	return el.Value.(EntryKey), true
+}
+
+// Admit - LRU принимает любую новую запись
+func (p *lruPolicy) Admit(candidate, victim EntryKey) bool {
+	return true
+}
+
+// lfuEntry - Запись в куче lfuPolicy
+type lfuEntry struct {
+	key EntryKey
+	// Количество обращений к записи
+	freq uint64
+	// Порядковый номер последнего обращения, чтобы среди равных freq вытеснять более старую
+	seq uint64
+	// Позиция в куче
+	index int
+}
+
+// lfuHeap - Min-куча по freq, затем по seq
+type lfuHeap []*lfuEntry
+
+func (h lfuHeap) Len() int { return len(h) }
+
+func (h lfuHeap) Less(i, j int) bool {
+	if h[i].freq == h[j].freq {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].freq < h[j].freq
+}
+
+func (h lfuHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *lfuHeap) Push(x any) {
+	entry := x.(*lfuEntry)
+	entry.index = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *lfuHeap) Pop() any {
+	old := *h
+	n := len(old)
+	entry := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return entry
+}
+
+// lfuPolicy - Вытесняем запись с наименьшим количеством обращений
+type lfuPolicy struct {
+	sync.Mutex
+	entries lfuHeap
+	// Ключ - запись cache, значение - её элемент в куче
+	index map[EntryKey]*lfuEntry
+	// Счётчик обращений для упорядочивания записей с равной freq
+	seq uint64
+}
+
+func NewLFUPolicy() *lfuPolicy {
+	return &lfuPolicy{
+		index: make(map[EntryKey]*lfuEntry),
+	}
+}
+
+func (p *lfuPolicy) Add(key EntryKey) {
+	p.Lock()
+	defer p.Unlock()
+	p.touchLocked(key, true)
+}
+
+func (p *lfuPolicy) Touch(key EntryKey) {
+	p.Lock()
+	defer p.Unlock()
+	p.touchLocked(key, false)
+}
+
+// touchLocked - Увеличиваем freq записи, при create заводим отсутствующую запись
+func (p *lfuPolicy) touchLocked(key EntryKey, create bool) {
+	p.seq++
+	if entry, ok := p.index[key]; ok {
+		entry.freq++
+		entry.seq = p.seq
+		heap.Fix(&p.entries, entry.index)
+		return
+	}
+	if !create {
+		return
+	}
+	entry := &lfuEntry{key: key, freq: 1, seq: p.seq}
+	heap.Push(&p.entries, entry)
+	p.index[key] = entry
+}
+
+func (p *lfuPolicy) Remove(key EntryKey) {
+	p.Lock()
+	defer p.Unlock()
+	if entry, ok := p.index[key]; ok {
+		heap.Remove(&p.entries, entry.index)
+		delete(p.index, key)
+	}
+}
+
+func (p *lfuPolicy) Victim() (EntryKey, bool) {
+	p.Lock()
+	defer p.Unlock()
+	if len(p.entries) == 0 {
+		return EntryKey{}, false
+	}
+	return p.entries[0].key, true
+}
+
+// Admit - LFU принимает любую новую запись
+func (p *lfuPolicy) Admit(candidate, victim EntryKey) bool {
+	return true
+}
+
+const (
+	// Количество строк count-min sketch
+	sketchDepth = 4
+	// Максимальное значение счётчика sketch
+	sketchMaxCount = 15
+)
+
+// countMinSketch - Приблизительная частота обращений к ключам с периодическим старением
+type countMinSketch struct {
+	counters [sketchDepth][]uint8
+	mask     uint64
+	// Количество инкрементов с последнего старения
+	additions int
+	// После стольких инкрементов все счётчики делятся пополам
+	resetAt int
+}
+
+func newCountMinSketch(capacity int) *countMinSketch {
+	width := 1
+	for width < capacity {
+		width <<= 1
+	}
+	s := &countMinSketch{
+		mask:    uint64(width - 1),
+		resetAt: 10 * width,
+	}
+	for i := range s.counters {
+		s.counters[i] = make([]uint8, width)
+	}
+	return s
+}
+
+func hashEntryKey(key EntryKey) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key.Realm))
+	h.Write([]byte{0})
+	h.Write([]byte(key.UserID))
+	return h.Sum64()
+}
+
+// positions - Индексы счётчиков ключа по строкам (double hashing)
+func (s *countMinSketch) positions(key EntryKey) [sketchDepth]uint64 {
+	hash := hashEntryKey(key)
+	low, high := hash&0xffffffff, hash>>32
+	var positions [sketchDepth]uint64
+	for i := range positions {
+		positions[i] = (low + uint64(i)*high) & s.mask
+	}
+	return positions
+}
+
+func (s *countMinSketch) increment(key EntryKey) {
+	for i, pos := range s.positions(key) {
+		if s.counters[i][pos] < sketchMaxCount {
+			s.counters[i][pos]++
+		}
+	}
+	s.additions++
+	if s.additions >= s.resetAt {
+		s.age()
+	}
+}
+
+func (s *countMinSketch) estimate(key EntryKey) uint8 {
+	lowest := uint8(sketchMaxCount)
+	for i, pos := range s.positions(key) {
+		if s.counters[i][pos] < lowest {
+			lowest = s.counters[i][pos]
+		}
+	}
+	return lowest
+}
+
+// age - Делим все счётчики пополам, чтобы старая популярность не мешала новым записям
+func (s *countMinSketch) age() {
+	for i := range s.counters {
+		for j := range s.counters[i] {
+			s.counters[i][j] >>= 1
+		}
+	}
+	s.additions = 0
+}
+
+// tinyLFUPolicy - LRU порядок вытеснения с TinyLFU фильтром допуска:
+// новая запись вытесняет victim только если к ней обращались чаще
+type tinyLFUPolicy struct {
+	*lruPolicy
+	sketchMu sync.Mutex
+	sketch   *countMinSketch
+}
+
+// NewTinyLFUPolicy - capacity - ожидаемое количество записей в cache
+func NewTinyLFUPolicy(capacity int) *tinyLFUPolicy {
+	return &tinyLFUPolicy{
+		lruPolicy: NewLRUPolicy(),
+		sketch:    newCountMinSketch(capacity),
+	}
+}
+
+func (p *tinyLFUPolicy) record(key EntryKey) {
+	p.sketchMu.Lock()
+	defer p.sketchMu.Unlock()
+	p.sketch.increment(key)
+}
+
+func (p *tinyLFUPolicy) Touch(key EntryKey) {
+	p.record(key)
+	p.lruPolicy.Touch(key)
+}
+
+// Admit - Учитываем обращение к candidate и сравниваем его частоту с частотой victim
+func (p *tinyLFUPolicy) Admit(candidate, victim EntryKey) bool {
+	p.sketchMu.Lock()
+	defer p.sketchMu.Unlock()
+	p.sketch.increment(candidate)
+	return p.sketch.estimate(candidate) > p.sketch.estimate(victim)
+}
@@ -0,0 +1,113 @@
+package keycloak
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/mtvy/cached_updater/pkg"
+	"github.com/stretchr/testify/require"
+)
+
+func testEntryKey(userID string) EntryKey {
+	return EntryKey{Realm: testRealm, UserID: userID}
+}
+
+func TestEvictionPolicies(t *testing.T) {
+	testCases := []struct {
+		name   string
+		policy EvictionPolicy
+		touch  []string
+		want   EntryKey
+	}{
+		{
+			name:   "LRU вытесняет запись, к которой дольше не обращались",
+			policy: NewLRUPolicy(),
+			touch:  []string{"1", "1", "1", "3"},
+			want:   testEntryKey("2"),
+		},
+		{
+			name:   "LFU вытесняет запись с наименьшим числом обращений",
+			policy: NewLFUPolicy(),
+			touch:  []string{"1", "1", "1", "2", "2", "3"},
+			want:   testEntryKey("3"),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.policy.Add(testEntryKey("1"))
+			tc.policy.Add(testEntryKey("2"))
+			tc.policy.Add(testEntryKey("3"))
+			for _, userID := range tc.touch {
+				tc.policy.Touch(testEntryKey(userID))
+			}
+
+			victim, ok := tc.policy.Victim()
+			require.True(t, ok)
+			require.Equal(t, tc.want, victim)
+
+			tc.policy.Remove(victim)
+			next, ok := tc.policy.Victim()
+			require.True(t, ok)
+			require.NotEqual(t, victim, next)
+		})
+	}
+}
+
+func TestTinyLFUAdmission(t *testing.T) {
+	policy := NewTinyLFUPolicy(16)
+	hot, cold := testEntryKey("hot"), testEntryKey("cold")
+	policy.Add(hot)
+	for i := 0; i < 5; i++ {
+		policy.Touch(hot)
+	}
+
+	require.False(t, policy.Admit(cold, hot), "редкая запись не должна вытеснять популярную")
+	require.True(t, policy.Admit(hot, cold), "популярная запись должна вытеснять редкую")
+}
+
+func TestUserCacheMaxEntries(t *testing.T) {
+	ctx := context.Background()
+	cache := NewUserCache(ctx, UserCacheConfig{TTL: time.Minute, MaxEntries: 10}, nil)
+	defer cache.Close()
+
+	users := testUsersFactory(20)
+	for _, user := range users {
+		cache.SetUser(ctx, testRealm, *user.ID, *user.Email, user)
+		// Держим первого user'а горячим, чтобы LRU его не вытеснил
+		_, err := cache.GetUserByUserID(ctx, testRealm, "0")
+		require.NoError(t, err)
+	}
+
+	require.Len(t, cache.realms[testRealm].userIDMap, 10)
+	require.Len(t, cache.realms[testRealm].emailMap, 10)
+	for userID, cached := range cache.realms[testRealm].userIDMap {
+		require.Same(t, cached, cache.realms[testRealm].emailMap[cached.email], "userID: "+userID)
+	}
+
+	_, err := cache.GetUserByEmail(ctx, testRealm, "0@test.test")
+	require.NoError(t, err)
+	_, err = cache.GetUserByUserID(ctx, testRealm, "1")
+	require.ErrorIs(t, err, pkg.ErrNoCachedUser)
+	_, err = cache.GetUserByEmail(ctx, testRealm, "19@test.test")
+	require.NoError(t, err)
+}
+
+func TestUserCacheMaxBytes(t *testing.T) {
+	ctx := context.Background()
+	user := testUserFactory("0", "0@test.test")
+	maxBytes := estimateUserSize(user) * 5
+	cache := NewUserCache(ctx, UserCacheConfig{TTL: time.Minute, MaxBytes: maxBytes, Eviction: NewLFUPolicy()}, nil)
+	defer cache.Close()
+
+	for i := 0; i < 10; i++ {
+		user := testUserFactory(strconv.Itoa(i), strconv.Itoa(i)+"@test.test")
+		cache.SetUser(ctx, testRealm, *user.ID, *user.Email, user)
+	}
+
+	require.LessOrEqual(t, cache.bytes, maxBytes)
+	require.Equal(t, 5, cache.entries)
+	require.Len(t, cache.realms[testRealm].emailMap, 5)
+}
@@ -0,0 +1,142 @@
+package keycloak
+
+import (
+	"context"
+
+	"github.com/Nerzal/gocloak/v13"
+	"github.com/mtvy/cached_updater/internal/userdata"
+)
+
+// groupToService - переводим *gocloak.Group к *userdata.Group
+func groupToService(keycloakGroup *gocloak.Group) *userdata.Group {
+	if keycloakGroup == nil {
+		return nil
+	}
+	return &userdata.Group{
+		ID:          keycloakGroup.ID,
+		Name:        keycloakGroup.Name,
+		Path:        keycloakGroup.Path,
+		Attributes:  keycloakGroup.Attributes,
+		ClientRoles: keycloakGroup.ClientRoles,
+		RealmRoles:  keycloakGroup.RealmRoles,
+	}
+}
+
+func groupsToService(keycloakGroups []*gocloak.Group) []*userdata.Group {
+	if keycloakGroups == nil {
+		return nil
+	}
+	groups := make([]*userdata.Group, 0, len(keycloakGroups))
+	for _, keycloakGroup := range keycloakGroups {
+		groups = append(groups, groupToService(keycloakGroup))
+	}
+	return groups
+}
+
+// roleToService - переводим *gocloak.Role к *userdata.Role
+func roleToService(keycloakRole *gocloak.Role) *userdata.Role {
+	if keycloakRole == nil {
+		return nil
+	}
+	return &userdata.Role{
+		ID:          keycloakRole.ID,
+		Name:        keycloakRole.Name,
+		Description: keycloakRole.Description,
+		Composite:   keycloakRole.Composite,
+		ClientRole:  keycloakRole.ClientRole,
+		ContainerID: keycloakRole.ContainerID,
+	}
+}
+
+func rolesToService(keycloakRoles []*gocloak.Role) []*userdata.Role {
+	if keycloakRoles == nil {
+		return nil
+	}
+	roles := make([]*userdata.Role, 0, len(keycloakRoles))
+	for _, keycloakRole := range keycloakRoles {
+		roles = append(roles, roleToService(keycloakRole))
+	}
+	return roles
+}
+
+// rolesToKeyCloak - переводим []userdata.Role к []gocloak.Role.
+// Keycloak сопоставляет роли по id и name, поэтому их нужно заполнить
+func rolesToKeyCloak(roles []userdata.Role) []gocloak.Role {
+	keycloakRoles := make([]gocloak.Role, 0, len(roles))
+	for _, role := range roles {
+		keycloakRoles = append(keycloakRoles, gocloak.Role{
+			ID:          role.ID,
+			Name:        role.Name,
+			Description: role.Description,
+			Composite:   role.Composite,
+			ClientRole:  role.ClientRole,
+			ContainerID: role.ContainerID,
+		})
+	}
+	return keycloakRoles
+}
+
+// userGroupsPageSize - Размер страницы групп user'а. Без max keycloak отдаёт только первую страницу
+const userGroupsPageSize = 100
+
+// GetUserGroups - Постранично получаем все группы user'а из keycloak, пока страница не окажется неполной
+func (a *adapter) GetUserGroups(ctx context.Context, token, realm, userID string) ([]*userdata.Group, error) {
+	var groups []*userdata.Group
+	for first := 0; ; first += userGroupsPageSize {
+		keycloakGroups, err := a.repo.GetUserGroups(ctx, token, realm, userID, gocloak.GetGroupsParams{
+			First: gocloak.IntP(first),
+			Max:   gocloak.IntP(userGroupsPageSize),
+		})
+		if err != nil {
+			return nil, wrapError(err)
+		}
+		groups = append(groups, groupsToService(keycloakGroups)...)
+		if len(keycloakGroups) < userGroupsPageSize {
+			return groups, nil
+		}
+	}
+}
+
+func (a *adapter) AddUserToGroup(ctx context.Context, token, realm, userID, groupID string) error {
+	return wrapError(a.repo.AddUserToGroup(ctx, token, realm, userID, groupID))
+}
+
+func (a *adapter) DeleteUserFromGroup(ctx context.Context, token, realm, userID, groupID string) error {
+	return wrapError(a.repo.DeleteUserFromGroup(ctx, token, realm, userID, groupID))
+}
+
+func (a *adapter) GetRealmRolesByUserID(ctx context.Context, token, realm, userID string) ([]*userdata.Role, error) {
+	keycloakRoles, err := a.repo.GetRealmRolesByUserID(ctx, token, realm, userID)
+	return rolesToService(keycloakRoles), wrapError(err)
+}
+
+func (a *adapter) GetCompositeRealmRolesByUserID(ctx context.Context, token, realm, userID string) ([]*userdata.Role, error) {
+	keycloakRoles, err := a.repo.GetCompositeRealmRolesByUserID(ctx, token, realm, userID)
+	return rolesToService(keycloakRoles), wrapError(err)
+}
+
+func (a *adapter) AddRealmRolesToUser(ctx context.Context, token, realm, userID string, roles []userdata.Role) error {
+	return wrapError(a.repo.AddRealmRoleToUser(ctx, token, realm, userID, rolesToKeyCloak(roles)))
+}
+
+func (a *adapter) DeleteRealmRolesFromUser(ctx context.Context, token, realm, userID string, roles []userdata.Role) error {
+	return wrapError(a.repo.DeleteRealmRoleFromUser(ctx, token, realm, userID, rolesToKeyCloak(roles)))
+}
+
+func (a *adapter) GetClientRolesByUserID(ctx context.Context, token, realm, idOfClient, userID string) ([]*userdata.Role, error) {
+	keycloakRoles, err := a.repo.GetClientRolesByUserID(ctx, token, realm, idOfClient, userID)
+	return rolesToService(keycloakRoles), wrapError(err)
+}
+
+func (a *adapter) GetCompositeClientRolesByUserID(ctx context.Context, token, realm, idOfClient, userID string) ([]*userdata.Role, error) {
+	keycloakRoles, err := a.repo.GetCompositeClientRolesByUserID(ctx, token, realm, idOfClient, userID)
+	return rolesToService(keycloakRoles), wrapError(err)
+}
+
+func (a *adapter) AddClientRolesToUser(ctx context.Context, token, realm, idOfClient, userID string, roles []userdata.Role) error {
+	return wrapError(a.repo.AddClientRolesToUser(ctx, token, realm, idOfClient, userID, rolesToKeyCloak(roles)))
+}
+
+func (a *adapter) DeleteClientRolesFromUser(ctx context.Context, token, realm, idOfClient, userID string, roles []userdata.Role) error {
+	return wrapError(a.repo.DeleteClientRolesFromUser(ctx, token, realm, idOfClient, userID, rolesToKeyCloak(roles)))
+}
@@ -1,11 +1,97 @@
 package keycloak
 
-import "github.com/Nerzal/gocloak/v13"
+import (
+	"context"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/Nerzal/gocloak/v13"
+)
 
 type repository struct {
 	*gocloak.GoCloak
+	// Адрес keycloak, с которым создан клиент. Нужен для запросов, которых нет в gocloak
+	basePath string
+}
+
+func NewRepository(keycloakClient *gocloak.GoCloak, basePath string) *repository {
+	return &repository{
+		GoCloak:  keycloakClient,
+		basePath: strings.TrimRight(basePath, "/"),
+	}
+}
+
+// AdminEvent - Событие аудита администрирования keycloak
+type AdminEvent struct {
+	// Время события в миллисекундах
+	Time    int64  `json:"time"`
+	RealmID string `json:"realmId"`
+	// CREATE, UPDATE, DELETE или ACTION
+	OperationType string `json:"operationType"`
+	// USER, GROUP, CLIENT и т.д.
+	ResourceType string `json:"resourceType"`
+	// Путь ресурса относительно realm'а, для user'а - users/{userID}
+	ResourcePath string `json:"resourcePath"`
+	// JSON ресурса, если в realm'е включены подробности admin events
+	Representation string `json:"representation,omitempty"`
+}
+
+// AdminEventsParams - Фильтры запроса admin events
+type AdminEventsParams struct {
+	// Дата в формате 2006-01-02, с которой отдавать события
+	DateFrom       string
+	OperationTypes []string
+	ResourceTypes  []string
+	First          int
+	Max            int
+}
+
+// GetAdminEvents - Получаем admin events realm'а, новые события идут первыми.
+// В gocloak такого метода нет, поэтому запрос собираем сами
+func (r *repository) GetAdminEvents(ctx context.Context, token, realm string, params AdminEventsParams) ([]*AdminEvent, error) {
+	query := url.Values{}
+	if params.DateFrom != "" {
+		query.Set("dateFrom", params.DateFrom)
+	}
+	for _, operationType := range params.OperationTypes {
+		query.Add("operationTypes", operationType)
+	}
+	for _, resourceType := range params.ResourceTypes {
+		query.Add("resourceTypes", resourceType)
+	}
+	if params.First > 0 {
+		query.Set("first", strconv.Itoa(params.First))
+	}
+	if params.Max > 0 {
+		query.Set("max", strconv.Itoa(params.Max))
+	}
+
+	var events []*AdminEvent
+	resp, err := r.GetRequestWithBearerAuth(ctx, token).
+		SetQueryParamsFromValues(query).
+		SetResult(&events).
+		Get(r.basePath + "/admin/realms/" + url.PathEscape(realm) + "/admin-events")
+	if err != nil {
+		return nil, &gocloak.APIError{Message: err.Error(), Type: gocloak.ParseAPIErrType(err)}
+	}
+	if resp.IsError() {
+		return nil, &gocloak.APIError{Code: resp.StatusCode(), Message: resp.Status()}
+	}
+	return events, nil
 }
 
-func NewRepository(keycloakClient *gocloak.GoCloak) *repository {
-	return &repository{keycloakClient}
+// GetJWKS - Получаем JWKS realm'а без cache gocloak, чтобы сразу видеть ротацию ключей
+func (r *repository) GetJWKS(ctx context.Context, realm string) (*gocloak.CertResponse, error) {
+	var certs gocloak.CertResponse
+	resp, err := r.GetRequest(ctx).
+		SetResult(&certs).
+		Get(r.basePath + "/realms/" + url.PathEscape(realm) + "/protocol/openid-connect/certs")
+	if err != nil {
+		return nil, &gocloak.APIError{Message: err.Error(), Type: gocloak.ParseAPIErrType(err)}
+	}
+	if resp.IsError() {
+		return nil, &gocloak.APIError{Code: resp.StatusCode(), Message: resp.Status()}
+	}
+	return &certs, nil
 }
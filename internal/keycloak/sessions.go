@@ -0,0 +1,55 @@
+package keycloak
+
+import (
+	"context"
+
+	"github.com/Nerzal/gocloak/v13"
+	"github.com/mtvy/cached_updater/internal/userdata"
+)
+
+// userSessionToService - переводим *gocloak.UserSessionRepresentation к *userdata.UserSession
+func userSessionToService(keycloakSession *gocloak.UserSessionRepresentation) *userdata.UserSession {
+	if keycloakSession == nil {
+		return nil
+	}
+	return &userdata.UserSession{
+		ID:         keycloakSession.ID,
+		UserID:     keycloakSession.UserID,
+		Username:   keycloakSession.Username,
+		IPAddress:  keycloakSession.IPAddress,
+		Start:      keycloakSession.Start,
+		LastAccess: keycloakSession.LastAccess,
+		Clients:    keycloakSession.Clients,
+	}
+}
+
+func userSessionsToService(keycloakSessions []*gocloak.UserSessionRepresentation) []*userdata.UserSession {
+	if keycloakSessions == nil {
+		return nil
+	}
+	sessions := make([]*userdata.UserSession, 0, len(keycloakSessions))
+	for _, keycloakSession := range keycloakSessions {
+		sessions = append(sessions, userSessionToService(keycloakSession))
+	}
+	return sessions
+}
+
+// GetUserSessions - Получаем активные сессии user'а из keycloak
+func (a *adapter) GetUserSessions(ctx context.Context, token, realm, userID string) ([]*userdata.UserSession, error) {
+	keycloakSessions, err := a.repo.GetUserSessions(ctx, token, realm, userID)
+	return userSessionsToService(keycloakSessions), wrapError(err)
+}
+
+func (a *adapter) LogoutUserSession(ctx context.Context, accessToken, realm, sessionID string) error {
+	return wrapError(a.repo.LogoutUserSession(ctx, accessToken, realm, sessionID))
+}
+
+func (a *adapter) Logout(ctx context.Context, clientID, clientSecret, realm, refreshToken string) error {
+	return wrapError(a.repo.Logout(ctx, clientID, clientSecret, realm, refreshToken))
+}
+
+// RefreshToken - Обновляем token по refresh token без повторного LoginClient
+func (a *adapter) RefreshToken(ctx context.Context, refreshToken, clientID, clientSecret, realm string) (*userdata.JWT, error) {
+	keycloakJWT, err := a.repo.RefreshToken(ctx, refreshToken, clientID, clientSecret, realm)
+	return jwtToService(keycloakJWT), wrapError(err)
+}
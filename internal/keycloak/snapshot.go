@@ -0,0 +1,156 @@
+package keycloak
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"time"
+
+	"github.com/mtvy/cached_updater/internal/metrics"
+	"github.com/mtvy/cached_updater/internal/userdata"
+)
+
+// snapshotMagic - Первые байты файла snapshot'а userCache
+var snapshotMagic = [4]byte{'U', 'C', 'S', 'N'}
+
+// snapshotVersion - Версия формата snapshot'а. Увеличивается при несовместимом изменении snapshotEntry
+const snapshotVersion uint32 = 1
+
+var (
+	// ErrSnapshotCorrupted - Файл не является snapshot'ом или повреждён
+	ErrSnapshotCorrupted = errors.New("user cache snapshot is corrupted")
+	// ErrSnapshotVersion - Snapshot записан в несовместимой версии формата
+	ErrSnapshotVersion = errors.New("user cache snapshot version is not supported")
+)
+
+// snapshotHeader - Заголовок snapshot'а перед payload
+type snapshotHeader struct {
+	Magic   [4]byte
+	Version uint32
+	// Длина payload в байтах
+	Length uint64
+	// Контрольная сумма payload
+	Checksum uint32
+}
+
+// snapshotEntry - Запись user'а в payload snapshot'а
+type snapshotEntry struct {
+	Realm    string        `json:"realm"`
+	UserID   string        `json:"user_id"`
+	Email    string        `json:"email,omitempty"`
+	Deadline time.Time     `json:"deadline"`
+	User     userdata.User `json:"user"`
+}
+
+// WriteSnapshot - Пишем всех user'ов cache вместе с deadline. Credentials в snapshot не попадают
+func (c *userCache) WriteSnapshot(w io.Writer) error {
+	c.RLock()
+	entries := make([]snapshotEntry, 0, c.entries)
+	for realm, rc := range c.realms {
+		for userID, cached := range rc.userIDMap {
+			entries = append(entries, snapshotEntry{
+				Realm:    realm,
+				UserID:   userID,
+				Email:    cached.email,
+				Deadline: cached.deadline,
+				User:     cached.user.WithoutSecrets(),
+			})
+		}
+	}
+	c.RUnlock()
+
+	payload, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	header := snapshotHeader{
+		Magic:    snapshotMagic,
+		Version:  snapshotVersion,
+		Length:   uint64(len(payload)),
+		Checksum: crc32.ChecksumIEEE(payload),
+	}
+	if err := binary.Write(w, binary.BigEndian, header); err != nil {
+		return err
+	}
+	_, err = w.Write(payload)
+	return err
+}
+
+// ReadSnapshot - Загружаем user'ов из snapshot'а, пропуская просроченные.
+// Snapshot проверяется целиком до загрузки, поэтому битый файл cache не меняет.
+// Возвращаем количество загруженных user'ов
+func (c *userCache) ReadSnapshot(r io.Reader) (int, error) {
+	var header snapshotHeader
+	if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+		return 0, fmt.Errorf("%w: %s", ErrSnapshotCorrupted, err)
+	}
+	if header.Magic != snapshotMagic {
+		return 0, ErrSnapshotCorrupted
+	}
+	if header.Version != snapshotVersion {
+		return 0, fmt.Errorf("%w: %d", ErrSnapshotVersion, header.Version)
+	}
+	var payload bytes.Buffer
+	if _, err := io.CopyN(&payload, r, int64(header.Length)); err != nil {
+		return 0, fmt.Errorf("%w: %s", ErrSnapshotCorrupted, err)
+	}
+	if crc32.ChecksumIEEE(payload.Bytes()) != header.Checksum {
+		return 0, fmt.Errorf("%w: checksum mismatch", ErrSnapshotCorrupted)
+	}
+	var entries []snapshotEntry
+	if err := json.Unmarshal(payload.Bytes(), &entries); err != nil {
+		return 0, fmt.Errorf("%w: %s", ErrSnapshotCorrupted, err)
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	// Как и sweep, оставляем записи, которые ещё можно отдать через GetStale*
+	now := time.Now().UTC().Add(-c.staleGrace)
+	restored := make(map[string]int)
+	for _, entry := range entries {
+		if !entry.Deadline.After(now) {
+			continue
+		}
+		rc := c.realmLocked(entry.Realm)
+		c.setUserLocked(rc, entry.Realm, entry.UserID, entry.Email, entry.User, entry.Deadline)
+		restored[entry.Realm]++
+	}
+	count := 0
+	for realm, n := range restored {
+		metrics.IncKeycloakCacheEvent(realm, cacheSnapshotRestored)
+		count += n
+	}
+	return count, nil
+}
+
+// SaveSnapshot - Атомарно пишем snapshot в файл с правами 0600: в нём персональные данные user'ов
+func (c *userCache) SaveSnapshot(path string) error {
+	var buf bytes.Buffer
+	if err := c.WriteSnapshot(&buf); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(path, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	metrics.IncKeycloakCacheEvent("", cacheSnapshotSaved)
+	return nil
+}
+
+// LoadSnapshot - Загружаем snapshot из файла, отсутствующий файл - не ошибка
+func (c *userCache) LoadSnapshot(path string) (int, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	return c.ReadSnapshot(bufio.NewReader(file))
+}
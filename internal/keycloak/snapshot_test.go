@@ -0,0 +1,124 @@
+package keycloak
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mtvy/cached_updater/internal/userdata"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUserCacheSnapshot(t *testing.T) {
+	ctx := context.Background()
+	source := NewUserCache(ctx, UserCacheConfig{TTL: time.Minute}, nil)
+	defer source.Close()
+	source.SetRealmTTL("expired", -time.Minute)
+	source.SetUser(ctx, testRealm, "1", "1@test.test", testUserFactory("1", "1@test.test"))
+	source.SetUser(ctx, "other", "2", "2@test.test", testUserFactory("2", "2@test.test"))
+	source.SetUser(ctx, "expired", "3", "3@test.test", testUserFactory("3", "3@test.test"))
+
+	var snapshot bytes.Buffer
+	require.NoError(t, source.WriteSnapshot(&snapshot))
+
+	t.Run("загружаем живых user'ов и пропускаем просроченных", func(t *testing.T) {
+		restored := NewUserCache(ctx, UserCacheConfig{TTL: time.Minute}, nil)
+		defer restored.Close()
+
+		count, err := restored.ReadSnapshot(bytes.NewReader(snapshot.Bytes()))
+		require.NoError(t, err)
+		require.Equal(t, 2, count)
+
+		user, err := restored.GetUserByEmail(ctx, testRealm, "1@test.test")
+		require.NoError(t, err)
+		require.Equal(t, testUserFactory("1", "1@test.test"), user)
+		_, err = restored.GetUserByUserID(ctx, "other", "2")
+		require.NoError(t, err)
+		_, err = restored.GetStaleUserByUserID(ctx, "expired", "3")
+		require.Error(t, err)
+	})
+
+	corrupt := func(offset int) []byte {
+		data := append([]byte(nil), snapshot.Bytes()...)
+		data[offset] ^= 0xff
+		return data
+	}
+	version := append([]byte(nil), snapshot.Bytes()...)
+	binary.BigEndian.PutUint32(version[4:8], snapshotVersion+1)
+
+	testCases := []struct {
+		name    string
+		data    []byte
+		wantErr error
+	}{
+		{
+			name:    "не snapshot",
+			data:    corrupt(0),
+			wantErr: ErrSnapshotCorrupted,
+		},
+		{
+			name:    "повреждённый payload",
+			data:    corrupt(snapshot.Len() - 2),
+			wantErr: ErrSnapshotCorrupted,
+		},
+		{
+			name:    "обрезанный файл",
+			data:    snapshot.Bytes()[:snapshot.Len()/2],
+			wantErr: ErrSnapshotCorrupted,
+		},
+		{
+			name:    "несовместимая версия",
+			data:    version,
+			wantErr: ErrSnapshotVersion,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			restored := NewUserCache(ctx, UserCacheConfig{TTL: time.Minute}, nil)
+			defer restored.Close()
+
+			count, err := restored.ReadSnapshot(bytes.NewReader(tc.data))
+			require.ErrorIs(t, err, tc.wantErr)
+			require.Zero(t, count)
+			require.Zero(t, restored.Stats(testRealm).Size)
+		})
+	}
+}
+
+func TestUserCacheWarmStart(t *testing.T) {
+	ctx := context.Background()
+	cfg := UserCacheConfig{TTL: time.Minute, SnapshotPath: filepath.Join(t.TempDir(), "users.snapshot")}
+
+	first := NewUserCache(ctx, cfg, nil)
+	first.SetUser(ctx, testRealm, "1", "1@test.test", testUserFactory("1", "1@test.test"))
+	require.NoError(t, first.Close())
+
+	info, err := os.Stat(cfg.SnapshotPath)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	second := NewUserCache(ctx, cfg, nil)
+	defer second.Close()
+	user, err := second.GetUserByUserID(ctx, testRealm, "1")
+	require.NoError(t, err)
+	require.Equal(t, testUserFactory("1", "1@test.test"), user)
+}
+
+func TestUserCacheSnapshotWithoutSecrets(t *testing.T) {
+	ctx := context.Background()
+	cache := NewUserCache(ctx, UserCacheConfig{TTL: time.Minute}, nil)
+	defer cache.Close()
+	user := testUserFactory("1", "1@test.test")
+	user.Credentials = &[]userdata.CredentialRepresentation{{Value: GetPtr("plain-password"), SecretData: GetPtr("secret-data")}}
+	cache.SetUser(ctx, testRealm, "1", "1@test.test", user)
+
+	var snapshot bytes.Buffer
+	require.NoError(t, cache.WriteSnapshot(&snapshot))
+	require.NotContains(t, snapshot.String(), "plain-password")
+	require.NotContains(t, snapshot.String(), "secret-data")
+}
@@ -3,6 +3,7 @@ package metrics
 import (
 	"context"
 	"net/http"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -15,13 +16,59 @@ var (
 		Subsystem: "site_client_process",
 		Name:      "keycloak_cache_counter",
 		Help:      "Count keycloak cache events",
-	}, []string{"status"})
+	}, []string{"realm", "status"})
+
+	// Попадания и промахи по уровням многоуровневого cache
+	keycloakCacheTierCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ord",
+		Subsystem: "site_client_process",
+		Name:      "keycloak_cache_tier_counter",
+		Help:      "Count keycloak cache hits and misses per cache tier",
+	}, []string{"realm", "tier", "status"})
+
+	// Количество удалённых при очистке просроченных записей cache
+	keycloakCacheSweptCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ord",
+		Subsystem: "site_client_process",
+		Name:      "keycloak_cache_swept_counter",
+		Help:      "Count expired keycloak cache entries removed by janitor",
+	}, []string{"realm"})
+
+	// Время, которое очистка cache держит lock
+	keycloakCacheSweepDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "ord",
+		Subsystem: "site_client_process",
+		Name:      "keycloak_cache_sweep_duration_seconds",
+		Help:      "Duration of keycloak cache sweep lock hold",
+		Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 8),
+	})
+
+	// Количество user'ов, загруженных в cache предзагрузкой
+	keycloakCachePreloadedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ord",
+		Subsystem: "site_client_process",
+		Name:      "keycloak_cache_preloaded_counter",
+		Help:      "Count users preloaded into keycloak cache",
+	}, []string{"realm"})
+
+	// Завершена ли предзагрузка realm'а: 1 - да, 0 - нет
+	keycloakCachePreloadDone = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "ord",
+		Subsystem: "site_client_process",
+		Name:      "keycloak_cache_preload_done",
+		Help:      "Whether keycloak cache preload of the realm is completed",
+	}, []string{"realm"})
 )
 
 func Init(ctx context.Context, mux *http.ServeMux) *http.ServeMux {
 	// Заводим метрики
 	prometheus.MustRegister(
 		keycloakCacheCounter,
+		keycloakCacheTierCounter,
+		keycloakCacheSweptCounter,
+		keycloakCacheSweepDuration,
+		keycloakCachePreloadedCounter,
+		keycloakCachePreloadDone,
 	)
 
 	// Роут по которому будет стучаться
@@ -31,6 +78,35 @@ func Init(ctx context.Context, mux *http.ServeMux) *http.ServeMux {
 }
 
 // Записываем размер файла в бакеты
-func IncKeycloakCacheEvent(status string) {
-	keycloakCacheCounter.WithLabelValues(status).Inc()
+func IncKeycloakCacheEvent(realm, status string) {
+	keycloakCacheCounter.WithLabelValues(realm, status).Inc()
+}
+
+// Записываем попадание или промах по уровню cache
+func IncKeycloakCacheTierEvent(realm, tier, status string) {
+	keycloakCacheTierCounter.WithLabelValues(realm, tier, status).Inc()
+}
+
+// Записываем количество удалённых при очистке записей realm'а
+func AddKeycloakCacheSwept(realm string, count int) {
+	keycloakCacheSweptCounter.WithLabelValues(realm).Add(float64(count))
+}
+
+// Записываем время удержания lock'а при очистке cache
+func ObserveKeycloakCacheSweepDuration(duration time.Duration) {
+	keycloakCacheSweepDuration.Observe(duration.Seconds())
+}
+
+// Записываем количество предзагруженных user'ов realm'а
+func AddKeycloakCachePreloaded(realm string, count int) {
+	keycloakCachePreloadedCounter.WithLabelValues(realm).Add(float64(count))
+}
+
+// Записываем, завершена ли предзагрузка realm'а
+func SetKeycloakCachePreloadDone(realm string, done bool) {
+	value := 0.0
+	if done {
+		value = 1
+	}
+	keycloakCachePreloadDone.WithLabelValues(realm).Set(value)
 }
@@ -0,0 +1,408 @@
+package rediscache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mtvy/cached_updater/internal/metrics"
+	"github.com/mtvy/cached_updater/internal/userdata"
+	"github.com/mtvy/cached_updater/pkg"
+	"github.com/redis/go-redis/v9"
+)
+
+// defaultPrefix - Префикс ключей, если он не задан в UserCacheConfig
+const defaultPrefix = "cached_updater"
+
+// scanBatch - Сколько ключей за раз достаём SCAN'ом при очистке realm'а
+const scanBatch = 500
+
+// maxScanPasses - Максимум проходов SCAN при очистке realm'а
+const maxScanPasses = 3
+
+const (
+	getCacheUserByEmail = "redis_get_user_by_email"
+	getCacheUsersErr    = "redis_error_get_user_by_email"
+
+	getCacheUserByID    = "redis_get_user_by_id"
+	getCacheUserByIDErr = "redis_error_get_user_by_id"
+
+	getCacheUserByIndex    = "redis_get_user_by_index"
+	getCacheUserByIndexErr = "redis_error_get_user_by_index"
+
+	getCacheStaleUser    = "redis_get_stale_user"
+	getCacheStaleUserErr = "redis_error_get_stale_user"
+
+	setCacheUserErr  = "redis_error_set_user"
+	cacheInvalidated = "redis_invalidated"
+	invalidateErr    = "redis_error_invalidate"
+)
+
+// setUserScript - Атомарно заменяем запись user'а: удаляем вторичные ключи старой записи,
+// которые ещё указывают на этого user'а, и сеттим новую запись с её вторичными ключами.
+// Ключ индекса, который уже указывает на другого user'а, становится пустым (ambiguousUserID):
+// значение атрибута есть у нескольких user'ов, и отдать одного из них нельзя.
+// KEYS[1] - ключ записи, KEYS[2..] - вторичные ключи: сначала уникальные (email), потом индексы.
+// ARGV[1] - запись, ARGV[2] - userID, ARGV[3] - время жизни в миллисекундах,
+// ARGV[4] - количество уникальных вторичных ключей
+var setUserScript = redis.NewScript(`
+local old = redis.call('GET', KEYS[1])
+if old then
+	for _, key in ipairs(cjson.decode(old).keys) do
+		if redis.call('GET', key) == ARGV[2] then
+			redis.call('DEL', key)
+		end
+	end
+end
+redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[3])
+local unique = tonumber(ARGV[4])
+for i = 2, #KEYS do
+	local current = redis.call('GET', KEYS[i])
+	if i - 1 > unique and current and current ~= ARGV[2] then
+		redis.call('SET', KEYS[i], '', 'PX', ARGV[3])
+	else
+		redis.call('SET', KEYS[i], ARGV[2], 'PX', ARGV[3])
+	end
+end
+return 1
+`)
+
+// ambiguousUserID - Значение ключа индекса, по которому нашлось несколько user'ов.
+// Такой ключ отдаёт промах и истекает вместе с записями user'ов
+const ambiguousUserID = ""
+
+// deleteUserScript - Атомарно удаляем запись user'а и его вторичные ключи.
+// Нечитаемую запись тоже удаляем, её вторичные ключи истекут сами.
+// KEYS[1] - ключ записи, ARGV[1] - userID
+var deleteUserScript = redis.NewScript(`
+local old = redis.call('GET', KEYS[1])
+if not old then
+	return 0
+end
+local ok, record = pcall(cjson.decode, old)
+if ok and type(record) == 'table' and type(record.keys) == 'table' then
+	for _, key in ipairs(record.keys) do
+		if redis.call('GET', key) == ARGV[1] then
+			redis.call('DEL', key)
+		end
+	end
+end
+redis.call('DEL', KEYS[1])
+return 1
+`)
+
+// cachedUser - Запись о пользователе в redis
+type cachedUser struct {
+	User userdata.User `json:"user"`
+	// Время, после которого запись отдаётся только через GetStale*
+	Deadline time.Time `json:"deadline"`
+	// Вторичные ключи записи: email и индексы
+	Keys []string `json:"keys"`
+}
+
+// UserCacheConfig - Настройки userCache
+type UserCacheConfig struct {
+	// Префикс ключей, чтобы несколько сервисов могли делить один redis.
+	// Если не задан - используем defaultPrefix
+	Prefix string
+	// Время жизни записи по умолчанию
+	TTL time.Duration
+	// Сколько хранить user'а после deadline, чтобы отдавать его через GetStale*
+	StaleGrace time.Duration
+	// Дополнительные индексы для GetUserByIndex: pkg.IndexUsername или ключи атрибутов.
+	// Значение, которое есть у нескольких user'ов в cache, из индекса не отдаётся
+	Indexes []string
+}
+
+// userCache - Хранит данные по user'ам в redis, разбитые по realm'ам.
+// Истечение записей остаётся на стороне redis
+type userCache struct {
+	client redis.UniversalClient
+	prefix string
+	// Время жизни записи по умолчанию
+	ttl        time.Duration
+	staleGrace time.Duration
+	indexes    []string
+
+	sync.RWMutex
+	// Ключ - realm, значение - время жизни записей в нём
+	realmTTL map[string]time.Duration
+}
+
+func NewUserCache(client redis.UniversalClient, cfg UserCacheConfig) *userCache {
+	prefix := cfg.Prefix
+	if prefix == "" {
+		prefix = defaultPrefix
+	}
+	return &userCache{
+		client:     client,
+		prefix:     prefix,
+		ttl:        cfg.TTL,
+		staleGrace: cfg.StaleGrace,
+		indexes:    cfg.Indexes,
+		realmTTL:   make(map[string]time.Duration),
+	}
+}
+
+// SetRealmTTL - Задаём отдельное время жизни записей для realm'а
+func (c *userCache) SetRealmTTL(realm string, ttl time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.realmTTL[realm] = ttl
+}
+
+func (c *userCache) getRealmTTL(realm string) time.Duration {
+	c.RLock()
+	defer c.RUnlock()
+	if ttl, ok := c.realmTTL[realm]; ok {
+		return ttl
+	}
+	return c.ttl
+}
+
+// realmPrefix - Все ключи realm'а имеют общий hash tag, чтобы скрипты работали в redis cluster
+func (c *userCache) realmPrefix(realm string) string {
+	return c.prefix + ":{" + realm + "}:"
+}
+
+func (c *userCache) userKey(realm, userID string) string {
+	return c.realmPrefix(realm) + "user:" + userID
+}
+
+// emailKey - Ключ email в нижнем регистре: keycloak ищет по email без учёта регистра
+func (c *userCache) emailKey(realm, email string) string {
+	return c.realmPrefix(realm) + "email:" + strings.ToLower(email)
+}
+
+func (c *userCache) indexKey(realm, index, value string) string {
+	return c.realmPrefix(realm) + "index:" + index + ":" + value
+}
+
+// SetUser - Сеттим user'а и его вторичные ключи, время жизни в redis - ttl realm'а и staleGrace.
+// Если новую запись записать не удалось, удаляем старую: после UpdateUser она уже устарела
+func (c *userCache) SetUser(ctx context.Context, realm, userID, email string, newUser userdata.User) {
+	ttl := c.getRealmTTL(realm)
+	expiration := ttl + c.staleGrace
+	if expiration <= 0 {
+		c.deleteUser(ctx, realm, userID)
+		return
+	}
+
+	keys := []string{}
+	if email != "" {
+		keys = append(keys, c.emailKey(realm, email))
+	}
+	uniqueKeys := len(keys)
+	for _, index := range c.indexes {
+		for _, value := range pkg.IndexValues(newUser, index) {
+			keys = append(keys, c.indexKey(realm, index, value))
+		}
+	}
+	payload, err := json.Marshal(cachedUser{
+		User:     newUser.WithoutSecrets(),
+		Deadline: time.Now().UTC().Add(ttl),
+		Keys:     keys,
+	})
+	if err != nil {
+		metrics.IncKeycloakCacheEvent(realm, setCacheUserErr)
+		c.deleteUser(ctx, realm, userID)
+		return
+	}
+
+	scriptKeys := append([]string{c.userKey(realm, userID)}, keys...)
+	err = setUserScript.Run(ctx, c.client, scriptKeys, payload, userID, expiration.Milliseconds(), uniqueKeys).Err()
+	if err != nil {
+		metrics.IncKeycloakCacheEvent(realm, setCacheUserErr)
+		c.deleteUser(ctx, realm, userID)
+	}
+}
+
+// getUser - Достаём запись user'а по ключу
+func (c *userCache) getUser(ctx context.Context, key string) (cachedUser, error) {
+	payload, err := c.client.Get(ctx, key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return cachedUser{}, pkg.ErrNoCachedUser
+	}
+	if err != nil {
+		return cachedUser{}, err
+	}
+	var cached cachedUser
+	if err := json.Unmarshal(payload, &cached); err != nil {
+		return cachedUser{}, err
+	}
+	return cached, nil
+}
+
+// getUserBySecondaryKey - Достаём запись user'а по вторичному ключу
+func (c *userCache) getUserBySecondaryKey(ctx context.Context, realm, key string) (cachedUser, error) {
+	userID, err := c.client.Get(ctx, key).Result()
+	if errors.Is(err, redis.Nil) || (err == nil && userID == ambiguousUserID) {
+		return cachedUser{}, pkg.ErrNoCachedUser
+	}
+	if err != nil {
+		return cachedUser{}, err
+	}
+	return c.getUser(ctx, c.userKey(realm, userID))
+}
+
+// fresh - Отдаём user'а, только если не прошёл его deadline
+func fresh(cached cachedUser, err error) (userdata.User, error) {
+	if err != nil {
+		return userdata.User{}, err
+	}
+	if !cached.Deadline.After(time.Now().UTC()) {
+		return userdata.User{}, pkg.ErrNoCachedUser
+	}
+	return cached.User, nil
+}
+
+// GetUserByUserID - Достаём User'а realm'а по userID
+func (c *userCache) GetUserByUserID(ctx context.Context, realm, userID string) (userdata.User, error) {
+	user, err := fresh(c.getUser(ctx, c.userKey(realm, userID)))
+	if err != nil {
+		metrics.IncKeycloakCacheEvent(realm, getCacheUserByIDErr)
+		return userdata.User{}, err
+	}
+	metrics.IncKeycloakCacheEvent(realm, getCacheUserByID)
+	return user, nil
+}
+
+// GetUserByEmail - Достаём User'а realm'а по email
+func (c *userCache) GetUserByEmail(ctx context.Context, realm, email string) (userdata.User, error) {
+	user, err := fresh(c.getUserBySecondaryKey(ctx, realm, c.emailKey(realm, email)))
+	if err != nil {
+		metrics.IncKeycloakCacheEvent(realm, getCacheUsersErr)
+		return userdata.User{}, err
+	}
+	metrics.IncKeycloakCacheEvent(realm, getCacheUserByEmail)
+	return user, nil
+}
+
+// GetUserByIndex - Достаём User'а realm'а по значению дополнительного индекса
+func (c *userCache) GetUserByIndex(ctx context.Context, realm, index, value string) (userdata.User, error) {
+	key := c.indexKey(realm, index, pkg.IndexValue(index, value))
+	user, err := fresh(c.getUserBySecondaryKey(ctx, realm, key))
+	if err != nil {
+		metrics.IncKeycloakCacheEvent(realm, getCacheUserByIndexErr)
+		return userdata.User{}, err
+	}
+	metrics.IncKeycloakCacheEvent(realm, getCacheUserByIndex)
+	return user, nil
+}
+
+// GetStaleUserByUserID - Достаём User'а realm'а по userID, в том числе с истёкшим deadline
+func (c *userCache) GetStaleUserByUserID(ctx context.Context, realm, userID string) (userdata.User, error) {
+	cached, err := c.getUser(ctx, c.userKey(realm, userID))
+	if err != nil {
+		metrics.IncKeycloakCacheEvent(realm, getCacheStaleUserErr)
+		return userdata.User{}, err
+	}
+	metrics.IncKeycloakCacheEvent(realm, getCacheStaleUser)
+	return cached.User, nil
+}
+
+// GetStaleUserByEmail - Достаём User'а realm'а по email, в том числе с истёкшим deadline
+func (c *userCache) GetStaleUserByEmail(ctx context.Context, realm, email string) (userdata.User, error) {
+	cached, err := c.getUserBySecondaryKey(ctx, realm, c.emailKey(realm, email))
+	if err != nil {
+		metrics.IncKeycloakCacheEvent(realm, getCacheStaleUserErr)
+		return userdata.User{}, err
+	}
+	metrics.IncKeycloakCacheEvent(realm, getCacheStaleUser)
+	return cached.User, nil
+}
+
+// InvalidateUser - Удаляем user'а realm'а и его вторичные ключи
+func (c *userCache) InvalidateUser(ctx context.Context, realm, userID string) {
+	if !c.deleteUser(ctx, realm, userID) {
+		return
+	}
+	metrics.IncKeycloakCacheEvent(realm, cacheInvalidated)
+}
+
+// deleteUser - Удаляем запись user'а и вторичные ключи, которые на неё указывают.
+// Возвращаем false, если redis вернул ошибку
+func (c *userCache) deleteUser(ctx context.Context, realm, userID string) bool {
+	if err := deleteUserScript.Run(ctx, c.client, []string{c.userKey(realm, userID)}, userID).Err(); err != nil {
+		metrics.IncKeycloakCacheEvent(realm, invalidateErr)
+		return false
+	}
+	return true
+}
+
+// InvalidateRealm - Удаляем все ключи realm'а
+func (c *userCache) InvalidateRealm(ctx context.Context, realm string) {
+	if err := c.deleteMatching(ctx, escapePattern(c.realmPrefix(realm))+"*"); err != nil {
+		metrics.IncKeycloakCacheEvent(realm, invalidateErr)
+		return
+	}
+	metrics.IncKeycloakCacheEvent(realm, cacheInvalidated)
+}
+
+// Purge - Удаляем все ключи с префиксом cache
+func (c *userCache) Purge(ctx context.Context) {
+	if err := c.deleteMatching(ctx, escapePattern(c.prefix+":")+"*"); err != nil {
+		metrics.IncKeycloakCacheEvent("", invalidateErr)
+		return
+	}
+	metrics.IncKeycloakCacheEvent("", cacheInvalidated)
+}
+
+// deleteMatching - Удаляем ключи по шаблону пачками через SCAN, чтобы не блокировать redis.
+// В redis cluster проходим по всем master-нодам
+func (c *userCache) deleteMatching(ctx context.Context, pattern string) error {
+	if cluster, ok := c.client.(*redis.ClusterClient); ok {
+		return cluster.ForEachMaster(ctx, func(ctx context.Context, node *redis.Client) error {
+			return deleteMatching(ctx, node, pattern)
+		})
+	}
+	return deleteMatching(ctx, c.client, pattern)
+}
+
+func deleteMatching(ctx context.Context, client redis.Cmdable, pattern string) error {
+	// SCAN не гарантирует выдачу ключей, добавленных или сдвинутых во время прохода,
+	// поэтому повторяем проход, пока он находит ключи. При непрекращающейся записи
+	// в realm новые ключи находились бы всегда, поэтому проходов не больше maxScanPasses
+	for pass := 0; pass < maxScanPasses; pass++ {
+		deleted, err := scanAndDelete(ctx, client, pattern)
+		if err != nil || deleted == 0 {
+			return err
+		}
+	}
+	return nil
+}
+
+// scanAndDelete - Один проход SCAN с удалением найденных ключей
+func scanAndDelete(ctx context.Context, client redis.Cmdable, pattern string) (int, error) {
+	var cursor uint64
+	deleted := 0
+	for {
+		keys, next, err := client.Scan(ctx, cursor, pattern, scanBatch).Result()
+		if err != nil {
+			return deleted, err
+		}
+		if len(keys) > 0 {
+			// Ключи разных realm'ов лежат в разных слотах, поэтому удаляем по одному в pipeline
+			pipe := client.Pipeline()
+			for _, key := range keys {
+				pipe.Del(ctx, key)
+			}
+			if _, err := pipe.Exec(ctx); err != nil {
+				return deleted, err
+			}
+			deleted += len(keys)
+		}
+		cursor = next
+		if cursor == 0 {
+			return deleted, nil
+		}
+	}
+}
+
+// escapePattern - Экранируем спецсимволы glob-шаблона SCAN MATCH
+func escapePattern(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`).Replace(s)
+}
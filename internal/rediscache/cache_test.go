@@ -0,0 +1,239 @@
+package rediscache
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/mtvy/cached_updater/internal/userdata"
+	"github.com/mtvy/cached_updater/pkg"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/require"
+)
+
+const testRealm = "test"
+
+func GetPtr[T any](v T) *T {
+	return &v
+}
+
+func testUserFactory(userID, email string) userdata.User {
+	return userdata.User{
+		ID:    GetPtr(userID),
+		Email: GetPtr(email),
+	}
+}
+
+func newTestCache(t *testing.T, cfg UserCacheConfig) (*userCache, *miniredis.Miniredis) {
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return NewUserCache(client, cfg), server
+}
+
+func TestUserCache(t *testing.T) {
+	ctx := context.Background()
+	cache, server := newTestCache(t, UserCacheConfig{TTL: time.Minute, Indexes: []string{pkg.IndexUsername, "inn"}})
+
+	user := testUserFactory("1", "1@test.test")
+	user.Username = GetPtr("User")
+	user.SetINN("7700000000")
+	cache.SetUser(ctx, testRealm, *user.ID, *user.Email, user)
+
+	t.Run("user достаётся по userID, email и индексам", func(t *testing.T) {
+		cachedUser, err := cache.GetUserByUserID(ctx, testRealm, "1")
+		require.NoError(t, err)
+		require.Equal(t, user, cachedUser)
+
+		cachedUser, err = cache.GetUserByEmail(ctx, testRealm, "1@test.test")
+		require.NoError(t, err)
+		require.Equal(t, user, cachedUser)
+
+		cachedUser, err = cache.GetUserByIndex(ctx, testRealm, pkg.IndexUsername, "USER")
+		require.NoError(t, err)
+		require.Equal(t, user, cachedUser)
+
+		cachedUser, err = cache.GetUserByIndex(ctx, testRealm, "inn", "7700000000")
+		require.NoError(t, err)
+		require.Equal(t, user, cachedUser)
+	})
+
+	t.Run("user'ы разных realm'ов не пересекаются", func(t *testing.T) {
+		_, err := cache.GetUserByUserID(ctx, "other", "1")
+		require.ErrorIs(t, err, pkg.ErrNoCachedUser)
+	})
+
+	t.Run("время жизни ключей задаётся в redis", func(t *testing.T) {
+		require.Equal(t, time.Minute, server.TTL(cache.userKey(testRealm, "1")))
+		require.Equal(t, time.Minute, server.TTL(cache.emailKey(testRealm, "1@test.test")))
+	})
+
+	t.Run("смена email удаляет старый ключ", func(t *testing.T) {
+		updated := testUserFactory("1", "new@test.test")
+		cache.SetUser(ctx, testRealm, *updated.ID, *updated.Email, updated)
+
+		_, err := cache.GetUserByEmail(ctx, testRealm, "1@test.test")
+		require.ErrorIs(t, err, pkg.ErrNoCachedUser)
+		_, err = cache.GetUserByIndex(ctx, testRealm, "inn", "7700000000")
+		require.ErrorIs(t, err, pkg.ErrNoCachedUser)
+		cachedUser, err := cache.GetUserByEmail(ctx, testRealm, "new@test.test")
+		require.NoError(t, err)
+		require.Equal(t, updated, cachedUser)
+	})
+
+	t.Run("InvalidateUser удаляет user'а и его вторичные ключи", func(t *testing.T) {
+		cache.InvalidateUser(ctx, testRealm, "1")
+
+		_, err := cache.GetUserByUserID(ctx, testRealm, "1")
+		require.ErrorIs(t, err, pkg.ErrNoCachedUser)
+		require.False(t, server.Exists(cache.emailKey(testRealm, "new@test.test")))
+	})
+
+	t.Run("значение нескольких user'ов не отдаётся из индекса", func(t *testing.T) {
+		for _, userID := range []string{"2", "3"} {
+			user := testUserFactory(userID, userID+"@test.test")
+			user.SetINN("7800000000")
+			cache.SetUser(ctx, testRealm, *user.ID, *user.Email, user)
+		}
+		_, err := cache.GetUserByIndex(ctx, testRealm, "inn", "7800000000")
+		require.ErrorIs(t, err, pkg.ErrNoCachedUser)
+
+		// Перезапись одного из user'ов не делает значение снова уникальным
+		user := testUserFactory("2", "2@test.test")
+		user.SetINN("7800000000")
+		cache.SetUser(ctx, testRealm, *user.ID, *user.Email, user)
+		_, err = cache.GetUserByIndex(ctx, testRealm, "inn", "7800000000")
+		require.ErrorIs(t, err, pkg.ErrNoCachedUser)
+		_, err = cache.GetUserByEmail(ctx, testRealm, "2@test.test")
+		require.NoError(t, err)
+	})
+
+	t.Run("истечение записи на стороне redis", func(t *testing.T) {
+		cache.SetUser(ctx, testRealm, *user.ID, *user.Email, user)
+		server.FastForward(2 * time.Minute)
+
+		_, err := cache.GetUserByUserID(ctx, testRealm, "1")
+		require.ErrorIs(t, err, pkg.ErrNoCachedUser)
+		_, err = cache.GetUserByEmail(ctx, testRealm, "1@test.test")
+		require.ErrorIs(t, err, pkg.ErrNoCachedUser)
+	})
+}
+
+func TestUserCacheStale(t *testing.T) {
+	ctx := context.Background()
+	cache, _ := newTestCache(t, UserCacheConfig{TTL: time.Minute, StaleGrace: time.Hour})
+	cache.SetRealmTTL(testRealm, time.Millisecond)
+
+	user := testUserFactory("1", "1@test.test")
+	cache.SetUser(ctx, testRealm, *user.ID, *user.Email, user)
+	time.Sleep(5 * time.Millisecond)
+
+	_, err := cache.GetUserByUserID(ctx, testRealm, "1")
+	require.ErrorIs(t, err, pkg.ErrNoCachedUser)
+
+	cachedUser, err := cache.GetStaleUserByUserID(ctx, testRealm, "1")
+	require.NoError(t, err)
+	require.Equal(t, user, cachedUser)
+	cachedUser, err = cache.GetStaleUserByEmail(ctx, testRealm, "1@test.test")
+	require.NoError(t, err)
+	require.Equal(t, user, cachedUser)
+}
+
+func TestUserCacheWithoutSecrets(t *testing.T) {
+	ctx := context.Background()
+	cache, server := newTestCache(t, UserCacheConfig{TTL: time.Minute})
+
+	user := testUserFactory("1", "1@test.test")
+	user.Credentials = &[]userdata.CredentialRepresentation{{
+		Type:       GetPtr("password"),
+		Value:      GetPtr("plain-password"),
+		SecretData: GetPtr("secret-data"),
+	}}
+	cache.SetUser(ctx, testRealm, *user.ID, *user.Email, user)
+
+	payload, err := server.Get(cache.userKey(testRealm, "1"))
+	require.NoError(t, err)
+	require.NotContains(t, payload, "plain-password")
+	require.NotContains(t, payload, "secret-data")
+
+	cachedUser, err := cache.GetUserByUserID(ctx, testRealm, "1")
+	require.NoError(t, err)
+	require.Nil(t, cachedUser.Credentials)
+	require.NotNil(t, user.Credentials)
+}
+
+func TestUserCacheSetUserFailure(t *testing.T) {
+	ctx := context.Background()
+	cache, server := newTestCache(t, UserCacheConfig{TTL: time.Minute})
+
+	user := testUserFactory("1", "1@test.test")
+	cache.SetUser(ctx, testRealm, *user.ID, *user.Email, user)
+
+	t.Run("нулевой ttl удаляет старую запись", func(t *testing.T) {
+		cache.SetRealmTTL(testRealm, 0)
+		cache.SetUser(ctx, testRealm, *user.ID, "updated@test.test", testUserFactory("1", "updated@test.test"))
+
+		_, err := cache.GetUserByUserID(ctx, testRealm, "1")
+		require.ErrorIs(t, err, pkg.ErrNoCachedUser)
+		_, err = cache.GetStaleUserByEmail(ctx, testRealm, "1@test.test")
+		require.ErrorIs(t, err, pkg.ErrNoCachedUser)
+		require.Empty(t, server.Keys())
+	})
+
+	t.Run("ошибка скрипта удаляет старую запись", func(t *testing.T) {
+		cache.SetRealmTTL(testRealm, time.Minute)
+		cache.SetUser(ctx, testRealm, *user.ID, *user.Email, user)
+		// Битая запись ломает cjson.decode в скрипте записи, но не удаление
+		require.NoError(t, server.Set(cache.userKey(testRealm, "1"), "broken"))
+		cache.SetUser(ctx, testRealm, *user.ID, *user.Email, user)
+
+		_, err := cache.GetUserByUserID(ctx, testRealm, "1")
+		require.ErrorIs(t, err, pkg.ErrNoCachedUser)
+	})
+}
+
+func TestUserCacheInvalidateRealm(t *testing.T) {
+	ctx := context.Background()
+	cache, server := newTestCache(t, UserCacheConfig{TTL: time.Minute})
+	for _, realm := range []string{testRealm, "other", "te*"} {
+		for i := 0; i < 1000; i++ {
+			user := testUserFactory(strconv.Itoa(i), strconv.Itoa(i)+"@test.test")
+			cache.SetUser(ctx, realm, *user.ID, *user.Email, user)
+		}
+	}
+
+	cache.InvalidateRealm(ctx, "te*")
+	require.Len(t, server.Keys(), 4000)
+
+	cache.InvalidateRealm(ctx, testRealm)
+	require.Len(t, server.Keys(), 2000)
+	_, err := cache.GetUserByUserID(ctx, "other", "1")
+	require.NoError(t, err)
+
+	cache.Purge(ctx)
+	require.Empty(t, server.Keys())
+}
+
+// testWritingClient - Redis, в realm которого пишут во время каждого SCAN
+type testWritingClient struct {
+	redis.Cmdable
+	scans int
+}
+
+func (c *testWritingClient) Scan(ctx context.Context, cursor uint64, match string, count int64) *redis.ScanCmd {
+	c.scans++
+	c.Cmdable.Set(ctx, "realm:"+strconv.Itoa(c.scans), "user", 0)
+	return c.Cmdable.Scan(ctx, cursor, match, count)
+}
+
+func TestDeleteMatchingConcurrentWrites(t *testing.T) {
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer client.Close()
+	writing := &testWritingClient{Cmdable: client}
+
+	require.NoError(t, deleteMatching(context.Background(), writing, "realm:*"))
+	require.Equal(t, maxScanPasses, writing.scans)
+}
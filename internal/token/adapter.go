@@ -0,0 +1,237 @@
+package token
+
+import (
+	"context"
+
+	"github.com/mtvy/cached_updater/internal/userdata"
+	"github.com/mtvy/cached_updater/pkg"
+)
+
+// authorizedAdapter - Подставляет token из Source в методы, вызванные с пустым token.
+// Переданный явно token используется как есть
+type authorizedAdapter struct {
+	pkg.UserAdapter
+	source Source
+	// Если задан, LoginClient отдаёт сохранённые token'ы
+	manager *manager
+}
+
+// NewAuthorizedAdapter - Оборачиваем адаптер. Если source получен из manager,
+// LoginClient обёртки тоже идёт через manager
+func NewAuthorizedAdapter(adapter pkg.UserAdapter, source Source) *authorizedAdapter {
+	a := &authorizedAdapter{
+		UserAdapter: adapter,
+		source:      source,
+	}
+	if clientSource, ok := source.(*clientSource); ok {
+		a.manager = clientSource.manager
+	}
+	return a
+}
+
+// token - Отдаём переданный token или получаем его из source
+func (a *authorizedAdapter) token(ctx context.Context, token, realm string) (string, error) {
+	if token != "" {
+		return token, nil
+	}
+	return a.source.Token(ctx, realm)
+}
+
+func (a *authorizedAdapter) CreateUser(ctx context.Context, token, realm string, user userdata.User) (string, error) {
+	token, err := a.token(ctx, token, realm)
+	if err != nil {
+		return "", err
+	}
+	return a.UserAdapter.CreateUser(ctx, token, realm, user)
+}
+
+func (a *authorizedAdapter) GetUsers(ctx context.Context, token, realm string, params userdata.GetUsersParams) ([]*userdata.User, error) {
+	token, err := a.token(ctx, token, realm)
+	if err != nil {
+		return nil, err
+	}
+	return a.UserAdapter.GetUsers(ctx, token, realm, params)
+}
+
+func (a *authorizedAdapter) GetUserByID(ctx context.Context, accessToken, realm, userID string) (*userdata.User, error) {
+	accessToken, err := a.token(ctx, accessToken, realm)
+	if err != nil {
+		return nil, err
+	}
+	return a.UserAdapter.GetUserByID(ctx, accessToken, realm, userID)
+}
+
+func (a *authorizedAdapter) LoginClient(ctx context.Context, clientID, clientSecret, realm string, scopes ...string) (*userdata.JWT, error) {
+	if a.manager != nil {
+		return a.manager.LoginClient(ctx, clientID, clientSecret, realm, scopes...)
+	}
+	return a.UserAdapter.LoginClient(ctx, clientID, clientSecret, realm, scopes...)
+}
+
+func (a *authorizedAdapter) SetPassword(ctx context.Context, token, userID, realm, password string, temporary bool) error {
+	token, err := a.token(ctx, token, realm)
+	if err != nil {
+		return err
+	}
+	return a.UserAdapter.SetPassword(ctx, token, userID, realm, password, temporary)
+}
+
+func (a *authorizedAdapter) GetCredentials(ctx context.Context, token, realm, userID string) ([]*userdata.CredentialRepresentation, error) {
+	token, err := a.token(ctx, token, realm)
+	if err != nil {
+		return nil, err
+	}
+	return a.UserAdapter.GetCredentials(ctx, token, realm, userID)
+}
+
+func (a *authorizedAdapter) DeleteCredentials(ctx context.Context, token, realm, userID, credentialID string) error {
+	token, err := a.token(ctx, token, realm)
+	if err != nil {
+		return err
+	}
+	return a.UserAdapter.DeleteCredentials(ctx, token, realm, userID, credentialID)
+}
+
+func (a *authorizedAdapter) LogoutAllSessions(ctx context.Context, accessToken, realm, userID string) error {
+	accessToken, err := a.token(ctx, accessToken, realm)
+	if err != nil {
+		return err
+	}
+	return a.UserAdapter.LogoutAllSessions(ctx, accessToken, realm, userID)
+}
+
+func (a *authorizedAdapter) GetUserSessions(ctx context.Context, token, realm, userID string) ([]*userdata.UserSession, error) {
+	token, err := a.token(ctx, token, realm)
+	if err != nil {
+		return nil, err
+	}
+	return a.UserAdapter.GetUserSessions(ctx, token, realm, userID)
+}
+
+func (a *authorizedAdapter) LogoutUserSession(ctx context.Context, accessToken, realm, sessionID string) error {
+	accessToken, err := a.token(ctx, accessToken, realm)
+	if err != nil {
+		return err
+	}
+	return a.UserAdapter.LogoutUserSession(ctx, accessToken, realm, sessionID)
+}
+
+func (a *authorizedAdapter) UpdateUser(ctx context.Context, token, realm string, user userdata.User) error {
+	token, err := a.token(ctx, token, realm)
+	if err != nil {
+		return err
+	}
+	return a.UserAdapter.UpdateUser(ctx, token, realm, user)
+}
+
+func (a *authorizedAdapter) DeleteUser(ctx context.Context, token, realm, userID string) error {
+	token, err := a.token(ctx, token, realm)
+	if err != nil {
+		return err
+	}
+	return a.UserAdapter.DeleteUser(ctx, token, realm, userID)
+}
+
+func (a *authorizedAdapter) ExecuteActionsEmail(ctx context.Context, token, realm, userID string, actions []userdata.RequiredAction, params userdata.ExecuteActionsEmailParams) error {
+	token, err := a.token(ctx, token, realm)
+	if err != nil {
+		return err
+	}
+	return a.UserAdapter.ExecuteActionsEmail(ctx, token, realm, userID, actions, params)
+}
+
+func (a *authorizedAdapter) SendVerifyEmail(ctx context.Context, token, realm, userID string, params userdata.SendVerifyEmailParams) error {
+	token, err := a.token(ctx, token, realm)
+	if err != nil {
+		return err
+	}
+	return a.UserAdapter.SendVerifyEmail(ctx, token, realm, userID, params)
+}
+
+func (a *authorizedAdapter) GetUserGroups(ctx context.Context, token, realm, userID string) ([]*userdata.Group, error) {
+	token, err := a.token(ctx, token, realm)
+	if err != nil {
+		return nil, err
+	}
+	return a.UserAdapter.GetUserGroups(ctx, token, realm, userID)
+}
+
+func (a *authorizedAdapter) AddUserToGroup(ctx context.Context, token, realm, userID, groupID string) error {
+	token, err := a.token(ctx, token, realm)
+	if err != nil {
+		return err
+	}
+	return a.UserAdapter.AddUserToGroup(ctx, token, realm, userID, groupID)
+}
+
+func (a *authorizedAdapter) DeleteUserFromGroup(ctx context.Context, token, realm, userID, groupID string) error {
+	token, err := a.token(ctx, token, realm)
+	if err != nil {
+		return err
+	}
+	return a.UserAdapter.DeleteUserFromGroup(ctx, token, realm, userID, groupID)
+}
+
+func (a *authorizedAdapter) GetRealmRolesByUserID(ctx context.Context, token, realm, userID string) ([]*userdata.Role, error) {
+	token, err := a.token(ctx, token, realm)
+	if err != nil {
+		return nil, err
+	}
+	return a.UserAdapter.GetRealmRolesByUserID(ctx, token, realm, userID)
+}
+
+func (a *authorizedAdapter) GetCompositeRealmRolesByUserID(ctx context.Context, token, realm, userID string) ([]*userdata.Role, error) {
+	token, err := a.token(ctx, token, realm)
+	if err != nil {
+		return nil, err
+	}
+	return a.UserAdapter.GetCompositeRealmRolesByUserID(ctx, token, realm, userID)
+}
+
+func (a *authorizedAdapter) AddRealmRolesToUser(ctx context.Context, token, realm, userID string, roles []userdata.Role) error {
+	token, err := a.token(ctx, token, realm)
+	if err != nil {
+		return err
+	}
+	return a.UserAdapter.AddRealmRolesToUser(ctx, token, realm, userID, roles)
+}
+
+func (a *authorizedAdapter) DeleteRealmRolesFromUser(ctx context.Context, token, realm, userID string, roles []userdata.Role) error {
+	token, err := a.token(ctx, token, realm)
+	if err != nil {
+		return err
+	}
+	return a.UserAdapter.DeleteRealmRolesFromUser(ctx, token, realm, userID, roles)
+}
+
+func (a *authorizedAdapter) GetClientRolesByUserID(ctx context.Context, token, realm, idOfClient, userID string) ([]*userdata.Role, error) {
+	token, err := a.token(ctx, token, realm)
+	if err != nil {
+		return nil, err
+	}
+	return a.UserAdapter.GetClientRolesByUserID(ctx, token, realm, idOfClient, userID)
+}
+
+func (a *authorizedAdapter) GetCompositeClientRolesByUserID(ctx context.Context, token, realm, idOfClient, userID string) ([]*userdata.Role, error) {
+	token, err := a.token(ctx, token, realm)
+	if err != nil {
+		return nil, err
+	}
+	return a.UserAdapter.GetCompositeClientRolesByUserID(ctx, token, realm, idOfClient, userID)
+}
+
+func (a *authorizedAdapter) AddClientRolesToUser(ctx context.Context, token, realm, idOfClient, userID string, roles []userdata.Role) error {
+	token, err := a.token(ctx, token, realm)
+	if err != nil {
+		return err
+	}
+	return a.UserAdapter.AddClientRolesToUser(ctx, token, realm, idOfClient, userID, roles)
+}
+
+func (a *authorizedAdapter) DeleteClientRolesFromUser(ctx context.Context, token, realm, idOfClient, userID string, roles []userdata.Role) error {
+	token, err := a.token(ctx, token, realm)
+	if err != nil {
+		return err
+	}
+	return a.UserAdapter.DeleteClientRolesFromUser(ctx, token, realm, idOfClient, userID, roles)
+}
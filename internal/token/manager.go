@@ -0,0 +1,215 @@
+package token
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mtvy/cached_updater/internal/userdata"
+	"github.com/mtvy/cached_updater/pkg"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// defaultRefreshBefore - За сколько до истечения token обновляется, если не задано в Config
+	defaultRefreshBefore = 30 * time.Second
+	// defaultObtainTimeout - Таймаут получения token'а, если не задан в Config
+	defaultObtainTimeout = 10 * time.Second
+)
+
+// Source - Отдаёт действующий access token для realm'а
+type Source interface {
+	Token(ctx context.Context, realm string) (string, error)
+}
+
+// Config - Настройки manager
+type Config struct {
+	// За сколько до истечения token обновляется. Если не задано - используем defaultRefreshBefore
+	RefreshBefore time.Duration
+	// Таймаут общего получения token'а. Оно не отменяется вместе с вызвавшим его запросом,
+	// поэтому всегда ограничено по времени. Если не задан - используем defaultObtainTimeout
+	ObtainTimeout time.Duration
+}
+
+// cachedToken - Полученный token и моменты истечения access и refresh token
+type cachedToken struct {
+	jwt *userdata.JWT
+	// Момент, после которого token следует обновить
+	refreshAt time.Time
+	// Момент истечения access token
+	expiresAt time.Time
+	// Момент истечения refresh token, нулевой - refresh token нет
+	refreshExpiresAt time.Time
+}
+
+// manager - Получает service-account token'ы через LoginClient, хранит их
+// по client/realm/scopes и обновляет заранее, до истечения ExpiresIn
+type manager struct {
+	adapter pkg.UserAdapter
+	cfg     Config
+
+	sync.RWMutex
+	// Ключ - tokenKey, значение - последний полученный token
+	tokens map[string]*cachedToken
+	// Объединяет одновременные обновления одного token
+	group singleflight.Group
+}
+
+func NewManager(adapter pkg.UserAdapter, cfg Config) *manager {
+	if cfg.RefreshBefore <= 0 {
+		cfg.RefreshBefore = defaultRefreshBefore
+	}
+	if cfg.ObtainTimeout <= 0 {
+		cfg.ObtainTimeout = defaultObtainTimeout
+	}
+	return &manager{
+		adapter: adapter,
+		cfg:     cfg,
+		tokens:  make(map[string]*cachedToken),
+	}
+}
+
+// tokenKey - Ключ token: client, realm и отсортированные scopes
+func tokenKey(clientID, realm string, scopes []string) string {
+	sorted := append([]string(nil), scopes...)
+	sort.Strings(sorted)
+	return clientID + "/" + realm + "/" + strings.Join(sorted, " ")
+}
+
+// LoginClient - Отдаём сохранённый token или получаем новый. Сигнатура совпадает
+// с pkg.UserAdapter.LoginClient, поэтому manager подменяет его без изменений у вызывающих
+func (m *manager) LoginClient(ctx context.Context, clientID, clientSecret, realm string, scopes ...string) (*userdata.JWT, error) {
+	key := tokenKey(clientID, realm, scopes)
+	m.RLock()
+	cached, ok := m.tokens[key]
+	m.RUnlock()
+	if ok && time.Now().Before(cached.refreshAt) {
+		return copyJWT(cached.jwt), nil
+	}
+
+	// Получение общее для всех ждущих, поэтому отмена ctx первого из них его не прерывает
+	resultCh := m.group.DoChan(key, func() (interface{}, error) {
+		obtainCtx, cancel := context.WithTimeout(valueOnlyContext{ctx}, m.cfg.ObtainTimeout)
+		defer cancel()
+		jwt, err := m.obtain(obtainCtx, cached, clientID, clientSecret, realm, scopes)
+		if err != nil {
+			return nil, err
+		}
+		m.Lock()
+		m.tokens[key] = m.newCachedToken(jwt)
+		m.Unlock()
+		return jwt, nil
+	})
+	var (
+		result interface{}
+		err    error
+	)
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case res := <-resultCh:
+		result, err = res.Val, res.Err
+	}
+	if err != nil {
+		// Обновить не удалось, но старый token ещё действует
+		if ok && time.Now().Before(cached.expiresAt) {
+			return copyJWT(cached.jwt), nil
+		}
+		return nil, err
+	}
+	return copyJWT(result.(*userdata.JWT)), nil
+}
+
+// obtain - Обновляем token по refresh token, если он ещё действует.
+// Иначе или при ошибке обновления логинимся заново
+func (m *manager) obtain(ctx context.Context, cached *cachedToken, clientID, clientSecret, realm string, scopes []string) (*userdata.JWT, error) {
+	if cached != nil && cached.jwt.RefreshToken != "" && time.Now().Before(cached.refreshExpiresAt) {
+		jwt, err := m.adapter.RefreshToken(ctx, cached.jwt.RefreshToken, clientID, clientSecret, realm)
+		if err == nil && jwt != nil {
+			return jwt, nil
+		}
+	}
+	return m.adapter.LoginClient(ctx, clientID, clientSecret, realm, scopes...)
+}
+
+func (m *manager) newCachedToken(jwt *userdata.JWT) *cachedToken {
+	now := time.Now()
+	expiresIn := time.Duration(jwt.ExpiresIn) * time.Second
+	refreshBefore := m.cfg.RefreshBefore
+	// Короткоживущий token обновляем на второй половине его жизни
+	if refreshBefore > expiresIn/2 {
+		refreshBefore = expiresIn / 2
+	}
+	cached := &cachedToken{
+		jwt:       jwt,
+		refreshAt: now.Add(expiresIn - refreshBefore),
+		expiresAt: now.Add(expiresIn),
+	}
+	if jwt.RefreshToken != "" && jwt.RefreshExpiresIn > 0 {
+		cached.refreshExpiresAt = now.Add(time.Duration(jwt.RefreshExpiresIn) * time.Second)
+	}
+	return cached
+}
+
+// Forget - Удаляем сохранённые token'ы client'а в realm'е, например после 401 от keycloak
+func (m *manager) Forget(clientID, realm string) {
+	prefix := clientID + "/" + realm + "/"
+	m.Lock()
+	defer m.Unlock()
+	for key := range m.tokens {
+		if strings.HasPrefix(key, prefix) {
+			delete(m.tokens, key)
+		}
+	}
+}
+
+// Source - Source, отдающий token'ы service-account'а clientID
+func (m *manager) Source(clientID, clientSecret string, scopes ...string) Source {
+	return &clientSource{
+		manager:      m,
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		scopes:       scopes,
+	}
+}
+
+// clientSource - Source одного service-account'а
+type clientSource struct {
+	manager      *manager
+	clientID     string
+	clientSecret string
+	scopes       []string
+}
+
+func (s *clientSource) Token(ctx context.Context, realm string) (string, error) {
+	jwt, err := s.manager.LoginClient(ctx, s.clientID, s.clientSecret, realm, s.scopes...)
+	if err != nil {
+		return "", err
+	}
+	return jwt.AccessToken, nil
+}
+
+// valueOnlyContext - Контекст со значениями родителя, но без его deadline и отмены
+type valueOnlyContext struct {
+	context.Context
+}
+
+func (valueOnlyContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (valueOnlyContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (valueOnlyContext) Err() error {
+	return nil
+}
+
+// copyJWT - Копия token, чтобы вызывающий не менял сохранённый
+func copyJWT(jwt *userdata.JWT) *userdata.JWT {
+	copied := *jwt
+	return &copied
+}
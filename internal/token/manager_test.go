@@ -0,0 +1,191 @@
+package token
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mtvy/cached_updater/internal/userdata"
+	"github.com/mtvy/cached_updater/pkg"
+	"github.com/stretchr/testify/require"
+)
+
+const testRealm = "test"
+
+// testAdapter - Выдаёт token'ы с порядковым номером и запоминает token последнего GetUserByID
+type testAdapter struct {
+	pkg.UserAdapter
+	// Время жизни выдаваемых token'ов в секундах
+	expiresIn int
+	// Ошибка, которую вернёт RefreshToken
+	refreshErr error
+	logins     atomic.Int64
+	refreshes  atomic.Int64
+	lastToken  string
+	// Если задан - LoginClient ждёт его закрытия
+	release chan struct{}
+}
+
+func (a *testAdapter) LoginClient(ctx context.Context, clientID, clientSecret, realm string, scopes ...string) (*userdata.JWT, error) {
+	n := a.logins.Add(1)
+	if a.release != nil {
+		<-a.release
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return &userdata.JWT{
+		AccessToken:      "login-" + strconv.FormatInt(n, 10),
+		ExpiresIn:        a.expiresIn,
+		RefreshToken:     "refresh",
+		RefreshExpiresIn: 60,
+	}, nil
+}
+
+func (a *testAdapter) GetUserByID(ctx context.Context, accessToken, realm, userID string) (*userdata.User, error) {
+	a.lastToken = accessToken
+	return &userdata.User{ID: &userID}, nil
+}
+
+func (a *testAdapter) RefreshToken(ctx context.Context, refreshToken, clientID, clientSecret, realm string) (*userdata.JWT, error) {
+	if a.refreshErr != nil {
+		return nil, a.refreshErr
+	}
+	n := a.refreshes.Add(1)
+	return &userdata.JWT{
+		AccessToken:      "refresh-" + strconv.FormatInt(n, 10),
+		ExpiresIn:        a.expiresIn,
+		RefreshToken:     refreshToken,
+		RefreshExpiresIn: 60,
+	}, nil
+}
+
+func TestManager(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("token получаем один раз на client, realm и scopes", func(t *testing.T) {
+		adapter := &testAdapter{expiresIn: 300}
+		manager := NewManager(adapter, Config{})
+
+		for i := 0; i < 3; i++ {
+			jwt, err := manager.LoginClient(ctx, "client", "secret", testRealm, "b", "a")
+			require.NoError(t, err)
+			require.Equal(t, "login-1", jwt.AccessToken)
+		}
+		// Порядок scopes не важен
+		_, err := manager.LoginClient(ctx, "client", "secret", testRealm, "a", "b")
+		require.NoError(t, err)
+		require.EqualValues(t, 1, adapter.logins.Load())
+
+		_, err = manager.LoginClient(ctx, "client", "secret", "other")
+		require.NoError(t, err)
+		require.EqualValues(t, 2, adapter.logins.Load())
+	})
+
+	t.Run("истекающий token обновляем по refresh token", func(t *testing.T) {
+		adapter := &testAdapter{expiresIn: 0}
+		manager := NewManager(adapter, Config{})
+
+		source := manager.Source("client", "secret")
+		token, err := source.Token(ctx, testRealm)
+		require.NoError(t, err)
+		require.Equal(t, "login-1", token)
+		token, err = source.Token(ctx, testRealm)
+		require.NoError(t, err)
+		require.Equal(t, "refresh-1", token)
+		require.EqualValues(t, 1, adapter.logins.Load())
+	})
+
+	t.Run("при ошибке RefreshToken логинимся заново", func(t *testing.T) {
+		adapter := &testAdapter{expiresIn: 0, refreshErr: errors.New("refresh token expired")}
+		manager := NewManager(adapter, Config{})
+
+		for i := 0; i < 2; i++ {
+			_, err := manager.LoginClient(ctx, "client", "secret", testRealm)
+			require.NoError(t, err)
+		}
+		require.EqualValues(t, 2, adapter.logins.Load())
+	})
+
+	t.Run("Forget сбрасывает сохранённый token", func(t *testing.T) {
+		adapter := &testAdapter{expiresIn: 300}
+		manager := NewManager(adapter, Config{})
+
+		_, err := manager.LoginClient(ctx, "client", "secret", testRealm)
+		require.NoError(t, err)
+		manager.Forget("client", testRealm)
+		_, err = manager.LoginClient(ctx, "client", "secret", testRealm)
+		require.NoError(t, err)
+		require.EqualValues(t, 2, adapter.logins.Load())
+	})
+}
+
+func TestManagerLeaderCancel(t *testing.T) {
+	adapter := &testAdapter{expiresIn: 300, release: make(chan struct{})}
+	manager := NewManager(adapter, Config{})
+
+	leaderCtx, cancel := context.WithCancel(context.Background())
+	leaderErr := make(chan error, 1)
+	go func() {
+		_, err := manager.LoginClient(leaderCtx, "client", "secret", testRealm)
+		leaderErr <- err
+	}()
+	require.Eventually(t, func() bool { return adapter.logins.Load() == 1 }, time.Second, time.Millisecond)
+
+	var waiterJWT *userdata.JWT
+	waiterErr := make(chan error, 1)
+	go func() {
+		jwt, err := manager.LoginClient(context.Background(), "client", "secret", testRealm)
+		waiterJWT = jwt
+		waiterErr <- err
+	}()
+
+	// Отмена первого вызова не прерывает общий логин
+	cancel()
+	require.ErrorIs(t, <-leaderErr, context.Canceled)
+	close(adapter.release)
+	require.NoError(t, <-waiterErr)
+	require.Equal(t, "login-1", waiterJWT.AccessToken)
+	require.EqualValues(t, 1, adapter.logins.Load())
+}
+
+func TestAuthorizedAdapter(t *testing.T) {
+	ctx := context.Background()
+	adapter := &testAdapter{expiresIn: 300}
+	authorized := NewAuthorizedAdapter(adapter, NewManager(adapter, Config{}).Source("client", "secret"))
+
+	testCases := []struct {
+		name      string
+		token     string
+		wantToken string
+	}{
+		{
+			name:      "пустой token подставляется из Source",
+			token:     "",
+			wantToken: "login-1",
+		},
+		{
+			name:      "явно переданный token используется как есть",
+			token:     "explicit",
+			wantToken: "explicit",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := authorized.GetUserByID(ctx, tc.token, testRealm, "1")
+			require.NoError(t, err)
+			require.Equal(t, tc.wantToken, adapter.lastToken)
+		})
+	}
+
+	t.Run("LoginClient обёртки отдаёт сохранённый token", func(t *testing.T) {
+		jwt, err := authorized.LoginClient(ctx, "client", "secret", testRealm)
+		require.NoError(t, err)
+		require.Equal(t, "login-1", jwt.AccessToken)
+		require.EqualValues(t, 1, adapter.logins.Load())
+	})
+}
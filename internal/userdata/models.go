@@ -1,5 +1,7 @@
 package userdata
 
+import "time"
+
 type User struct {
 	ID                         *string
 	CreatedTimestamp           *int64
@@ -22,6 +24,12 @@ type User struct {
 	Credentials                *[]CredentialRepresentation
 }
 
+// WithoutSecrets - Копия user'а без credentials: пароли и секреты не должны попадать в cache
+func (user User) WithoutSecrets() User {
+	user.Credentials = nil
+	return user
+}
+
 func (user *User) SetSiteClientID(siteClientID string) {
 	if user.Attributes == nil {
 		attr := make(map[string][]string, 0)
@@ -78,6 +86,105 @@ type JWT struct {
 	Scope            string
 }
 
+type Group struct {
+	ID          *string
+	Name        *string
+	Path        *string
+	Attributes  *map[string][]string
+	ClientRoles *map[string][]string
+	RealmRoles  *[]string
+}
+
+type Role struct {
+	ID          *string
+	Name        *string
+	Description *string
+	Composite   *bool
+	ClientRole  *bool
+	// Для роли client'а - id client'а, для роли realm'а - id realm'а
+	ContainerID *string
+}
+
+// EffectiveRoles - Роли user'а с учётом групп и composite ролей
+type EffectiveRoles struct {
+	RealmRoles []string
+	// Ключ - id client'а, значение - имена его ролей
+	ClientRoles map[string][]string
+}
+
+// RequiredAction - Действие, которое user должен выполнить при следующем входе
+type RequiredAction string
+
+const (
+	RequiredActionVerifyEmail        RequiredAction = "VERIFY_EMAIL"
+	RequiredActionUpdatePassword     RequiredAction = "UPDATE_PASSWORD"
+	RequiredActionUpdateProfile      RequiredAction = "UPDATE_PROFILE"
+	RequiredActionUpdateEmail        RequiredAction = "UPDATE_EMAIL"
+	RequiredActionConfigureTOTP      RequiredAction = "CONFIGURE_TOTP"
+	RequiredActionTermsAndConditions RequiredAction = "TERMS_AND_CONDITIONS"
+	RequiredActionWebAuthnRegister   RequiredAction = "webauthn-register"
+)
+
+// ExecuteActionsEmailParams - Параметры письма с required actions
+type ExecuteActionsEmailParams struct {
+	// Client и адрес, куда keycloak вернёт user'а после выполнения действий
+	ClientID    *string
+	RedirectURI *string
+	// Время жизни ссылки в секундах
+	Lifespan *int
+}
+
+// SendVerifyEmailParams - Параметры письма с подтверждением email
+type SendVerifyEmailParams struct {
+	ClientID    *string
+	RedirectURI *string
+}
+
+// UserSession - Активная сессия user'а
+type UserSession struct {
+	ID        *string
+	UserID    *string
+	Username  *string
+	IPAddress *string
+	// Время начала сессии и последнего обращения в миллисекундах
+	Start      *int64
+	LastAccess *int64
+	// Ключ - id client'а, значение - clientID
+	Clients *map[string]string
+}
+
+// TokenClaims - Проверенные claims access token'а
+type TokenClaims struct {
+	Subject           string
+	Issuer            string
+	Audience          []string
+	AuthorizedParty   string
+	PreferredUsername string
+	ExpiresAt         time.Time
+	// Роли realm'а из realm_access
+	RealmRoles []string
+	// Ключ - clientID, значение - роли client'а из resource_access
+	ClientRoles map[string][]string
+}
+
+func (claims *TokenClaims) HasRealmRole(role string) bool {
+	for _, r := range claims.RealmRoles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+func (claims *TokenClaims) HasClientRole(clientID, role string) bool {
+	for _, r := range claims.ClientRoles[clientID] {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
 type GetUsersParams struct {
 	BriefRepresentation *bool
 	Email               *string
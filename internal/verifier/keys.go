@@ -0,0 +1,85 @@
+package verifier
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"math/big"
+
+	"github.com/Nerzal/gocloak/v13"
+)
+
+// errUnsupportedKey - Ключ JWKS не RSA и не EC P-256
+var errUnsupportedKey = errors.New("unsupported jwks key")
+
+// parseKeys - Переводим JWKS к публичным ключам по kid. Ключи, которые не разобрать, пропускаем
+func parseKeys(certs *gocloak.CertResponse) map[string]crypto.PublicKey {
+	keys := make(map[string]crypto.PublicKey)
+	if certs == nil || certs.Keys == nil {
+		return keys
+	}
+	for _, cert := range *certs.Keys {
+		if cert.Kid == nil || (cert.Use != nil && *cert.Use != "sig") {
+			continue
+		}
+		key, err := parseKey(cert)
+		if err != nil {
+			continue
+		}
+		keys[*cert.Kid] = key
+	}
+	return keys
+}
+
+func parseKey(cert gocloak.CertResponseKey) (crypto.PublicKey, error) {
+	if cert.Kty == nil {
+		return nil, errUnsupportedKey
+	}
+	switch *cert.Kty {
+	case "RSA":
+		if cert.N == nil || cert.E == nil {
+			return nil, errUnsupportedKey
+		}
+		n, err := decodeBigInt(*cert.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(*cert.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() {
+			return nil, errUnsupportedKey
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if cert.Crv == nil || *cert.Crv != "P-256" || cert.X == nil || cert.Y == nil {
+			return nil, errUnsupportedKey
+		}
+		x, err := decodeBigInt(*cert.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(*cert.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+		if !key.Curve.IsOnCurve(x, y) {
+			return nil, errUnsupportedKey
+		}
+		return key, nil
+	}
+	return nil, errUnsupportedKey
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(data), nil
+}
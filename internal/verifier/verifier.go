@@ -0,0 +1,225 @@
+package verifier
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Nerzal/gocloak/v13"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/mtvy/cached_updater/internal/userdata"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// defaultKeysTTL - Сколько доверяем полученному JWKS, если не задано в Config
+	defaultKeysTTL = 10 * time.Minute
+	// defaultMinRefreshInterval - Не чаще скольких раз перезапрашиваем JWKS из-за незнакомого kid
+	defaultMinRefreshInterval = 10 * time.Second
+)
+
+var (
+	// ErrInvalidToken - Token не разобрать или подпись не сходится
+	ErrInvalidToken = errors.New("invalid token")
+	// ErrUnknownKey - Token подписан ключом, которого нет в JWKS realm'а
+	ErrUnknownKey = errors.New("token signed with unknown key")
+	// ErrTokenExpired - Истёк exp
+	ErrTokenExpired = errors.New("token is expired")
+	// ErrTokenNotYetValid - Не наступил nbf
+	ErrTokenNotYetValid = errors.New("token is not valid yet")
+	// ErrInvalidIssuer - iss не соответствует realm'у
+	ErrInvalidIssuer = errors.New("token issuer mismatch")
+	// ErrInvalidAudience - В aud нет ожидаемого client'а
+	ErrInvalidAudience = errors.New("token audience mismatch")
+)
+
+// KeySource - Откуда берём JWKS realm'а, например keycloak repository
+type KeySource interface {
+	GetJWKS(ctx context.Context, realm string) (*gocloak.CertResponse, error)
+}
+
+// Config - Настройки verifier
+type Config struct {
+	// Адрес keycloak, из которого собирается ожидаемый iss: {IssuerBase}/realms/{realm}.
+	// Пустой - iss не проверяется
+	IssuerBase string
+	// Client, который должен быть в aud. Пустой - aud не проверяется
+	Audience string
+	// Допустимое расхождение часов при проверке exp и nbf
+	Leeway time.Duration
+	// Сколько доверяем полученному JWKS, если не задано - defaultKeysTTL
+	KeysTTL time.Duration
+	// Минимальный интервал между перезапросами JWKS, если не задан - defaultMinRefreshInterval
+	MinRefreshInterval time.Duration
+}
+
+// keycloakClaims - Claims access token'а keycloak
+type keycloakClaims struct {
+	jwt.RegisteredClaims
+	AuthorizedParty   string `json:"azp"`
+	PreferredUsername string `json:"preferred_username"`
+	RealmAccess       struct {
+		Roles []string `json:"roles"`
+	} `json:"realm_access"`
+	ResourceAccess map[string]struct {
+		Roles []string `json:"roles"`
+	} `json:"resource_access"`
+}
+
+// realmKeys - JWKS realm'а
+type realmKeys struct {
+	// Ключ - kid, значение - публичный ключ
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+}
+
+// verifier - Проверяет access token'ы локально по JWKS realm'а: подпись RS256/ES256,
+// exp, nbf, iss и aud. JWKS хранится в памяти и перезапрашивается по KeysTTL
+// или при появлении незнакомого kid после ротации ключей
+type verifier struct {
+	source KeySource
+	cfg    Config
+	parser *jwt.Parser
+
+	sync.RWMutex
+	// Ключ - realm, значение - его JWKS
+	realms map[string]*realmKeys
+	// Объединяет одновременные запросы JWKS одного realm'а
+	group singleflight.Group
+}
+
+func New(source KeySource, cfg Config) *verifier {
+	if cfg.KeysTTL <= 0 {
+		cfg.KeysTTL = defaultKeysTTL
+	}
+	if cfg.MinRefreshInterval <= 0 {
+		cfg.MinRefreshInterval = defaultMinRefreshInterval
+	}
+	return &verifier{
+		source: source,
+		cfg:    cfg,
+		// Сроки и издателя проверяем сами, чтобы учесть Leeway и realm
+		parser: jwt.NewParser(jwt.WithValidMethods([]string{"RS256", "ES256"}), jwt.WithoutClaimsValidation()),
+		realms: make(map[string]*realmKeys),
+	}
+}
+
+// VerifyToken - Проверяем token realm'а и отдаём его claims
+func (v *verifier) VerifyToken(ctx context.Context, accessToken, realm string) (*userdata.TokenClaims, error) {
+	var claims keycloakClaims
+	_, err := v.parser.ParseWithClaims(accessToken, &claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return v.key(ctx, realm, kid)
+	})
+	if err != nil {
+		if errors.Is(err, ErrUnknownKey) {
+			return nil, ErrUnknownKey
+		}
+		return nil, fmt.Errorf("%w: %s", ErrInvalidToken, err)
+	}
+	if err := v.validate(&claims, realm); err != nil {
+		return nil, err
+	}
+	return claimsToService(&claims), nil
+}
+
+// validate - Проверяем exp, nbf, iss и aud
+func (v *verifier) validate(claims *keycloakClaims, realm string) error {
+	now := time.Now()
+	if claims.ExpiresAt == nil || !now.Before(claims.ExpiresAt.Add(v.cfg.Leeway)) {
+		return ErrTokenExpired
+	}
+	if claims.NotBefore != nil && now.Add(v.cfg.Leeway).Before(claims.NotBefore.Time) {
+		return ErrTokenNotYetValid
+	}
+	if v.cfg.IssuerBase != "" && claims.Issuer != strings.TrimRight(v.cfg.IssuerBase, "/")+"/realms/"+realm {
+		return ErrInvalidIssuer
+	}
+	if v.cfg.Audience != "" && !claims.VerifyAudience(v.cfg.Audience, true) {
+		return ErrInvalidAudience
+	}
+	return nil
+}
+
+// key - Достаём ключ по kid. Незнакомый kid или устаревший JWKS - повод перезапросить JWKS,
+// но не чаще MinRefreshInterval
+func (v *verifier) key(ctx context.Context, realm, kid string) (crypto.PublicKey, error) {
+	v.RLock()
+	keys, ok := v.realms[realm]
+	v.RUnlock()
+	if ok {
+		key, found := keys.keys[kid]
+		age := time.Since(keys.fetchedAt)
+		if found && age < v.cfg.KeysTTL {
+			return key, nil
+		}
+		if age < v.cfg.MinRefreshInterval {
+			if found {
+				return key, nil
+			}
+			return nil, ErrUnknownKey
+		}
+	}
+
+	fetched, err := v.refresh(ctx, realm)
+	if err != nil {
+		// JWKS не обновился, но ключ из прошлого JWKS ещё можно использовать
+		if ok {
+			if key, found := keys.keys[kid]; found {
+				return key, nil
+			}
+		}
+		return nil, err
+	}
+	key, found := fetched.keys[kid]
+	if !found {
+		return nil, ErrUnknownKey
+	}
+	return key, nil
+}
+
+// refresh - Запрашиваем JWKS realm'а, параллельные запросы ждут один поход
+func (v *verifier) refresh(ctx context.Context, realm string) (*realmKeys, error) {
+	result, err, _ := v.group.Do(realm, func() (interface{}, error) {
+		certs, err := v.source.GetJWKS(ctx, realm)
+		if err != nil {
+			return nil, err
+		}
+		keys := &realmKeys{
+			keys:      parseKeys(certs),
+			fetchedAt: time.Now(),
+		}
+		v.Lock()
+		v.realms[realm] = keys
+		v.Unlock()
+		return keys, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result.(*realmKeys), nil
+}
+
+// claimsToService - переводим keycloakClaims к *userdata.TokenClaims
+func claimsToService(claims *keycloakClaims) *userdata.TokenClaims {
+	result := &userdata.TokenClaims{
+		Subject:           claims.Subject,
+		Issuer:            claims.Issuer,
+		Audience:          claims.Audience,
+		AuthorizedParty:   claims.AuthorizedParty,
+		PreferredUsername: claims.PreferredUsername,
+		RealmRoles:        claims.RealmAccess.Roles,
+		ClientRoles:       make(map[string][]string, len(claims.ResourceAccess)),
+	}
+	if claims.ExpiresAt != nil {
+		result.ExpiresAt = claims.ExpiresAt.Time
+	}
+	for clientID, access := range claims.ResourceAccess {
+		result.ClientRoles[clientID] = access.Roles
+	}
+	return result
+}
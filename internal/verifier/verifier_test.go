@@ -0,0 +1,201 @@
+package verifier
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Nerzal/gocloak/v13"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/mtvy/cached_updater/internal/keycloak"
+	"github.com/stretchr/testify/require"
+)
+
+const testRealm = "test"
+
+// testKeycloak - Отдаёт JWKS realm'а из текущего набора ключей
+type testKeycloak struct {
+	sync.Mutex
+	keys     []gocloak.CertResponseKey
+	requests atomic.Int64
+}
+
+func (k *testKeycloak) setKeys(keys ...gocloak.CertResponseKey) {
+	k.Lock()
+	defer k.Unlock()
+	k.keys = keys
+}
+
+func (k *testKeycloak) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	k.requests.Add(1)
+	k.Lock()
+	defer k.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(gocloak.CertResponse{Keys: &k.keys})
+}
+
+func encodeBigInt(value *big.Int) *string {
+	encoded := base64.RawURLEncoding.EncodeToString(value.Bytes())
+	return &encoded
+}
+
+func rsaJWK(kid string, key *rsa.PrivateKey) gocloak.CertResponseKey {
+	return gocloak.CertResponseKey{
+		Kid: &kid,
+		Kty: gocloak.StringP("RSA"),
+		Use: gocloak.StringP("sig"),
+		N:   encodeBigInt(key.N),
+		E:   encodeBigInt(big.NewInt(int64(key.E))),
+	}
+}
+
+func ecJWK(kid string, key *ecdsa.PrivateKey) gocloak.CertResponseKey {
+	return gocloak.CertResponseKey{
+		Kid: &kid,
+		Kty: gocloak.StringP("EC"),
+		Use: gocloak.StringP("sig"),
+		Crv: gocloak.StringP("P-256"),
+		X:   encodeBigInt(key.X),
+		Y:   encodeBigInt(key.Y),
+	}
+}
+
+func TestVerifier(t *testing.T) {
+	ctx := context.Background()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	rotatedKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	kc := &testKeycloak{}
+	kc.setKeys(rsaJWK("rsa", rsaKey), ecJWK("ec", ecKey))
+	mux := http.NewServeMux()
+	mux.Handle("/realms/"+testRealm+"/protocol/openid-connect/certs", kc)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	repo := keycloak.NewRepository(gocloak.NewClient(server.URL), server.URL)
+	v := New(repo, Config{IssuerBase: server.URL, Audience: "service", MinRefreshInterval: time.Nanosecond})
+
+	issuer := server.URL + "/realms/" + testRealm
+	validClaims := func() jwt.MapClaims {
+		return jwt.MapClaims{
+			"sub":             "user-id",
+			"iss":             issuer,
+			"aud":             []string{"account", "service"},
+			"exp":             time.Now().Add(time.Minute).Unix(),
+			"realm_access":    map[string]interface{}{"roles": []string{"offline_access"}},
+			"resource_access": map[string]interface{}{"realm-management": map[string]interface{}{"roles": []string{"view-users"}}},
+		}
+	}
+	sign := func(method jwt.SigningMethod, kid string, key interface{}, claims jwt.MapClaims) string {
+		token := jwt.NewWithClaims(method, claims)
+		token.Header["kid"] = kid
+		signed, err := token.SignedString(key)
+		require.NoError(t, err)
+		return signed
+	}
+	withClaim := func(key string, value interface{}) jwt.MapClaims {
+		claims := validClaims()
+		claims[key] = value
+		return claims
+	}
+
+	testCases := []struct {
+		name    string
+		token   string
+		wantErr error
+	}{
+		{
+			name:  "RS256",
+			token: sign(jwt.SigningMethodRS256, "rsa", rsaKey, validClaims()),
+		},
+		{
+			name:  "ES256",
+			token: sign(jwt.SigningMethodES256, "ec", ecKey, validClaims()),
+		},
+		{
+			name:    "подпись чужим ключом",
+			token:   sign(jwt.SigningMethodRS256, "rsa", rotatedKey, validClaims()),
+			wantErr: ErrInvalidToken,
+		},
+		{
+			name:    "незнакомый kid",
+			token:   sign(jwt.SigningMethodRS256, "unknown", rsaKey, validClaims()),
+			wantErr: ErrUnknownKey,
+		},
+		{
+			name:    "HS256 не принимаем",
+			token:   sign(jwt.SigningMethodHS256, "rsa", []byte("secret"), validClaims()),
+			wantErr: ErrInvalidToken,
+		},
+		{
+			name:    "истёкший token",
+			token:   sign(jwt.SigningMethodRS256, "rsa", rsaKey, withClaim("exp", time.Now().Add(-time.Minute).Unix())),
+			wantErr: ErrTokenExpired,
+		},
+		{
+			name:    "nbf в будущем",
+			token:   sign(jwt.SigningMethodRS256, "rsa", rsaKey, withClaim("nbf", time.Now().Add(time.Minute).Unix())),
+			wantErr: ErrTokenNotYetValid,
+		},
+		{
+			name:    "token другого realm'а",
+			token:   sign(jwt.SigningMethodRS256, "rsa", rsaKey, withClaim("iss", server.URL+"/realms/other")),
+			wantErr: ErrInvalidIssuer,
+		},
+		{
+			name:    "token чужого keycloak с тем же realm'ом",
+			token:   sign(jwt.SigningMethodRS256, "rsa", rsaKey, withClaim("iss", "https://evil.example/realms/"+testRealm)),
+			wantErr: ErrInvalidIssuer,
+		},
+		{
+			name:    "token другого client'а",
+			token:   sign(jwt.SigningMethodRS256, "rsa", rsaKey, withClaim("aud", "account")),
+			wantErr: ErrInvalidAudience,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			claims, err := v.VerifyToken(ctx, tc.token, testRealm)
+			require.ErrorIs(t, err, tc.wantErr)
+			if tc.wantErr != nil {
+				return
+			}
+			require.Equal(t, "user-id", claims.Subject)
+			require.Equal(t, []string{"offline_access"}, claims.RealmRoles)
+			require.True(t, claims.HasClientRole("realm-management", "view-users"))
+		})
+	}
+
+	t.Run("JWKS кэшируется", func(t *testing.T) {
+		cached := New(repo, Config{})
+		kc.requests.Store(0)
+		for i := 0; i < 3; i++ {
+			_, err := cached.VerifyToken(ctx, sign(jwt.SigningMethodRS256, "rsa", rsaKey, validClaims()), testRealm)
+			require.NoError(t, err)
+		}
+		require.EqualValues(t, 1, kc.requests.Load())
+	})
+
+	t.Run("после ротации ключей JWKS перезапрашивается", func(t *testing.T) {
+		kc.setKeys(rsaJWK("rotated", rotatedKey))
+
+		claims, err := v.VerifyToken(ctx, sign(jwt.SigningMethodRS256, "rotated", rotatedKey, validClaims()), testRealm)
+		require.NoError(t, err)
+		require.Equal(t, "user-id", claims.Subject)
+	})
+}
@@ -0,0 +1,58 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Категории ошибок keycloak. Проверяются через errors.Is, подробности ответа достаются через errors.As с *KeycloakError
+var (
+	// ErrNotFound - Запрошенного объекта нет в keycloak
+	ErrNotFound = errors.New("not found")
+	// ErrConflict - Объект уже есть в keycloak, например user с таким же email или username
+	ErrConflict = errors.New("conflict")
+	// ErrUnauthorized - Token или учётные данные не приняты
+	ErrUnauthorized = errors.New("unauthorized")
+	// ErrForbidden - Не хватает прав на операцию
+	ErrForbidden = errors.New("forbidden")
+	// ErrRateLimited - Keycloak ограничил частоту запросов
+	ErrRateLimited = errors.New("rate limited")
+	// ErrTransport - Keycloak не ответил: сеть, таймаут, отмена запроса
+	ErrTransport = errors.New("keycloak transport failure")
+)
+
+// ErrUserNotFound - User'а нет в keycloak, errors.Is(ErrUserNotFound, ErrNotFound) == true
+var ErrUserNotFound = fmt.Errorf("user %w", ErrNotFound)
+
+// ErrNoCachedUser - User'а нет в cache, это не значит, что его нет в keycloak
+var ErrNoCachedUser = errors.New("no cached user")
+
+// KeycloakError - Ошибка ответа keycloak.
+// errors.Is сравнивает её с Kind, errors.As позволяет достать код ответа
+type KeycloakError struct {
+	// HTTP-код ответа keycloak, 0 - keycloak не ответил
+	Code int
+	// Категория ошибки: ErrNotFound, ErrConflict и т.д., nil - код не попал ни в одну категорию
+	Kind error
+	// Исходная ошибка клиента keycloak
+	Err error
+}
+
+func (e *KeycloakError) Error() string {
+	message := fmt.Sprintf("keycloak error %d", e.Code)
+	if e.Err != nil {
+		message = e.Err.Error()
+	}
+	if e.Kind == nil {
+		return message
+	}
+	return e.Kind.Error() + ": " + message
+}
+
+func (e *KeycloakError) Is(target error) bool {
+	return e.Kind != nil && errors.Is(e.Kind, target)
+}
+
+func (e *KeycloakError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,37 @@
+package pkg
+
+import (
+	"strings"
+
+	"github.com/mtvy/cached_updater/internal/userdata"
+)
+
+// IndexUsername - Имя индекса cache по username, остальные индексы строятся по атрибутам user'а
+const IndexUsername = "username"
+
+// IndexValue - Приводим значение к виду, в котором оно хранится в индексе.
+// Keycloak хранит username в нижнем регистре
+func IndexValue(index, value string) string {
+	if index == IndexUsername {
+		return strings.ToLower(value)
+	}
+	return value
+}
+
+// IndexValues - Достаём значения user'а для индекса
+func IndexValues(user userdata.User, index string) []string {
+	if index == IndexUsername {
+		if user.Username == nil {
+			return nil
+		}
+		return []string{IndexValue(index, *user.Username)}
+	}
+	if user.Attributes == nil {
+		return nil
+	}
+	values := (*user.Attributes)[index]
+	if len(values) == 0 {
+		return nil
+	}
+	return append([]string(nil), values...)
+}
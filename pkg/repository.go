@@ -19,7 +19,45 @@ type UserAdapter interface {
 	GetCredentials(ctx context.Context, token, realm, userID string) ([]*userdata.CredentialRepresentation, error)
 	DeleteCredentials(ctx context.Context, token, realm, userID, credentialID string) error
 	LogoutAllSessions(ctx context.Context, accessToken, realm, userID string) error
+	// GetUserSessions - Получаем активные сессии user'а
+	GetUserSessions(ctx context.Context, token, realm, userID string) ([]*userdata.UserSession, error)
+	// LogoutUserSession - Завершаем одну сессию по её id
+	LogoutUserSession(ctx context.Context, accessToken, realm, sessionID string) error
+	// Logout - Завершаем сессию, которой выдан refresh token
+	Logout(ctx context.Context, clientID, clientSecret, realm, refreshToken string) error
+	// RefreshToken - Обновляем token по refresh token
+	RefreshToken(ctx context.Context, refreshToken, clientID, clientSecret, realm string) (*userdata.JWT, error)
 	Login(ctx context.Context, clientID, clientSecret, realm, username, password string) (*userdata.JWT, error)
 
 	UpdateUser(ctx context.Context, token, realm string, user userdata.User) error
+	// DeleteUser - Удаляем user'а из keycloak по userID
+	DeleteUser(ctx context.Context, token, realm, userID string) error
+	// ExecuteActionsEmail - Отправляем user'у письмо со ссылкой на выполнение required actions
+	ExecuteActionsEmail(ctx context.Context, token, realm, userID string, actions []userdata.RequiredAction, params userdata.ExecuteActionsEmailParams) error
+	// SendVerifyEmail - Отправляем user'у письмо с подтверждением email
+	SendVerifyEmail(ctx context.Context, token, realm, userID string, params userdata.SendVerifyEmailParams) error
+
+	// GetUserGroups - Получаем группы, в которых состоит user
+	GetUserGroups(ctx context.Context, token, realm, userID string) ([]*userdata.Group, error)
+	// AddUserToGroup - Добавляем user'а в группу
+	AddUserToGroup(ctx context.Context, token, realm, userID, groupID string) error
+	// DeleteUserFromGroup - Удаляем user'а из группы
+	DeleteUserFromGroup(ctx context.Context, token, realm, userID, groupID string) error
+
+	// GetRealmRolesByUserID - Получаем роли realm'а, назначенные user'у напрямую
+	GetRealmRolesByUserID(ctx context.Context, token, realm, userID string) ([]*userdata.Role, error)
+	// GetCompositeRealmRolesByUserID - Получаем роли realm'а user'а с учётом групп и composite ролей
+	GetCompositeRealmRolesByUserID(ctx context.Context, token, realm, userID string) ([]*userdata.Role, error)
+	// AddRealmRolesToUser - Назначаем user'у роли realm'а
+	AddRealmRolesToUser(ctx context.Context, token, realm, userID string, roles []userdata.Role) error
+	// DeleteRealmRolesFromUser - Снимаем с user'а роли realm'а
+	DeleteRealmRolesFromUser(ctx context.Context, token, realm, userID string, roles []userdata.Role) error
+	// GetClientRolesByUserID - Получаем роли client'а, назначенные user'у напрямую
+	GetClientRolesByUserID(ctx context.Context, token, realm, idOfClient, userID string) ([]*userdata.Role, error)
+	// GetCompositeClientRolesByUserID - Получаем роли client'а user'а с учётом групп и composite ролей
+	GetCompositeClientRolesByUserID(ctx context.Context, token, realm, idOfClient, userID string) ([]*userdata.Role, error)
+	// AddClientRolesToUser - Назначаем user'у роли client'а
+	AddClientRolesToUser(ctx context.Context, token, realm, idOfClient, userID string, roles []userdata.Role) error
+	// DeleteClientRolesFromUser - Снимаем с user'а роли client'а
+	DeleteClientRolesFromUser(ctx context.Context, token, realm, idOfClient, userID string, roles []userdata.Role) error
 }